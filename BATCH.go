@@ -0,0 +1,224 @@
+package history
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// BatchFlushMax flushes the insert queue of a hashDB_Worker when it holds N offsets.
+	// The queue is flushed latest every BatchFlushEvery milliseconds.
+	// 0 or 1 disables batching: every insert is a single query.
+	BatchFlushMax int = 512
+)
+
+// HashDBBatcher is implemented by backends which can commit many offsets at once.
+// hashDB_Worker falls back to InsertOffset for backends without InsertOffsets.
+// If a batch fails after a part got committed the retry may store an offset twice:
+// readers check every offset against history.dat, so this is harmless.
+type HashDBBatcher interface {
+	// InsertOffsets appends all offsets of batch in one transaction per database or table.
+	InsertOffsets(batch []*OffsetData) error
+}
+
+// BatchStats holds the counters of all flushed batches.
+type BatchStats struct {
+	Batches      uint64        // committed batches
+	Items        uint64        // committed offsets
+	Errors       uint64        // failed batches: items stay queued for the next flush
+	LastSize     int           // items in the last batch
+	MaxSize      int           // items in the biggest batch
+	LastLatency  time.Duration // commit duration of the last batch
+	MaxLatency   time.Duration // commit duration of the slowest batch
+	TotalLatency time.Duration // sum of all commit durations
+	IndexLost    bool          // an offset did not reach the hashDB: the next boot replays history.dat
+}
+
+// AvgSize returns the average number of items per batch.
+func (bs BatchStats) AvgSize() float64 {
+	if bs.Batches == 0 {
+		return 0
+	}
+	return float64(bs.Items) / float64(bs.Batches)
+} // end func AvgSize
+
+// AvgLatency returns the average commit duration of a batch.
+func (bs BatchStats) AvgLatency() time.Duration {
+	if bs.Batches == 0 {
+		return 0
+	}
+	return bs.TotalLatency / time.Duration(bs.Batches)
+} // end func AvgLatency
+
+type batchCounter struct {
+	mux   sync.Mutex
+	stats BatchStats
+}
+
+// GetBatchStats returns a copy of the batch counters.
+func (his *HISTORY) GetBatchStats() BatchStats {
+	his.batchStats.mux.Lock()
+	stats := his.batchStats.stats
+	his.batchStats.mux.Unlock()
+	stats.IndexLost = his.indexLost.Load()
+	return stats
+} // end func GetBatchStats
+
+func (his *HISTORY) countBatch(size int, latency time.Duration, err error) {
+	his.batchStats.mux.Lock()
+	defer his.batchStats.mux.Unlock()
+	bs := &his.batchStats.stats
+	if err != nil {
+		bs.Errors++
+		return
+	}
+	bs.Batches++
+	bs.Items += uint64(size)
+	bs.LastSize = size
+	if size > bs.MaxSize {
+		bs.MaxSize = size
+	}
+	bs.LastLatency = latency
+	if latency > bs.MaxLatency {
+		bs.MaxLatency = latency
+	}
+	bs.TotalLatency += latency
+} // end func countBatch
+
+// batchQueue collects the inserts of one hashDB_Worker.
+// Only the owning hashDB_Worker touches it: no mutex needed.
+type batchQueue struct {
+	char    string
+	items   []*OffsetData
+	pending map[string][]int64 // key: offsets queued but not yet committed
+}
+
+func newBatchQueue(char string, size int) *batchQueue {
+	return &batchQueue{
+		char:    char,
+		items:   make([]*OffsetData, 0, size),
+		pending: make(map[string][]int64, size),
+	}
+} // end func newBatchQueue
+
+func (bq *batchQueue) add(key string, offset int64) {
+	bq.items = append(bq.items, &OffsetData{Shorthash: key, Offset: offset})
+	bq.pending[key] = append(bq.pending[key], offset)
+} // end func add
+
+// flush commits all queued offsets to the backend.
+// On error the items stay queued and the next flush tries again.
+func (bq *batchQueue) flush(his *HISTORY) error {
+	if len(bq.items) == 0 {
+		return nil
+	}
+	start := time.Now()
+	// MigrateShardMode copies the hashDB meanwhile: offsets go to both
+	m := his.migration.Load()
+	if m != nil {
+		m.mux.RLock()
+		defer m.mux.RUnlock()
+	}
+	var err error
+	if batcher, ok := his.hashDB.(HashDBBatcher); ok {
+		err = batcher.InsertOffsets(bq.items)
+	} else {
+		for i, od := range bq.items {
+			if err = his.hashDB.InsertOffset(od.Shorthash, od.Offset); err != nil {
+				if m != nil {
+					m.insert(bq.items[:i])
+				}
+				// drop what got inserted
+				bq.items = bq.items[i:]
+				bq.pending = make(map[string][]int64, len(bq.items))
+				for _, od := range bq.items {
+					bq.pending[od.Shorthash] = append(bq.pending[od.Shorthash], od.Offset)
+				}
+				break
+			}
+		}
+	}
+	his.countBatch(len(bq.items), time.Since(start), err)
+	if err != nil {
+		log.Printf("ERROR hashDB_Worker [%s] batch flush items=%d err='%v'", bq.char, len(bq.items), err)
+		return err
+	}
+	if m != nil {
+		m.insert(bq.items)
+	}
+	bq.items = bq.items[:0]
+	clear(bq.pending)
+	return nil
+} // end func flush
+
+// batchViaWorkers sends the offsets of batch with flag to the hashDB_Workers of their keys and waits for all.
+// Returns the sum of HistoryIndex.found. caller names the function in errors.
+func (his *HISTORY) batchViaWorkers(flag int64, batch []*OffsetData, caller string) (found int, err error) {
+	groups := make(map[string][]*OffsetData)
+	for _, od := range batch {
+		char := strings.ToLower(od.Shorthash[:his.cutChar])
+		groups[char] = append(groups[char], od)
+	}
+	sent := make([]*HistoryIndex, 0, len(groups))
+	for char, group := range groups {
+		hi := &HistoryIndex{Offset: flag, IndexRetChan: make(chan int, 1), batch: group}
+		select {
+		case his.indexChans[his.charsMap[char]] <- hi:
+			sent = append(sent, hi)
+		case <-his.workersDone:
+			err = fmt.Errorf("ERROR %s hashDB_Worker stopped: %w", caller, ErrClosed)
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, hi := range sent {
+		select {
+		case isDup := <-hi.IndexRetChan:
+			if isDup != CaseAdded {
+				err = fmt.Errorf("ERROR %s hashDB_Worker [%s] failed: %w", caller, hi.batch[0].Shorthash[:his.cutChar], ErrBackendUnavailable)
+				continue
+			}
+			found += int(hi.found)
+		case <-his.workersDone:
+			err = fmt.Errorf("ERROR %s hashDB_Worker stopped: %w", caller, ErrClosed)
+		}
+	}
+	return found, err
+} // end func batchViaWorkers
+
+// insertOffset commits a single offset if batching is disabled.
+// Like flush it writes the target of a running MigrateShardMode too.
+func (his *HISTORY) insertOffset(key string, offset int64) error {
+	m := his.migration.Load()
+	if m != nil {
+		m.mux.RLock()
+		defer m.mux.RUnlock()
+	}
+	if err := his.hashDB.InsertOffset(key, offset); err != nil {
+		return err
+	}
+	if m != nil {
+		m.insert([]*OffsetData{{Shorthash: key, Offset: offset}})
+	}
+	return nil
+} // end func insertOffset
+
+// groupOffsets merges all offsets of batch per key into the comma separated format of the 'o' column.
+// keys keeps the order of first appearance.
+func groupOffsets(batch []*OffsetData, enc int) (keys []string, values map[string][]byte) {
+	values = make(map[string][]byte, len(batch))
+	for _, od := range batch {
+		if len(od.Shorthash) < 4 {
+			continue
+		}
+		if _, exists := values[od.Shorthash]; !exists {
+			keys = append(keys, od.Shorthash)
+		}
+		values[od.Shorthash] = appendOffsets(values[od.Shorthash], enc, od.Offset)
+	}
+	return
+} // end func groupOffsets
@@ -0,0 +1,166 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultReserveTimeout: a hash reserved by Reserve is released after N seconds
+	// if neither AddHistory nor Release got called for it.
+	DefaultReserveTimeout int64 = 60
+)
+
+// CheckResult is the answer of Check and Reserve.
+// It maps to the NNTP CHECK/IHAVE responses.
+type CheckResult int
+
+const (
+	CheckWanted CheckResult = iota // send it: CHECK 238, IHAVE 335
+	CheckHave                      // don't want it, already have it: CHECK 438, IHAVE 435
+	CheckRetry                     // try later, it is in flight: CHECK 431, IHAVE 436
+)
+
+func (cr CheckResult) String() string {
+	switch cr {
+	case CheckWanted:
+		return "wanted"
+	case CheckHave:
+		return "have"
+	case CheckRetry:
+		return "retry"
+	}
+	return fmt.Sprintf("CheckResult(%d)", int(cr))
+} // end func String
+
+// reservations holds the hashes reserved by Reserve with their deadlines.
+type reservations struct {
+	mux      sync.Mutex
+	deadline map[string]time.Time
+}
+
+// Check returns if hash is wanted, already in history or in flight.
+// Check does not reserve hash: use Reserve for the CHECK/TAKETHIS flow.
+func (his *HISTORY) Check(hash string) (CheckResult, error) {
+	if len(hash) < 64 {
+		return CheckRetry, fmt.Errorf("ERROR Check hash='%s' too short", hash)
+	}
+	if his.isClosed() {
+		return CheckRetry, fmt.Errorf("ERROR Check: %w", ErrClosed)
+	}
+	if his.isReserved(hash) {
+		return CheckRetry, nil
+	}
+	if value, exists := his.L1.GetL1Cache(hash, his); exists {
+		switch value {
+		case CaseLock, CaseWrite:
+			return CheckRetry, nil
+		case CaseDupes, CaseAdded:
+			return CheckHave, nil
+		}
+	}
+	if his.IndexChan == nil {
+		// L1 cache only
+		return CheckWanted, nil
+	}
+	isDup, err := his.indexQueryCtx(context.Background(), hash)
+	if err != nil {
+		return CheckRetry, err
+	}
+	return checkResult(isDup)
+} // end func Check
+
+// Reserve checks hash and reserves it if it is wanted.
+// Other Check and Reserve calls get CheckRetry for a reserved hash
+// until AddHistory stored it, Release got called or DefaultReserveTimeout expired.
+func (his *HISTORY) Reserve(hash string) (CheckResult, error) {
+	if len(hash) < 64 {
+		return CheckRetry, fmt.Errorf("ERROR Reserve hash='%s' too short", hash)
+	}
+	if his.isClosed() {
+		return CheckRetry, fmt.Errorf("ERROR Reserve: %w", ErrClosed)
+	}
+	if his.isReserved(hash) {
+		return CheckRetry, nil
+	}
+	// IndexQuery keeps the L1 lock on CasePass: concurrent Reserve calls get CaseRetry
+	isDup, err := his.IndexQuery(hash, nil, FlagSearch)
+	if err != nil {
+		return CheckRetry, err
+	}
+	cr, err := checkResult(isDup)
+	if err != nil || cr != CheckWanted {
+		return cr, err
+	}
+	his.reserved.mux.Lock()
+	his.reserved.deadline[hash] = time.Now().Add(time.Duration(his.opts.ReserveTimeout) * time.Second)
+	his.reserved.mux.Unlock()
+	return CheckWanted, nil
+} // end func Reserve
+
+// Release drops the reservation of hash: the article got rejected or was not received.
+func (his *HISTORY) Release(hash string) {
+	his.unreserve(hash)
+	his.L1.ReleaseL1Cache(hash, his)
+} // end func Release
+
+func (his *HISTORY) isReserved(hash string) bool {
+	his.reserved.mux.Lock()
+	defer his.reserved.mux.Unlock()
+	deadline, exists := his.reserved.deadline[hash]
+	if !exists {
+		return false
+	}
+	if time.Now().After(deadline) {
+		delete(his.reserved.deadline, hash)
+		return false
+	}
+	return true
+} // end func isReserved
+
+func (his *HISTORY) unreserve(hash string) {
+	his.reserved.mux.Lock()
+	delete(his.reserved.deadline, hash)
+	his.reserved.mux.Unlock()
+} // end func unreserve
+
+// reserveJanitor removes expired reservations until Close.
+func (his *HISTORY) reserveJanitor() {
+	defer his.bgWG.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-his.stop:
+			return
+		case now := <-ticker.C:
+			var expired []string
+			his.reserved.mux.Lock()
+			for hash, deadline := range his.reserved.deadline {
+				if now.After(deadline) {
+					delete(his.reserved.deadline, hash)
+					expired = append(expired, hash)
+				}
+			}
+			his.reserved.mux.Unlock()
+			for _, hash := range expired {
+				his.L1.ReleaseL1Cache(hash, his)
+			}
+		}
+	}
+} // end func reserveJanitor
+
+// checkResult maps the reply of IndexQuery to a CheckResult.
+func checkResult(isDup int) (CheckResult, error) {
+	switch isDup {
+	case CasePass:
+		return CheckWanted, nil
+	case CaseDupes, CaseAdded:
+		return CheckHave, nil
+	case CaseRetry, CaseLock, CaseWrite:
+		return CheckRetry, nil
+	}
+	return CheckRetry, fmt.Errorf("ERROR checkResult unknown isDup=%x", isDup)
+} // end func checkResult
@@ -0,0 +1,392 @@
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-while/go-utils"
+)
+
+// Compact writes history.dat.compact and renames it to history.dat.
+// CompactMarkerFile exists from right before the rename until the hashDB is remapped.
+// If BootHistory finds it the hashDB may hold old offsets and gets rebuilt by a forced replay.
+const (
+	compactTmpFile    = "history.dat.compact"
+	CompactMarkerFile = "history.compact"
+)
+
+// flagFlush asks a hashDB_Worker to commit its batch queue and reply. See workerBarrier.
+const flagFlush = -2
+
+// HashDBRemapper is implemented by backends which can rewrite all offsets.
+// Compact uses it to move the offsets to the positions in the compacted history.dat.
+type HashDBRemapper interface {
+	// RemapOffsets replaces every offset with remap(offset). Offsets with ok=false are removed,
+	// keys without offsets left are deleted. Returns the number of changed keys and removed offsets.
+	RemapOffsets(remap func(offset int64) (newOffset int64, ok bool)) (keys int, offsets int, err error)
+}
+
+// CompactStats is returned by Compact.
+type CompactStats struct {
+	Lines        uint64        // history lines read
+	Dropped      uint64        // dead or bad lines removed
+	OldSize      int64         // size of history.dat before
+	NewSize      int64         // size of history.dat after
+	RemappedKeys int           // keys rewritten in the hashDB
+	Duration     time.Duration // runtime
+}
+
+// offsetRemap maps offsets of the old history.dat to the compacted one.
+// Lines keep their order: a line moves back by the size of all dropped lines before it.
+type offsetRemap struct {
+	drops []int64 // sorted offsets of dropped lines
+	shift []int64 // shift[i]: bytes dropped up to and including drops[i]
+	end   int64   // size of the old history.dat: offsets >= end are already new
+}
+
+// translate returns the new offset of old or false if its line got dropped.
+func (r *offsetRemap) translate(old int64) (int64, bool) {
+	if old >= r.end {
+		return old, true
+	}
+	i := sort.Search(len(r.drops), func(i int) bool { return r.drops[i] >= old })
+	if i < len(r.drops) && r.drops[i] == old {
+		return 0, false
+	}
+	if i == 0 {
+		return old, true
+	}
+	return old - r.shift[i-1], true
+} // end func translate
+
+// writerPause is sent to history_Writer by Compact.
+// history_Writer closes paused and waits for resume:
+// a new file handle replaces history.dat, nil continues with the old one.
+type writerPause struct {
+	paused chan struct{}
+	resume chan *os.File
+}
+
+// Compact removes dead lines from history.dat: expired entries older than Remember and broken lines.
+// Live lines keep their order. All offsets in the hashDB are moved to the new positions.
+//
+// Compact runs online: history_Writer pauses only while the last lines are copied and the files are swapped.
+// Lookups stay correct while the hashDB is remapped: hashDB_Worker checks the old and the new position
+// of every offset against history.dat and holds new offsets back until the remap is done.
+// After a crash BootHistory rebuilds the hashDB with a forced replay.
+// Compact refuses a history with segments.
+func (his *HISTORY) Compact() (*CompactStats, error) {
+	his.mux.Lock()
+	if his.stop == nil || his.WriterChan == nil {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Compact: %w", ErrNotBooted)
+	}
+	if his.isClosed() {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Compact: %w", ErrClosed)
+	}
+	if his.opts.SegmentSize > 0 || his.opts.SegmentEvery > 0 || his.segment.Load() > 0 {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Compact does not work with segments, Expire drops whole segments: %w", ErrInvalidConfig)
+	}
+	remapper, canRemap := his.hashDB.(HashDBRemapper)
+	if his.hashDB != nil && !canRemap {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Compact hashDB %T can not remap offsets: %w", his.hashDB, ErrInvalidConfig)
+	}
+	// Close waits for us before it closes the hashDB
+	his.bgWG.Add(1)
+	his.mux.Unlock()
+	defer his.bgWG.Done()
+
+	// Expire and ReplayHisDat must not touch history.dat or the hashDB meanwhile
+	for _, lock := range []chan struct{}{his.lockCompact, his.lockExpire, his.lockReplay} {
+		if !LOCKfunc(lock, "Compact") {
+			return nil, fmt.Errorf("ERROR Compact: Compact, Expire or ReplayHisDat running")
+		}
+		defer UNLOCKfunc(lock, "Compact")
+	}
+	// UpdateEntry waits: its writes would be lost in the copy
+	his.inplaceMux.Lock()
+	defer his.inplaceMux.Unlock()
+	return his.compact(remapper, time.Now().Unix())
+} // end func Compact
+
+func (his *HISTORY) compact(remapper HashDBRemapper, now int64) (*CompactStats, error) {
+	start := time.Now()
+	stats := &CompactStats{}
+	tmpPath := his.DIR + "/" + compactTmpFile
+	markerPath := his.DIR + "/" + CompactMarkerFile
+
+	src, err := os.OpenFile(his.hisDat, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Compact: %w: %w", ErrHisDat, err)
+	}
+	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Compact Stat: %w: %w", ErrHisDat, err)
+	}
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Compact: %w: %w", ErrHisDat, err)
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			dst.Close() // may be closed already
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// 1. copy live lines while history_Writer keeps appending
+	remap := &offsetRemap{}
+	endA := fileInfo.Size()
+	reader := bufio.NewReaderSize(io.NewSectionReader(src, 0, endA), 1024*1024)
+	dw := bufio.NewWriterSize(dst, 1024*1024)
+	header, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Compact reading header err='%v': %w", err, ErrBadHeader)
+	}
+	if _, err := dw.Write(header); err != nil {
+		return nil, fmt.Errorf("ERROR Compact: %w: %w", ErrHisDat, err)
+	}
+	offset, dropped := int64(len(header)), int64(0)
+	drop := func(size int64) {
+		dropped += size
+		remap.drops = append(remap.drops, offset)
+		remap.shift = append(remap.shift, dropped)
+		stats.Dropped++
+	}
+	rs := newRecordScanner(reader, his.settings.Fv)
+	for {
+		rec, n, err := rs.next()
+		if err == errBadRecord {
+			drop(n)
+			offset += n
+			continue
+		}
+		if err != nil {
+			// io.EOF: a partial record at the end gets copied with the tail
+			endA = offset
+			break
+		}
+		hl, ok := parseRecord(rec, his.settings.Fv)
+		if !ok || (isExpiredToken(hl.token) && hl.arrival+his.opts.Remember <= now) {
+			drop(n)
+			offset += n
+			continue
+		}
+		stats.Lines++
+		if _, err := dw.Write(rec); err != nil {
+			return nil, fmt.Errorf("ERROR Compact: %w: %w", ErrHisDat, err)
+		}
+		offset += n
+	}
+	stats.Lines += stats.Dropped
+	if stats.Dropped == 0 {
+		logf(DEBUG, "Compact nothing to drop lines=%d", stats.Lines)
+		stats.OldSize, stats.NewSize = endA, endA
+		stats.Duration = time.Since(start)
+		return stats, nil
+	}
+
+	// 2. pause history_Writer and commit the queued offsets: they are still old
+	pause := &writerPause{paused: make(chan struct{}), resume: make(chan *os.File, 1)}
+	select {
+	case his.pauseWriter <- pause:
+	case <-his.writerDone:
+		return nil, fmt.Errorf("ERROR Compact history_Writer stopped: %w", ErrClosed)
+	}
+	<-pause.paused
+	resumed := false
+	resume := func(fh *os.File) {
+		if !resumed {
+			resumed = true
+			pause.resume <- fh
+		}
+	}
+	defer resume(nil)
+	if err := his.workerBarrier(); err != nil {
+		return nil, err
+	}
+
+	// 3. copy the lines appended meanwhile
+	endB := his.Offset
+	if _, err := io.Copy(dw, io.NewSectionReader(src, endA, endB-endA)); err != nil {
+		return nil, fmt.Errorf("ERROR Compact copy tail: %w: %w", ErrHisDat, err)
+	}
+	if err := dw.Flush(); err != nil {
+		return nil, fmt.Errorf("ERROR Compact Flush: %w: %w", ErrHisDat, err)
+	}
+	if err := dst.Sync(); err != nil {
+		return nil, fmt.Errorf("ERROR Compact Sync: %w: %w", ErrHisDat, err)
+	}
+	if err := dst.Close(); err != nil {
+		return nil, fmt.Errorf("ERROR Compact Close: %w: %w", ErrHisDat, err)
+	}
+	// opened before the rename: history_Writer gets a valid handle or nothing changes
+	newfh, err := os.OpenFile(tmpPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Compact: %w: %w", ErrHisDat, err)
+	}
+	defer func() {
+		if !swapped {
+			newfh.Close()
+		}
+	}()
+	remap.end = endB
+	newSize := endB - dropped
+
+	// 4. from now on hashDB_Worker checks old and new positions
+	if remapper != nil {
+		his.remap.Store(remap)
+		if err := his.workerBarrier(); err != nil {
+			his.remap.Store(nil)
+			return nil, err
+		}
+	}
+
+	// 5. swap history.dat
+	if err := os.WriteFile(markerPath, []byte(fmt.Sprintf("%d\n", endB)), 0644); err != nil {
+		his.remap.Store(nil)
+		return nil, fmt.Errorf("ERROR Compact writing %s: %w", CompactMarkerFile, err)
+	}
+	if err := os.Rename(tmpPath, his.hisDat); err != nil {
+		his.remap.Store(nil)
+		os.Remove(markerPath)
+		return nil, fmt.Errorf("ERROR Compact Rename: %w: %w", ErrHisDat, err)
+	}
+	swapped = true
+	syncDir(his.DIR)
+	if his.reader != nil {
+		// the old mapping still holds the old positions: remapMatch checks both until now
+		if err := his.reader.reopen(0); err != nil {
+			log.Printf("ERROR Compact reader.reopen err='%v'", err)
+		}
+	}
+	his.Offset = newSize
+	resume(newfh)
+	stats.OldSize, stats.NewSize = endB, newSize
+	log.Printf("Compact swapped history.dat oldSize=%d newSize=%d dropped=%d", endB, newSize, stats.Dropped)
+
+	// 6. move the offsets in the hashDB
+	if remapper != nil {
+		keys, _, err := remapper.RemapOffsets(remap.translate)
+		if err != nil {
+			// keep remap active and the marker: next boot rebuilds the hashDB
+			his.indexLost.Store(true)
+			return stats, fmt.Errorf("ERROR Compact RemapOffsets: %w: %w", ErrBackendUnavailable, err)
+		}
+		stats.RemappedKeys = keys
+		his.remap.Store(nil)
+		// commit offsets held back during the remap
+		if err := his.workerBarrier(); err != nil {
+			return stats, err
+		}
+		if err := his.writeReplayCheckpoint(newSize); err != nil {
+			return stats, err
+		}
+	}
+	if err := os.Remove(markerPath); err != nil {
+		return stats, fmt.Errorf("ERROR Compact removing %s: %w", CompactMarkerFile, err)
+	}
+	stats.Duration = time.Since(start)
+	log.Printf("Compact done lines=%d dropped=%d oldSize=%d newSize=%d remappedKeys=%d took=(%d ms)",
+		stats.Lines, stats.Dropped, stats.OldSize, stats.NewSize, stats.RemappedKeys, stats.Duration.Milliseconds())
+	return stats, nil
+} // end func compact
+
+// workerBarrier sends flagFlush to every hashDB_Worker and waits for all replies.
+// When it returns every request received before got processed.
+// Workers commit their batch queue unless Compact is remapping the hashDB.
+func (his *HISTORY) workerBarrier() error {
+	if his.IndexChan == nil {
+		return nil
+	}
+	replies := make([]chan int, len(his.indexChans))
+	for i, indexchan := range his.indexChans {
+		replies[i] = make(chan int, 1)
+		select {
+		case indexchan <- &HistoryIndex{Offset: flagFlush, IndexRetChan: replies[i]}:
+		case <-his.workersDone:
+			return fmt.Errorf("ERROR workerBarrier hashDB_Workers stopped: %w", ErrClosed)
+		}
+	}
+	for _, reply := range replies {
+		select {
+		case isDup := <-reply:
+			if isDup != CaseAdded {
+				return fmt.Errorf("ERROR workerBarrier batch flush failed: %w", ErrBackendUnavailable)
+			}
+		case <-his.workersDone:
+			return fmt.Errorf("ERROR workerBarrier hashDB_Workers stopped: %w", ErrClosed)
+		}
+	}
+	return nil
+} // end func workerBarrier
+
+// pauseHistoryWriter is called by history_Writer when Compact sends a writerPause.
+func (his *HISTORY) pauseHistoryWriter(hw *historyWindow, p *writerPause) error {
+	// nothing may wait for a fsync of the old file
+	if err := his.syncHisDat(hw); err != nil {
+		close(p.paused)
+		<-p.resume
+		return err
+	}
+	close(p.paused)
+	fh := <-p.resume
+	if fh == nil {
+		return nil
+	}
+	if err := hw.fh.Close(); err != nil {
+		log.Printf("ERROR history_Writer closing old history.dat err='%v'", err)
+	}
+	hw.fh = fh
+	hw.dw.Reset(fh)
+	hw.buffered = 0
+	return nil
+} // end func pauseHistoryWriter
+
+// remapMatch returns true if hash is found at the old or the new position of any offset.
+// Used by hashDB_Worker while Compact remaps the hashDB: an offset can be old or new.
+func (his *HISTORY) remapMatch(r *offsetRemap, offsets []int64, char string, hash string) bool {
+	for _, offset := range offsets {
+		candidates := []int64{offset}
+		if newOffset, ok := r.translate(offset); ok && newOffset != offset {
+			candidates = append(candidates, newOffset)
+		}
+		for _, candidate := range candidates {
+			var hashFromFile string
+			// an old offset may not point to a line start in the new file: errors are expected
+			if err := his.FseekHistoryMessageHash(nil, candidate, char, &hashFromFile); err == nil && hashFromFile == hash {
+				return true
+			}
+		}
+	}
+	return false
+} // end func remapMatch
+
+// checkCompactMarker is called by BootHistory.
+// Returns true if a Compact did not finish remapping the hashDB.
+func (his *HISTORY) checkCompactMarker() bool {
+	os.Remove(his.DIR + "/" + compactTmpFile)
+	if !utils.FileExists(his.DIR + "/" + CompactMarkerFile) {
+		return false
+	}
+	log.Printf("WARN BootHistory found %s: Compact did not finish, rebuilding the hashDB", CompactMarkerFile)
+	return true
+} // end func checkCompactMarker
+
+// syncDir fsyncs a directory to persist a rename.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+} // end func syncDir
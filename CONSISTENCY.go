@@ -0,0 +1,234 @@
+package history
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// RunningMarkerFile exists in HistoryDir while a history is booted.
+// Close removes it after history.dat got flushed.
+// If BootHistory finds it the last shutdown was not clean and history.dat is checked against the hashDB.
+const RunningMarkerFile = "history.running"
+
+// HashDBPruner is implemented by backends which can remove offsets.
+// BootHistory uses it after a crash to remove offsets pointing past the end of history.dat.
+type HashDBPruner interface {
+	// PruneOffsets removes all offsets >= from. Keys without offsets left are deleted.
+	// It returns the number of changed keys and removed offsets.
+	PruneOffsets(from int64) (keys int, offsets int, err error)
+}
+
+// ConsistencyReport tells what BootHistory fixed after a crash.
+type ConsistencyReport struct {
+	Clean          bool         // last shutdown was clean: nothing to check
+	Size           int64        // size of history.dat after the check
+	TruncatedBytes int64        // partial line cut off the end of history.dat
+	PrunedKeys     int          // keys which had offsets past the end of history.dat
+	PrunedOffsets  int          // offsets past the end of history.dat removed from the hashDB
+	Replay         *ReplayStats // missing offsets replayed into the hashDB. nil: no replay
+	Compact        bool         // an unfinished Compact left old offsets: the hashDB got rebuilt
+}
+
+// GetConsistencyReport returns what BootHistory checked and fixed.
+func (his *HISTORY) GetConsistencyReport() ConsistencyReport {
+	his.mux.Lock()
+	report := his.consistency
+	his.mux.Unlock()
+	return report
+} // end func GetConsistencyReport
+
+// checkHisDatTail cuts a partial line off the end of the segment at path: history_Writer appends only to the last one.
+// first is the offset of the first line after the header, format the record format of the segment.
+// Returns the number of bytes cut off.
+func (his *HISTORY) checkHisDatTail(path string, first int64, format int) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fileInfo.Size()
+	if size <= first {
+		return 0, nil
+	}
+	end := size
+	if format == FormatBinary {
+		// records have a fixed length
+		end = size - (size-first)%binRecordLen
+		if end == size {
+			return 0, nil
+		}
+		log.Printf("WARN BootHistory cuts partial record off '%s' offset=%d size=%d", path, end, size)
+		if err := os.Truncate(path, end); err != nil {
+			return 0, err
+		}
+		return size - end, nil
+	}
+	// search the last LF backwards
+	buf := make([]byte, 4096)
+	for pos := size; pos > first; {
+		n := int64(len(buf))
+		if pos-first < n {
+			n = pos - first
+		}
+		pos -= n
+		if _, err := file.ReadAt(buf[:n], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = pos + int64(i) + 1
+			break
+		}
+		if pos == first {
+			end = first // no complete line at all
+		}
+	}
+	if end == size {
+		return 0, nil
+	}
+	log.Printf("WARN BootHistory cuts partial line off '%s' offset=%d size=%d", path, end, size)
+	if err := os.Truncate(path, end); err != nil {
+		return 0, err
+	}
+	return size - end, nil
+} // end func checkHisDatTail
+
+// checkHashDB removes offsets past the end of history.dat from the hashDB after a crash
+// and replays lines missing in the hashDB. Called by BootHistory before the workers start.
+// After an unfinished Compact every offset goes: old offsets point into other lines of the compacted history.dat.
+func (his *HISTORY) checkHashDB() error {
+	his.consistency.Compact = his.checkCompactMarker()
+	if !his.consistency.Clean || his.consistency.Compact {
+		from := his.Offset
+		if his.consistency.Compact {
+			from = 0 // empties the hashDB: the forced replay rebuilds it
+		}
+		if pruner, ok := his.hashDB.(HashDBPruner); ok {
+			keys, offsets, err := pruner.PruneOffsets(from)
+			if err != nil {
+				return fmt.Errorf("ERROR checkHashDB PruneOffsets: %w: %w", ErrBackendUnavailable, err)
+			}
+			his.consistency.PrunedKeys = keys
+			his.consistency.PrunedOffsets = offsets
+		} else if his.consistency.Compact {
+			return fmt.Errorf("ERROR checkHashDB hashDB %T can not drop the offsets of the old history.dat, empty it and boot again: %w", his.hashDB, ErrHashDBMismatch)
+		} else {
+			log.Printf("WARN checkHashDB hashDB %T can not remove offsets past the end of history.dat", his.hashDB)
+		}
+	}
+	stats, err := his.replayAtBoot(his.consistency.Compact)
+	if err != nil {
+		return err
+	}
+	his.consistency.Replay = stats
+	if his.consistency.Compact && stats != nil {
+		if err := os.Remove(his.DIR + "/" + CompactMarkerFile); err != nil {
+			return fmt.Errorf("ERROR checkHashDB removing %s: %w", CompactMarkerFile, err)
+		}
+	}
+	return nil
+} // end func checkHashDB
+
+func (his *HISTORY) logConsistencyReport() {
+	r := his.consistency
+	if r.Clean && !r.Compact {
+		return
+	}
+	replayed := uint64(0)
+	if r.Replay != nil {
+		replayed = r.Replay.Inserted
+	}
+	log.Printf("BootHistory recovered from unclean shutdown: size=%d truncated=%d prunedKeys=%d prunedOffsets=%d replayed=%d compact=%t",
+		r.Size, r.TruncatedBytes, r.PrunedKeys, r.PrunedOffsets, replayed, r.Compact)
+} // end func logConsistencyReport
+
+// remapOffsetsTable replaces every offset in table with remap(offset).
+// Offsets with ok=false are removed, keys without offsets left are deleted.
+// Changed values are written in encoding enc. Works with SQLite3 and MySQL.
+func remapOffsetsTable(db *sql.DB, table string, enc int, remap func(offset int64) (int64, bool)) (keys int, offsets int, err error) {
+	rows, err := db.Query("SELECT h, o FROM " + table)
+	if err != nil {
+		return 0, 0, err
+	}
+	update := make(map[string][]byte)
+	for rows.Next() {
+		var h string
+		var o []byte
+		if err := rows.Scan(&h, &o); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		kept, changed, removed := remapOffsetList(o, enc, remap)
+		if changed {
+			update[h] = kept
+			offsets += removed
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(update) == 0 {
+		return 0, 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	for h, kept := range update {
+		if len(kept) == 0 {
+			_, err = tx.Exec("DELETE FROM "+table+" WHERE h = ?", h)
+		} else {
+			_, err = tx.Exec("UPDATE "+table+" SET o = ? WHERE h = ?", kept, h)
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(update), offsets, nil
+} // end func remapOffsetsTable
+
+// remapOffsetList applies remap to the offsets of value and returns them in encoding enc.
+// A value which can not be decoded is kept.
+func remapOffsetList(value []byte, enc int, remap func(offset int64) (int64, bool)) (kept []byte, changed bool, removed int) {
+	offsets, err := decodeOffsets(nil, value)
+	if err != nil {
+		log.Printf("WARN remapOffsetList err='%v'", err)
+		return value, false, 0
+	}
+	remapped := offsets[:0]
+	for _, offset := range offsets {
+		newOffset, ok := remap(offset)
+		if !ok {
+			removed++
+			changed = true
+			continue
+		}
+		if newOffset != offset {
+			changed = true
+		}
+		remapped = append(remapped, newOffset)
+	}
+	if !changed || len(remapped) == 0 {
+		return nil, changed, removed
+	}
+	return encodeOffsets(enc, remapped...), changed, removed
+} // end func remapOffsetList
+
+// pruneBelow returns a remap function which removes all offsets >= from.
+func pruneBelow(from int64) func(offset int64) (int64, bool) {
+	return func(offset int64) (int64, bool) {
+		return offset, offset < from
+	}
+} // end func pruneBelow
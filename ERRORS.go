@@ -0,0 +1,24 @@
+package history
+
+import (
+	"errors"
+)
+
+// Boot, init and Close paths return errors wrapping one of these values.
+// Test with errors.Is(err, ErrBadHeader).
+var (
+	ErrAlreadyBooted      = errors.New("history already booted")
+	ErrInvalidConfig      = errors.New("invalid history config")
+	ErrNoHistoryDir       = errors.New("history dir not available")
+	ErrHisDat             = errors.New("history.dat io error")
+	ErrBadHeader          = errors.New("bad history.dat header")
+	ErrKeyLenMismatch     = errors.New("keylen mismatch")
+	ErrHashDBMismatch     = errors.New("hashDB does not match BootOptions")
+	ErrBackendUnavailable = errors.New("hashDB backend unavailable")
+	ErrListen             = errors.New("historyServer listen failed")
+	ErrNotBooted          = errors.New("history not booted")
+	ErrClosed             = errors.New("history closed")
+	ErrNotFound           = errors.New("hash not found in history")
+	ErrNoHashDB           = errors.New("no hashDB to look up offsets")
+	ErrIndexLost          = errors.New("offsets did not reach the hashDB")
+)
@@ -0,0 +1,436 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// DefaultExpireEvery runs Expire every N seconds. 0 disables the schedule.
+	DefaultExpireEvery int64 = 0
+	// DefaultExpireAfter expires lines without Expires N seconds after Arrival. 0: never
+	DefaultExpireAfter int64 = 0
+	// DefaultRemember keeps an expired entry N seconds after Arrival to reject its hash, like INN's /remember/.
+	DefaultRemember int64 = 11 * 86400
+	// ExpireRemoveKeys removes entries older than Remember from the hashDB
+	ExpireRemoveKeys bool = false
+)
+
+// positions in a history line: {sha256}\t%010d~%s~%010d\t%s\n
+const (
+	lineArrivalPos = 67
+	lineExpiresPos = 78
+	lineDatePos    = 89
+	lineTokenPos   = 100
+)
+
+// historyLine holds the parsed fields of a line in history.dat.
+type historyLine struct {
+	hash    string
+	arrival int64
+	expires int64 // 0: never
+	date    int64
+	token   []byte // points into the line
+}
+
+// parseHistoryLine parses a line of history.dat including its LF.
+func parseHistoryLine(line []byte) (hl historyLine, ok bool) {
+	hash, ok := parseHistoryLineHash(line)
+	if !ok || len(line) < lineTokenPos+2 || line[len(line)-1] != '\n' ||
+		line[lineExpiresPos-1] != '~' || line[lineDatePos-1] != '~' || line[lineTokenPos-1] != '\t' {
+		return hl, false
+	}
+	hl.hash = hash
+	var err error
+	if hl.arrival, err = strconv.ParseInt(string(line[lineArrivalPos:lineExpiresPos-1]), 10, 64); err != nil {
+		return hl, false
+	}
+	if expires := string(line[lineExpiresPos : lineDatePos-1]); expires != DefExpiresStr {
+		if hl.expires, err = strconv.ParseInt(expires, 10, 64); err != nil {
+			return hl, false
+		}
+	}
+	if hl.date, err = strconv.ParseInt(string(line[lineDatePos:lineTokenPos-1]), 10, 64); err != nil {
+		return hl, false
+	}
+	hl.token = line[lineTokenPos : len(line)-1]
+	return hl, true
+} // end func parseHistoryLine
+
+// isExpiredToken returns true if token marks an expired entry: only 'X'.
+func isExpiredToken(token []byte) bool {
+	return len(token) > 0 && len(bytes.Trim(token, "X")) == 0
+} // end func isExpiredToken
+
+// HashDBRemover is implemented by backends which can remove single offsets.
+// Expire uses it to forget entries older than Remember.
+type HashDBRemover interface {
+	// RemoveOffsets removes the offsets of batch and returns how many it found.
+	// Keys without offsets left are deleted.
+	RemoveOffsets(batch []*OffsetData) (int, error)
+}
+
+// flagRemove asks a hashDB_Worker to remove HistoryIndex.batch. See forget.
+const flagRemove = -5
+
+// ExpireStats is returned by Expire.
+type ExpireStats struct {
+	Lines           uint64        // history lines read
+	Expired         uint64        // lines marked as expired in this run
+	Forgotten       uint64        // expired entries older than Remember removed from the hashDB in this run
+	BadLines        uint64        // lines which are not a history line: ignored
+	DroppedSegments int           // whole segments removed: all their entries were forgotten
+	Duration        time.Duration // runtime
+}
+
+// Expire walks history.dat and marks every line whose Expires passed as expired:
+// its StorageToken is overwritten in place with 'X' so offsets do not move.
+// Lines without Expires expire ExpireAfter seconds after Arrival if set.
+// An expired entry keeps rejecting its hash until Remember seconds after Arrival.
+// Then, if ExpireRemoveKeys is set, its offset is removed from the hashDB and the hash is accepted again.
+// With segments a whole old segment is removed once all its entries are forgotten.
+// BootOptions.ExpireEvery runs Expire on a schedule.
+func (his *HISTORY) Expire() (*ExpireStats, error) {
+	his.mux.Lock()
+	if his.stop == nil || his.WriterChan == nil {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Expire: %w", ErrNotBooted)
+	}
+	if his.isClosed() {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR Expire: %w", ErrClosed)
+	}
+	// Close waits for us before it closes the hashDB
+	his.bgWG.Add(1)
+	his.mux.Unlock()
+	defer his.bgWG.Done()
+	return his.expire(time.Now().Unix())
+} // end func Expire
+
+func (his *HISTORY) expire(now int64) (*ExpireStats, error) {
+	if !LOCKfunc(his.lockExpire, "Expire") {
+		return nil, fmt.Errorf("ERROR Expire already running")
+	}
+	defer UNLOCKfunc(his.lockExpire, "Expire")
+
+	segs, err := his.listSegments()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Expire listSegments: %w: %w", ErrHisDat, err)
+	}
+	start := time.Now()
+	stats := &ExpireStats{}
+	remover, canRemove := his.hashDB.(HashDBRemover)
+	if his.opts.ExpireRemoveKeys && his.hashDB != nil && !canRemove {
+		log.Printf("WARN Expire hashDB %T can not remove offsets", his.hashDB)
+	}
+	// a segment can go once the hashDB forgot all its lines
+	canDrop := his.opts.ExpireRemoveKeys && (his.hashDB == nil || canRemove)
+	// entries forgotten until since were removed by the previous run, unless UpdateEntry expired them later
+	since := his.expireLast
+	redo := his.expireRedo.Swap(0)
+	if redo != 0 && redo <= since {
+		since = redo - 1
+	}
+	for _, seg := range segs {
+		dead, err := his.expireSegment(seg, now, since, remover, canRemove, stats)
+		if err != nil {
+			if redo != 0 {
+				his.redoExpire(redo)
+			}
+			return stats, err
+		}
+		// history_Writer appends only to the last segment
+		if dead && canDrop && seg < int(his.segment.Load()) {
+			if err := his.dropSegment(seg); err != nil {
+				if redo != 0 {
+					his.redoExpire(redo)
+				}
+				return stats, fmt.Errorf("ERROR Expire dropSegment %d: %w: %w", seg, ErrHisDat, err)
+			}
+			stats.DroppedSegments++
+			log.Printf("Expire dropped segment %d fp='%s'", seg, his.segmentPath(seg))
+		}
+	}
+	// entries forgotten until now are removed: the next run skips them
+	his.expireLast = now
+	stats.Duration = time.Since(start)
+	logf(DEBUG, "Expire done lines=%d expired=%d forgotten=%d bad=%d droppedSegments=%d took=(%d ms)",
+		stats.Lines, stats.Expired, stats.Forgotten, stats.BadLines, stats.DroppedSegments, stats.Duration.Milliseconds())
+	return stats, nil
+} // end func expire
+
+// expireSegment expires the lines of segment seg.
+// Returns dead=true if every line is expired and older than Remember.
+func (his *HISTORY) expireSegment(seg int, now int64, since int64, remover HashDBRemover, canRemove bool, stats *ExpireStats) (dead bool, err error) {
+	// lines are only modified in place: a second handle does not disturb history_Writer
+	file, err := os.OpenFile(his.segmentPath(seg), os.O_RDWR, 0666)
+	if err != nil {
+		return false, fmt.Errorf("ERROR Expire: %w: %w", ErrHisDat, err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("ERROR Expire Stat: %w: %w", ErrHisDat, err)
+	}
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, fileInfo.Size()), 1024*1024)
+	header, err := reader.ReadSlice('\n')
+	if err != nil {
+		return false, fmt.Errorf("ERROR Expire reading header of segment %d err='%v': %w", seg, err, ErrBadHeader)
+	}
+	var forget []*OffsetData
+	var forgetHashes []string
+	lines, marked, forgotten := 0, 0, 0
+	local := int64(len(header))
+	rs := newRecordScanner(reader, his.settings.Fv)
+	for {
+		rec, n, err := rs.next()
+		if err == errBadRecord {
+			// skip overlong line
+			local += n
+			stats.BadLines++
+			lines++
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				return false, fmt.Errorf("ERROR Expire read segment %d: %w: %w", seg, ErrHisDat, err)
+			}
+			if n > 0 {
+				lines++ // a partial record at the end is still being written
+			}
+			break
+		}
+		lines++
+		hl, ok := parseRecord(rec, his.settings.Fv)
+		if !ok {
+			stats.BadLines++
+			local += n
+			continue
+		}
+		stats.Lines++
+		justMarked := false
+		if !isExpiredToken(hl.token) && his.isExpired(hl, now) {
+			ok, err := his.expireLine(file, local, now)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				hl.token = []byte("X")
+				stats.Expired++
+				marked++
+				justMarked = true
+			}
+		}
+		if isExpiredToken(hl.token) && hl.arrival+his.opts.Remember <= now {
+			forgotten++
+		}
+		// a previous run removed entries which were forgotten already
+		if canRemove && his.isForgotten(hl, now) && (justMarked || hl.arrival+his.opts.Remember > since) {
+			forget = append(forget, &OffsetData{Shorthash: hl.hash[:10], Offset: segmentOffset(seg, local)})
+			forgetHashes = append(forgetHashes, hl.hash)
+			if len(forget) >= ReplayBatchSize {
+				if err := his.forget(remover, forget, forgetHashes, stats); err != nil {
+					return false, err
+				}
+				forget, forgetHashes = forget[:0], forgetHashes[:0]
+			}
+		}
+		local += n
+	}
+	if err := his.forget(remover, forget, forgetHashes, stats); err != nil {
+		return false, err
+	}
+	if marked > 0 && his.opts.SyncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			return false, fmt.Errorf("ERROR Expire Sync: %w: %w", ErrHisDat, err)
+		}
+	}
+	return lines > 0 && forgotten == lines, nil
+} // end func expireSegment
+
+// expireLine overwrites the token of the line at offset in place with 'X': keeps the line length.
+// The line is read again under inplaceMux: UpdateEntry may have changed it meanwhile.
+func (his *HISTORY) expireLine(file *os.File, offset int64, now int64) (bool, error) {
+	his.inplaceMux.Lock()
+	defer his.inplaceMux.Unlock()
+	hl, _, err := readRecordAt(file, offset, his.settings.Fv)
+	if err != nil {
+		return false, fmt.Errorf("ERROR Expire offset=%d: %w", offset, err)
+	}
+	if isExpiredToken(hl.token) || !his.isExpired(hl, now) {
+		return false, nil
+	}
+	if _, err := file.WriteAt(bytes.Repeat([]byte("X"), len(hl.token)), offset+tokenPos(his.settings.Fv)); err != nil {
+		return false, fmt.Errorf("ERROR Expire WriteAt offset=%d: %w: %w", offset, ErrHisDat, err)
+	}
+	return true, nil
+} // end func expireLine
+
+// forget removes the offsets of batch from the hashDB and hashes from the L1 cache.
+// The hashDB_Worker of a key removes its offsets: a read-modify-write beside it could drop an appended offset.
+func (his *HISTORY) forget(remover HashDBRemover, batch []*OffsetData, hashes []string, stats *ExpireStats) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if his.IndexChan == nil {
+		removed, err := remover.RemoveOffsets(batch)
+		if err != nil {
+			return fmt.Errorf("ERROR Expire RemoveOffsets: %w: %w", ErrBackendUnavailable, err)
+		}
+		stats.Forgotten += uint64(removed)
+	} else {
+		removed, err := his.batchViaWorkers(flagRemove, batch, "Expire")
+		stats.Forgotten += uint64(removed)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range hashes {
+		his.L1.DelL1Cache(hash, his)
+	}
+	return nil
+} // end func forget
+
+// removeOffsets runs in the hashDB_Worker which owns bq: it commits bq first,
+// so queued offsets can be removed and do not come back with a later flush.
+// Returns CaseAdded and sets hi.found to the number of removed offsets.
+func (his *HISTORY) removeOffsets(bq *batchQueue, hi *HistoryIndex) int {
+	remover, ok := his.hashDB.(HashDBRemover)
+	if !ok || his.remap.Load() != nil {
+		return CaseRetry
+	}
+	if err := bq.flush(his); err != nil {
+		return CaseError
+	}
+	removed, err := remover.RemoveOffsets(hi.batch)
+	if err != nil {
+		log.Printf("ERROR hashDB_Worker [%s] RemoveOffsets err='%v'", bq.char, err)
+		return CaseError
+	}
+	hi.found = int64(removed)
+	return CaseAdded
+} // end func removeOffsets
+
+// redoExpire makes the next Expire run check entries forgotten after forgotten-1 again.
+// UpdateEntry calls it when it expires an entry which a previous run already skipped.
+func (his *HISTORY) redoExpire(forgotten int64) {
+	forgotten = max(forgotten, 1)
+	for {
+		redo := his.expireRedo.Load()
+		if redo != 0 && redo <= forgotten {
+			return
+		}
+		if his.expireRedo.CompareAndSwap(redo, forgotten) {
+			return
+		}
+	}
+} // end func redoExpire
+
+// isExpired returns true if the article of hl expired at now.
+func (his *HISTORY) isExpired(hl historyLine, now int64) bool {
+	if hl.expires > 0 {
+		return hl.expires <= now
+	}
+	return his.opts.ExpireAfter > 0 && hl.arrival+his.opts.ExpireAfter <= now
+} // end func isExpired
+
+// isForgotten returns true if the expired entry hl is older than Remember
+// and has to be removed from the hashDB.
+func (his *HISTORY) isForgotten(hl historyLine, now int64) bool {
+	return his.opts.ExpireRemoveKeys && isExpiredToken(hl.token) && hl.arrival+his.opts.Remember <= now
+} // end func isForgotten
+
+// isForgottenRecord parses rec and returns isForgotten.
+func (his *HISTORY) isForgottenRecord(rec []byte, now int64) bool {
+	hl, ok := parseRecord(rec, his.settings.Fv)
+	return ok && his.isForgotten(hl, now)
+} // end func isForgottenRecord
+
+// expireScheduler runs Expire every ExpireEvery seconds until Close.
+func (his *HISTORY) expireScheduler() {
+	defer his.bgWG.Done()
+	ticker := time.NewTicker(time.Duration(his.opts.ExpireEvery) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-his.stop:
+			return
+		case now := <-ticker.C:
+			if _, err := his.expire(now.Unix()); err != nil {
+				log.Printf("ERROR expireScheduler err='%v'", err)
+			}
+		}
+	}
+} // end func expireScheduler
+
+// sqlRemoveOffsets removes the offsets of batch in one transaction. Changed values are written in encoding enc.
+// table returns the table name of a key. Works with SQLite3 and MySQL.
+func sqlRemoveOffsets(db *sql.DB, batch []*OffsetData, enc int, table func(key string) string) (removed int, err error) {
+	remove := make(map[string]map[int64]struct{}, len(batch))
+	var keys []string
+	for _, od := range batch {
+		if len(od.Shorthash) < 4 {
+			continue
+		}
+		if remove[od.Shorthash] == nil {
+			remove[od.Shorthash] = make(map[int64]struct{})
+			keys = append(keys, od.Shorthash)
+		}
+		remove[od.Shorthash][od.Offset] = struct{}{}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		tableName := table(key)
+		var o []byte
+		err := tx.QueryRow("SELECT o FROM "+tableName+" WHERE h = ?", key[3:]).Scan(&o)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		offsets, err := decodeOffsets(nil, o)
+		if err != nil {
+			log.Printf("WARN sqlRemoveOffsets table=%s key=%s err='%v'", tableName, key[3:], err)
+			continue
+		}
+		var kept []int64
+		for _, offset := range offsets {
+			if _, drop := remove[key][offset]; drop {
+				continue
+			}
+			kept = append(kept, offset)
+		}
+		if len(kept) == len(offsets) {
+			continue
+		}
+		removed += len(offsets) - len(kept)
+		if len(kept) == 0 {
+			_, err = tx.Exec("DELETE FROM "+tableName+" WHERE h = ?", key[3:])
+		} else {
+			_, err = tx.Exec("UPDATE "+tableName+" SET o = ? WHERE h = ?", encodeOffsets(enc, kept...), key[3:])
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+} // end func sqlRemoveOffsets
@@ -0,0 +1,287 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// record formats of history.dat, stored as Fv in the header
+const (
+	FormatText   = 0 // {sha256}\t%010d~%s~%010d\t%s\n: 102 bytes with a 1 char token
+	FormatBinary = 1 // binRecordLen bytes: tag, raw sha256, arrival, expires, date, token
+)
+
+// HisDatFormat is the record format of a new history.dat: FormatText or FormatBinary.
+// An existing history.dat keeps the format of its header.
+var HisDatFormat = FormatText
+
+// layout of a binary record. Timestamps are int64 big endian, expires 0: never.
+// The token is a single byte: 'X' marks an expired entry.
+const (
+	binRecordTag  = 0xB1
+	binHashPos    = 1
+	binArrivalPos = 33
+	binExpiresPos = 41
+	binDatePos    = 49
+	binTokenPos   = 57
+	binRecordLen  = 58
+)
+
+// errBadRecord is returned by recordScanner.next for a skipped overlong text line.
+var errBadRecord = errors.New("bad record")
+
+// recordScanner reads the records of a segment one by one.
+type recordScanner struct {
+	r      *bufio.Reader
+	format int
+	buf    [binRecordLen]byte
+}
+
+func newRecordScanner(r *bufio.Reader, format int) *recordScanner {
+	return &recordScanner{r: r, format: format}
+} // end func newRecordScanner
+
+// next returns the next record and its length. rec is valid until the next call.
+// errBadRecord: an overlong text line of n bytes got skipped.
+// io.EOF at the end. n > 0 with io.EOF: a partial record which history_Writer did not finish yet.
+func (rs *recordScanner) next() (rec []byte, n int64, err error) {
+	if rs.format == FormatBinary {
+		read, err := io.ReadFull(rs.r, rs.buf[:])
+		if err == io.ErrUnexpectedEOF {
+			return nil, int64(read), io.EOF
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return rs.buf[:], binRecordLen, nil
+	}
+	line, err := rs.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// no history line is that long
+		n = int64(len(line))
+		for err == bufio.ErrBufferFull {
+			line, err = rs.r.ReadSlice('\n')
+			n += int64(len(line))
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		return nil, n, errBadRecord
+	}
+	if err != nil {
+		return nil, int64(len(line)), err
+	}
+	return line, int64(len(line)), nil
+} // end func next
+
+// parseRecord parses a record of format.
+func parseRecord(rec []byte, format int) (historyLine, bool) {
+	if format != FormatBinary {
+		return parseHistoryLine(rec)
+	}
+	hash, ok := recordHash(rec, format)
+	if !ok {
+		return historyLine{}, false
+	}
+	return historyLine{
+		hash:    hash,
+		arrival: int64(binary.BigEndian.Uint64(rec[binArrivalPos:])),
+		expires: int64(binary.BigEndian.Uint64(rec[binExpiresPos:])),
+		date:    int64(binary.BigEndian.Uint64(rec[binDatePos:])),
+		token:   rec[binTokenPos : binTokenPos+1],
+	}, true
+} // end func parseRecord
+
+// recordHash returns the hash of a record of format.
+func recordHash(rec []byte, format int) (string, bool) {
+	if format != FormatBinary {
+		return parseHistoryLineHash(rec)
+	}
+	if len(rec) != binRecordLen || rec[0] != binRecordTag {
+		return "", false
+	}
+	return hex.EncodeToString(rec[binHashPos:binArrivalPos]), true
+} // end func recordHash
+
+// isSha256Hex returns true if hash is a lowercase hex sha256.
+func isSha256Hex(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if c := hash[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+} // end func isSha256Hex
+
+// encodeRecord appends the record of hobj in format to buf.
+func encodeRecord(buf []byte, hobj *HistoryObject, format int) ([]byte, error) {
+	if format != FormatBinary {
+		expiresStr := DefExpiresStr
+		if hobj.Expires > 0 {
+			expiresStr = fmt.Sprintf("%010d", hobj.Expires) // leftpad zeros to 10 digit
+		}
+		return fmt.Appendf(buf, "{%s}\t%010d~%s~%010d\t%s\n", hobj.MessageIDHash, hobj.Arrival, expiresStr, hobj.Date, hobj.StorageToken), nil // leftpad zeros to 10 digit
+	}
+	if len(hobj.StorageToken) != 1 {
+		return buf, fmt.Errorf("ERROR encodeRecord StorageToken='%s': binary format stores 1 char", hobj.StorageToken)
+	}
+	if !isSha256Hex(hobj.MessageIDHash) {
+		return buf, fmt.Errorf("ERROR encodeRecord hash='%s' is no sha256", hobj.MessageIDHash)
+	}
+	var rec [binRecordLen]byte
+	rec[0] = binRecordTag
+	hex.Decode(rec[binHashPos:binArrivalPos], []byte(hobj.MessageIDHash)) // checked by isSha256Hex
+	binary.BigEndian.PutUint64(rec[binArrivalPos:], uint64(hobj.Arrival))
+	binary.BigEndian.PutUint64(rec[binExpiresPos:], uint64(max(hobj.Expires, 0)))
+	binary.BigEndian.PutUint64(rec[binDatePos:], uint64(hobj.Date))
+	rec[binTokenPos] = hobj.StorageToken[0]
+	return append(buf, rec[:]...), nil
+} // end func encodeRecord
+
+// recordText returns the record hl as history line without LF.
+func recordText(hl historyLine) string {
+	expiresStr := DefExpiresStr
+	if hl.expires > 0 {
+		expiresStr = fmt.Sprintf("%010d", hl.expires)
+	}
+	return fmt.Sprintf("{%s}\t%010d~%s~%010d\t%s", hl.hash, hl.arrival, expiresStr, hl.date, hl.token)
+} // end func recordText
+
+// tokenPos returns the position of the token in a record of format.
+func tokenPos(format int) int64 {
+	if format == FormatBinary {
+		return binTokenPos
+	}
+	return lineTokenPos
+} // end func tokenPos
+
+// readRecordAt reads and parses the record at offset.
+func readRecordAt(file io.ReaderAt, offset int64, format int) (historyLine, []byte, error) {
+	if format == FormatBinary {
+		rec := make([]byte, binRecordLen)
+		if _, err := file.ReadAt(rec, offset); err != nil {
+			return historyLine{}, nil, fmt.Errorf("%w: %w", ErrHisDat, err)
+		}
+		hl, ok := parseRecord(rec, format)
+		if !ok {
+			return historyLine{}, nil, fmt.Errorf("bad record: %w", ErrHisDat)
+		}
+		return hl, rec, nil
+	}
+	return readHistoryLineAt(file, offset)
+} // end func readRecordAt
+
+// ConvertStats is returned by ConvertHisDat.
+type ConvertStats struct {
+	Records    uint64        // records converted
+	BadRecords uint64        // records which could not be parsed: dropped
+	OldSize    int64         // size of src
+	NewSize    int64         // size of dst
+	Duration   time.Duration // runtime
+}
+
+// ConvertHisDat converts history.dat or a segment at src into a new file dst using record format.
+// The history must not be booted. Offsets change: replace src with dst, remove ReplayCheckpointFile
+// and boot with an empty hashDB to rebuild it. A ForcedReplay on the old hashDB is not enough:
+// it only adds offsets and the old ones point into other records.
+// With segments every segment has to be converted.
+// The binary format stores 1 char tokens: a longer token made only of 'X' becomes "X", any other fails.
+func ConvertHisDat(src string, dst string, format int) (*ConvertStats, error) {
+	if format != FormatText && format != FormatBinary {
+		return nil, fmt.Errorf("ERROR ConvertHisDat unknown format=%d: %w", format, ErrInvalidConfig)
+	}
+	start := time.Now()
+	settings, headerLen, err := readSegmentHeader(src)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat: %w", err)
+	}
+	if settings.Fv == format {
+		return nil, fmt.Errorf("ERROR ConvertHisDat src='%s' has format=%d already: %w", src, format, ErrInvalidConfig)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat: %w: %w", ErrHisDat, err)
+	}
+	defer in.Close()
+	if _, err := in.Seek(headerLen, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat Seek: %w: %w", ErrHisDat, err)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat: %w: %w", ErrHisDat, err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+	oldFormat := settings.Fv
+	settings.Fv = format
+	var headerdata []byte
+	if _, err := gobEncodeHeader(&headerdata, settings); err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat gobEncodeHeader: %w", err)
+	}
+	stats := &ConvertStats{OldSize: headerLen}
+	dw := bufio.NewWriterSize(out, 1024*1024)
+	if err := writeHistoryHeader(dw, headerdata, &stats.NewSize, false); err != nil {
+		return nil, fmt.Errorf("ERROR ConvertHisDat writeHistoryHeader: %w: %w", ErrHisDat, err)
+	}
+	rs := newRecordScanner(bufio.NewReaderSize(in, 1024*1024), oldFormat)
+	var buf []byte
+	for {
+		rec, n, err := rs.next()
+		if err == errBadRecord {
+			stats.OldSize += n
+			stats.BadRecords++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("ERROR ConvertHisDat read: %w: %w", ErrHisDat, err)
+		}
+		offset := stats.OldSize
+		stats.OldSize += n
+		hl, ok := parseRecord(rec, oldFormat)
+		if !ok {
+			stats.BadRecords++
+			continue
+		}
+		hobj := &HistoryObject{MessageIDHash: hl.hash, StorageToken: string(hl.token), Arrival: hl.arrival, Expires: hl.expires, Date: hl.date}
+		if format == FormatBinary && isExpiredToken(hl.token) {
+			hobj.StorageToken = "X"
+		}
+		if buf, err = encodeRecord(buf[:0], hobj, format); err != nil {
+			return stats, fmt.Errorf("ERROR ConvertHisDat offset=%d: %v: %w", offset, err, ErrInvalidConfig)
+		}
+		if _, err := dw.Write(buf); err != nil {
+			return stats, fmt.Errorf("ERROR ConvertHisDat write: %w: %w", ErrHisDat, err)
+		}
+		stats.NewSize += int64(len(buf))
+		stats.Records++
+	}
+	if err := dw.Flush(); err != nil {
+		return stats, fmt.Errorf("ERROR ConvertHisDat Flush: %w: %w", ErrHisDat, err)
+	}
+	if err := out.Sync(); err != nil {
+		return stats, fmt.Errorf("ERROR ConvertHisDat Sync: %w: %w", ErrHisDat, err)
+	}
+	if err := out.Close(); err != nil {
+		return stats, fmt.Errorf("ERROR ConvertHisDat Close: %w: %w", ErrHisDat, err)
+	}
+	done = true
+	stats.Duration = time.Since(start)
+	return stats, nil
+} // end func ConvertHisDat
@@ -0,0 +1,105 @@
+package history
+
+import (
+	"fmt"
+	"log"
+)
+
+var (
+	// HashDBDriver selects the backend opened by BootHistory when UseHashDB is true
+	// and no backend has been set via InitializeDatabase or SetHashDB.
+	// "mysql" or "sqlite3"
+	HashDBDriver = "mysql"
+	// HashDBShardMode is the SQLite3 shard mode used when HashDBDriver is "sqlite3".
+	HashDBShardMode = SHARD_SINGLE_DB
+)
+
+// HashDB is the index backend used by hashDB_Worker.
+// A key is the first 10 chars of a hash: 3 chars select the table, the next KeyLen chars are the key.
+// The backend maps each key to the list of history.dat offsets sharing that key.
+//
+// SQL (MySQL RocksDB), SQLite3DB and SQLite3ShardedDB implement HashDB.
+type HashDB interface {
+	// GetOffsets returns all offsets stored for key or nil if key is unknown.
+	GetOffsets(key string) ([]int64, error)
+	// InsertOffset appends offset to the list of offsets for key.
+	InsertOffset(key string, offset int64) error
+	// Close closes all connections of the backend.
+	Close() error
+	// Stats returns backend specific statistics.
+	Stats() map[string]interface{}
+}
+
+// SetHashDB sets the index backend used by BootHistory.
+// Must be called before BootHistory.
+func (his *HISTORY) SetHashDB(db HashDB) {
+	his.mux.Lock()
+	his.hashDB = db
+	his.mux.Unlock()
+} // end func SetHashDB
+
+// GetHashDB returns the index backend or nil if none is initialized.
+func (his *HISTORY) GetHashDB() HashDB {
+	his.mux.Lock()
+	db := his.hashDB
+	his.mux.Unlock()
+	return db
+} // end func GetHashDB
+
+// openHashDB returns the already initialized backend or opens a new one for driver.
+func (his *HISTORY) openHashDB(driver string, shardMode int) (HashDB, error) {
+	if his.hashDB != nil {
+		// preset by InitializeDatabase, SetHashDB or BootOptions.HashDB before the options were known
+		if c, ok := his.hashDB.(stmtCacher); ok {
+			c.setStmtCacheSize(his.opts.StmtCacheSize)
+		}
+		switch db := his.hashDB.(type) {
+		case *SQLite3DB:
+			shardMode = SHARD_SINGLE_DB
+		case *SQLite3ShardedDB:
+			shardMode = db.shardMode
+		default:
+			return his.hashDB, nil
+		}
+		his.ShardMode = shardMode
+		his.ShardDBs, his.ShardTables, _ = GetShardConfig(shardMode)
+		return his.hashDB, nil
+	}
+	switch driver {
+	case "mysql":
+		opts := defaultMySQLOpts()
+		opts.stmtcache = his.opts.StmtCacheSize
+		pool, err := NewSQLpool(opts, true) // true = create tables
+		if err != nil {
+			return nil, fmt.Errorf("ERROR openHashDB failed to initialize MySQL pool: %w: %w", ErrBackendUnavailable, err)
+		}
+		his.MySQLPool = pool
+		his.hashDB = pool
+		log.Printf("MySQL RocksDB pool initialized successfully")
+	case "sqlite3":
+		if err := his.InitSQLite3WithSharding(shardMode); err != nil {
+			return nil, fmt.Errorf("ERROR openHashDB: %w: %w", ErrBackendUnavailable, err)
+		}
+		numDBs, tablesPerDB, _ := GetShardConfig(shardMode)
+		his.ShardMode = shardMode
+		his.ShardDBs = numDBs
+		his.ShardTables = tablesPerDB
+	default:
+		return nil, fmt.Errorf("ERROR openHashDB driver '%s' not implemented: %w", driver, ErrInvalidConfig)
+	}
+	return his.hashDB, nil
+} // end func openHashDB
+
+func defaultMySQLOpts() *DBopts {
+	return &DBopts{
+		username: "nntp_history",   // You can make these configurable
+		password: "password",       // You can make these configurable
+		hostname: "localhost:3306", // You can make these configurable
+		dbname:   "nntp_history",   // You can make these configurable
+		params:   "?charset=utf8mb4&parseTime=True&loc=Local",
+		maxopen:  64, // You can make this configurable
+		initopen: 16, // You can make this configurable
+		tcpmode:  "tcp",
+		timeout:  30,
+	}
+} // end func defaultMySQLOpts
@@ -8,15 +8,13 @@ import (
 	"hash/crc32"
 	"log"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
 var (
-	// set HEX true: converts offset into hex strings to store in hashdb
-	// dont change later once db is initialized!
+	// Deprecated: HEX was never used. The hashDB stores offsets in the encoding of BootOptions.Offsets.
 	HEX bool = true
 
 	//ADDCRC bool = false
@@ -27,81 +25,15 @@ type Offsets struct {
 	hashLCR map[int64]string
 }
 
-func concatInt64(input []int64, output *[]byte) (int, error) {
-	if input == nil || len(input) == 0 || output == nil {
-		return 0, fmt.Errorf("ERROR concatInt64 io nil")
-	}
-	strSlice := make([]string, len(input))
-	for i, value := range input {
-		if HEX {
-			// stores int64 as hex string
-			strSlice[i] = strconv.FormatInt(value, 16)
-		} else {
-			// stores int64 as digit string
-			strSlice[i] = strconv.FormatInt(value, 10)
-		}
-		//if ADDCRC {
-		//	_, _ = CRC(strSlice[i])
-		//}
-	}
-	// joins ints with , into a []byte
-	*output = []byte(strings.Join(strSlice, ","))
-
-	// adds comma to strings EOL
-	*output = append(*output, ',')
-	//log.Printf("concatInt64 input='%#v' output='%s'", input, *output)
-	return len(*output), nil
-} // end func concatInt64
-
-func parseByteToSlice(input []byte, result *[]int64) (int, error) {
-	if input == nil || result == nil {
-		return 0, fmt.Errorf("ERROR parseByteToSlice io nil")
-	}
-	if input[len(input)-1] != ',' {
-		return 0, fmt.Errorf("ERROR parseByteToSlice EOL!=','")
-	}
-	parts := bytes.Split(input, []byte(","))
-transform:
-	for _, part := range parts {
-		if len(part) == 0 {
-			//log.Printf("parseByteToSlice ignored i=%d part='%s'", i, part)
-			continue transform
-		}
-		if HEX {
-			// reads hex
-			if value, err := strconv.ParseInt(string(part), 16, 64); err != nil {
-				log.Printf("ERROR parseByteToSlice HEX err='%v'", err)
-				return 0, err
-			} else {
-				*result = append(*result, value)
-			}
-		} else {
-			// reads digits
-			if value, err := strconv.ParseInt(string(part), 10, 64); err != nil {
-				log.Printf("ERROR parseByteToSlice DIG err='%v'", err)
-				return 0, err
-			} else {
-				*result = append(*result, value)
-			}
-		}
-		//log.Printf("parseByteToSlice i=%d part='%s'=>value=%d result='%#v'", i, string(part), value, result)
-
-	}
-	//log.Printf("parseByteToSlice input=%s result='%#v'", string(input), parts, result)
-	return len(*result), nil
-} // end func parseByteToSlice
-
 func gobEncodeHeader(iobuf *[]byte, settings *HistorySettings) (int, error) {
 	if iobuf == nil || settings == nil {
-		log.Printf("ERROR gobEncodeHeader iobuf or settings nil")
-		os.Exit(1)
+		return 0, fmt.Errorf("ERROR gobEncodeHeader iobuf or settings nil: %w", ErrBadHeader)
 	}
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	err := encoder.Encode(settings)
 	if err != nil {
-		log.Printf("ERROR gobEncodeHeader Encode err='%v'", err)
-		return 0, err
+		return 0, fmt.Errorf("ERROR gobEncodeHeader Encode err='%v': %w", err, ErrBadHeader)
 	}
 	b64str := base64.StdEncoding.EncodeToString(buf.Bytes())
 	NullPad(&b64str, ZEROPADLEN)
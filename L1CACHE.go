@@ -3,17 +3,16 @@ package history
 import (
 	//"container/heap"
 	"log"
-	"os"
 	"sync"
 	"time"
 )
 
 var (
 	DEBUGL1         bool  = true
-	L1              bool  = true // better not disable L1 cache...
-	L1CacheExpires  int64 = DefaultCacheExpires
+	L1              bool  = true                // better not disable L1 cache...
+	L1CacheExpires  int64 = DefaultCacheExpires // default of BootOptions.CacheExpires
 	L1ExtendExpires int64 = DefaultCacheExtend
-	L1Purge         int64 = DefaultCachePurge
+	L1Purge         int64 = DefaultCachePurge // default of BootOptions.CachePurge
 	L1InitSize      int   = 128
 
 	// L1LockDelay: delays L1 locking by N milliseconds
@@ -28,7 +27,11 @@ var (
 )
 
 type L1CACHE struct {
-	mux     sync.Mutex // global L1 mutex
+	mux     sync.Mutex      // global L1 mutex
+	expires int64           // L1CacheExpires or BootOptions.CacheExpires
+	purge   int64           // L1Purge or BootOptions.CachePurge
+	stop    chan struct{}   // closed by HISTORY.Close: stops pqExpire and pqExtend
+	wg      *sync.WaitGroup // counts pqExpire and pqExtend goroutines
 	Caches  map[string]*L1CACHEMAP
 	Extend  map[string]*L1ECH
 	Muxers  map[string]*L1MUXER
@@ -83,7 +86,14 @@ func (l1 *L1CACHE) BootL1Cache(his *HISTORY) {
 	l1.Muxers = make(map[string]*L1MUXER, NumCacheDBs)
 	l1.Counter = make(map[string]*CCC, NumCacheDBs)
 	l1.pqQueue = make(map[string]*L1pqQ, NumCacheDBs)
-	for _, char := range ROOTDBS {
+	l1.expires, l1.purge = L1CacheExpires, L1Purge
+	if his.opts.CacheExpires > 0 {
+		l1.expires = his.opts.CacheExpires
+	}
+	if his.opts.CachePurge > 0 {
+		l1.purge = his.opts.CachePurge
+	}
+	for _, char := range his.rootDBs {
 		//log.Printf("L1 Boot [%s]", char)
 		l1.Caches[char] = &L1CACHEMAP{cache: make(map[string]*L1ITEM, L1InitSize)}
 		l1.Extend[char] = &L1ECH{ch: make(chan *L1PQItem, his.cEvCap)}
@@ -91,8 +101,10 @@ func (l1 *L1CACHE) BootL1Cache(his *HISTORY) {
 		l1.Counter[char] = &CCC{Counter: make(map[string]uint64)}
 		l1.pqQueue[char] = &L1pqQ{mux: sync.Mutex{}, que: &L1PQ{}, pqC: make(chan struct{}, 1)}
 	}
+	l1.stop, l1.wg = his.stop, &his.bgWG
 	time.Sleep(time.Millisecond)
-	for _, char := range ROOTDBS {
+	l1.wg.Add(2 * len(his.rootDBs))
+	for _, char := range his.rootDBs {
 		// stupid race condition on boot when placed in loop before
 		go l1.pqExpire(char)
 		go l1.pqExtend(char)
@@ -134,6 +146,7 @@ func (l1 *L1CACHE) LockL1Cache(hash string, value int, his *HISTORY) (retcase in
 		//}
 		cnt.Counter["Count_Locked"]++
 		ptr.cache[hash] = &L1ITEM{value: value}
+		l1.pushExpires(char, hash) // a lock nobody releases expires
 		retcase = CasePass
 	} else {
 		if ptr.cache[hash] != nil {
@@ -147,8 +160,107 @@ func (l1 *L1CACHE) LockL1Cache(hash string, value int, his *HISTORY) (retcase in
 	return retcase
 } // end func LockL1Cache
 
+// The WriteL1Cache method marks a `MessageIDHash` as being written.
+// It takes over a CaseLock set by LockL1Cache.
+// Possible return values:
+//
+//	CaseWrite == already in writing
+//	CaseDupes == is a duplicate
+//	CasePass == not a duplicate == locked article for writing
+func (l1 *L1CACHE) WriteL1Cache(hash string, his *HISTORY) (retcase int) {
+	if !L1 {
+		return CasePass
+	}
+	if hash == "" {
+		log.Printf("ERROR WriteL1Cache hash=nil")
+		return -999
+	}
+	char := string(hash[:his.cutChar])
+
+	ptr := l1.Caches[char]
+	cnt := l1.Counter[char]
+	mux := l1.Muxers[char]
+	mux.mux.Lock()
+	defer mux.mux.Unlock()
+	item, exists := ptr.cache[hash]
+	switch {
+	case !exists:
+		cnt.Counter["Count_Locked"]++
+		ptr.cache[hash] = &L1ITEM{value: CaseWrite}
+		l1.pushExpires(char, hash)
+		return CasePass
+	case item == nil:
+		log.Printf("ERROR WriteL1Cache ptr.cache[%s] is nil for hash='%s'", char, hash)
+		return CaseError
+	case item.value == CaseLock:
+		item.value = CaseWrite
+		return CasePass
+	}
+	return item.value
+} // end func WriteL1Cache
+
+// The GetL1Cache method returns the cached value of a `MessageIDHash` without locking it.
+func (l1 *L1CACHE) GetL1Cache(hash string, his *HISTORY) (value int, exists bool) {
+	if !L1 || len(hash) < his.cutChar {
+		return
+	}
+	char := string(hash[:his.cutChar])
+	ptr := l1.Caches[char]
+	mux := l1.Muxers[char]
+	mux.mux.Lock()
+	if item := ptr.cache[hash]; item != nil {
+		value, exists = item.value, true
+	}
+	mux.mux.Unlock()
+	return
+} // end func GetL1Cache
+
+// The ReleaseL1Cache method removes a `MessageIDHash` locked by LockL1Cache with CaseLock.
+// Other states stay untouched.
+func (l1 *L1CACHE) ReleaseL1Cache(hash string, his *HISTORY) {
+	if !L1 || len(hash) < his.cutChar {
+		return
+	}
+	char := string(hash[:his.cutChar])
+	ptr := l1.Caches[char]
+	cnt := l1.Counter[char]
+	mux := l1.Muxers[char]
+	mux.mux.Lock()
+	if item := ptr.cache[hash]; item != nil && item.value == CaseLock {
+		delete(ptr.cache, hash)
+		cnt.Counter["Count_Delete"]++
+	}
+	mux.mux.Unlock()
+} // end func ReleaseL1Cache
+
+// The DelL1Cache method removes a `MessageIDHash` from the cache.
+func (l1 *L1CACHE) DelL1Cache(hash string, his *HISTORY) {
+	if !L1 || len(hash) < his.cutChar {
+		return
+	}
+	char := string(hash[:his.cutChar])
+	ptr := l1.Caches[char]
+	cnt := l1.Counter[char]
+	mux := l1.Muxers[char]
+	mux.mux.Lock()
+	if _, exists := ptr.cache[hash]; exists {
+		delete(ptr.cache, hash)
+		cnt.Counter["Count_Delete"]++
+	}
+	mux.mux.Unlock()
+} // end func DelL1Cache
+
+// pushExpires queues hash for removal after l1.expires seconds.
+func (l1 *L1CACHE) pushExpires(char string, hash string) {
+	pq := l1.pqQueue[char]
+	pq.mux.Lock()
+	pq.Push(&L1PQItem{Key: hash, Expires: l1.expires})
+	pq.mux.Unlock()
+} // end func pushExpires
+
 // The L1pqExtend function runs as a goroutine for each character.
 func (l1 *L1CACHE) pqExtend(char string) {
+	defer l1.wg.Done()
 	if !L1 {
 		return
 	}
@@ -159,7 +271,7 @@ func (l1 *L1CACHE) pqExtend(char string) {
 	//logf(DEBUGL1, "Boot L1pqExtend [%s]", char)
 	//defer log.Printf("LEFT L1 [%s] pqExtend", char)
 
-	l1purge := L1Purge
+	l1purge := l1.purge
 	if l1purge <= 0 {
 		l1purge = 1
 	}
@@ -178,11 +290,14 @@ func (l1 *L1CACHE) pqExtend(char string) {
 	timer := time.NewTimer(time.Duration(l1purge) * time.Second)
 	if extC == nil {
 		log.Printf("ERROR L1 pqExtend extC is nil for char='%s'", char)
-		os.Exit(1)
+		return
 	}
 	//forever:
 	for {
 		select {
+		case <-l1.stop:
+			timer.Stop()
+			return
 		case <-timer.C:
 			timeout = true
 		case pqitem := <-extC.ch: // receives stuff from DoCacheEvict
@@ -238,12 +353,9 @@ func (l1 *L1CACHE) Set(hash string, char string, value int, flagexpires bool, hi
 	ptr := l1.Caches[char]
 	cnt := l1.Counter[char]
 	mux := l1.Muxers[char]
-	pq := l1.pqQueue[char]
 
 	if flagexpires {
-		pq.mux.Lock()
-		pq.Push(&L1PQItem{Key: hash, Expires: L1CacheExpires})
-		pq.mux.Unlock()
+		l1.pushExpires(char, hash)
 	}
 	mux.mux.Lock()
 	if _, exists := ptr.cache[hash]; !exists {
@@ -273,8 +385,7 @@ func (l1 *L1CACHE) L1Stats(statskey string) (retval uint64, retmap map[string]ui
 	if l1 == nil || l1.Muxers == nil {
 		return
 	}
-	for _, char := range ROOTDBS {
-		cnt := l1.Counter[char]
+	for char, cnt := range l1.Counter {
 		mux := l1.Muxers[char]
 		mux.mux.Lock()
 		switch statskey {
@@ -316,6 +427,7 @@ func (pq *L1pqQ) Pop() (*L1PQItem, int) {
 
 // Remove expired items from the cache
 func (l1 *L1CACHE) pqExpire(char string) {
+	defer l1.wg.Done()
 	if !L1 {
 		return
 	}
@@ -331,7 +443,7 @@ func (l1 *L1CACHE) pqExpire(char string) {
 	//lenpq := 0
 	var item *L1PQItem
 	var isleep int64
-	l1purge := L1Purge
+	l1purge := l1.purge
 	//dq, dqmax, dqcnt := make([]string, ClearEveryN), ClearEveryN, 0
 	//now := UnixTimeSec()
 	//lf := now
@@ -354,19 +466,25 @@ cleanup:
 		//logf(DEBUGL1, "L1 pqExpire [%s] pq.Pop item='%v'", char, item)
 		if pq == nil {
 			logf(true, "L1 pqExpire [%s] pq is nil, sleeping", char)
-			time.Sleep(time.Duration(l1purge) * time.Second)
+			if !l1.sleep(time.Duration(l1purge) * time.Second) {
+				return
+			}
 			continue cleanup
 		}
 		item, _ = pq.Pop()
 		if item == nil {
-			time.Sleep(time.Duration(l1purge) * time.Second)
+			if !l1.sleep(time.Duration(l1purge) * time.Second) {
+				return
+			}
 			continue cleanup
 		}
 		if item.Expires > time.Now().UnixNano() {
 			isleep = item.Expires - time.Now().UnixNano()
 			if isleep >= int64(1*time.Millisecond) {
 				//logf(DEBUGL1, "L1 pqExpire [%s] POS sleep=(%d ms) nanos=(%d) lenpq=%d", char, isleep/1e6, isleep, lenpq)
-				time.Sleep(time.Duration(isleep))
+				if !l1.sleep(time.Duration(isleep)) {
+					return
+				}
 			} else {
 				//logf(DEBUGL1, "L1 pqExpire [%s] NEG sleep=(%d ms) nanos=(%d) lenpq=%d", char, isleep/1e6, isleep, lenpq)
 			}
@@ -384,3 +502,15 @@ cleanup:
 		//item = nil
 	}
 } // end func pqExpire
+
+// sleep waits for d and returns false if l1.stop got closed.
+func (l1 *L1CACHE) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-l1.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+} // end func sleep
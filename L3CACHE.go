@@ -92,7 +92,7 @@ func (l3 *L3CACHE) BootL3Cache(his *HISTORY) {
 		l3.pqQueue[char] = &L3pqQ{que: &L3PQ{}, pqC: make(chan struct{}, 1)}
 	}
 	time.Sleep(time.Millisecond)
-	for _, char := range ROOTDBS {
+	for _, char := range his.rootDBs {
 		// stupid race condition on boot when placed in loop before
 		go l3.pqExpire(char)
 		go l3.pqExtend(char)
@@ -281,8 +281,7 @@ func (l3 *L3CACHE) L3Stats(statskey string) (retval uint64, retmap map[string]ui
 	if l3 == nil || l3.Muxers == nil {
 		return
 	}
-	for _, char := range ROOTDBS {
-		cnt := l3.Counter[char]
+	for char, cnt := range l3.Counter {
 		mux := l3.Muxers[char]
 		mux.mux.RLock()
 		switch statskey {
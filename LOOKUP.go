@@ -0,0 +1,64 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HistoryRecord is a parsed line of history.dat returned by Lookup.
+type HistoryRecord struct {
+	MessageIDHash string
+	Offset        int64 // offset of the line in history.dat
+	Arrival       int64
+	Expires       int64 // 0: never expires
+	Date          int64
+	StorageToken  string // "F" = flatstorage | "M" = mongodb | "X" = deleted
+}
+
+// Expired returns true if the entry got marked as expired by Expire or UpdateEntry.
+func (hr *HistoryRecord) Expired() bool {
+	return isExpiredToken([]byte(hr.StorageToken))
+} // end func Expired
+
+// Lookup returns the history record of hash.
+// The line is found through the hashDB and its full hash is verified.
+// Returns ErrNotFound if hash is not in history and ErrNoHashDB without hashDB.
+func (his *HISTORY) Lookup(hash string) (*HistoryRecord, error) {
+	if len(hash) < 64 {
+		return nil, fmt.Errorf("ERROR Lookup hash='%s' too short", hash)
+	}
+	if his.isClosed() {
+		return nil, fmt.Errorf("ERROR Lookup: %w", ErrClosed)
+	}
+	var err error
+	// a Compact between locate and read moves the line: try once more
+	for try := 1; try <= 2; try++ {
+		var hr *HistoryRecord
+		if hr, err = his.lookup(hash); err == nil || errors.Is(err, ErrNotFound) {
+			return hr, err
+		}
+	}
+	return nil, err
+} // end func Lookup
+
+func (his *HISTORY) lookup(hash string) (*HistoryRecord, error) {
+	offset, err := his.locate(hash)
+	if err != nil {
+		return nil, err
+	}
+	hl, _, err := readRecordAt(his.reader, offset, his.settings.Fv)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR Lookup offset=%d: %w", offset, err)
+	}
+	if hl.hash != hash {
+		return nil, fmt.Errorf("ERROR Lookup offset=%d holds hash='%s': %w", offset, hl.hash, ErrHisDat)
+	}
+	return &HistoryRecord{
+		MessageIDHash: hl.hash,
+		Offset:        offset,
+		Arrival:       hl.arrival,
+		Expires:       hl.expires,
+		Date:          hl.date,
+		StorageToken:  string(hl.token),
+	}, nil
+} // end func lookup
@@ -0,0 +1,341 @@
+package history
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-while/go-utils"
+)
+
+// HashDBManifestFile identifies the hashDB in HistoryDir: backend, shard mode, key length and offset encoding.
+// BootHistory writes it and refuses to boot with BootOptions which do not match it.
+const HashDBManifestFile = "hashdb.manifest"
+
+// manifestVersion is the version of HashDBManifestFile written by this package.
+const manifestVersion = 1
+
+// HashDBAutoMigrate is the default of BootOptions.AutoMigrate.
+var HashDBAutoMigrate = false
+
+// HashDBManifest is the content of HashDBManifestFile.
+type HashDBManifest struct {
+	Version    int    // manifestVersion
+	Backend    string // "sqlite3", "mysql" or the type of a custom HashDB
+	ShardMode  int    // SQLite3 shard mode. 0 for other backends
+	KeyLen     int    // KeyLen of the keys
+	Offsets    int    // offset encoding: OffsetsText or OffsetsVarint
+	Converting bool   // a conversion to Offsets did not finish
+	unsaved    bool   // BootHistory writes it once the hashDB is open
+}
+
+// expectedManifest returns the manifest of the hashDB o asks for.
+// A preset hashDB (BootOptions.HashDB, InitializeDatabase or SetHashDB) wins over HashDBDriver and ShardMode.
+func (his *HISTORY) expectedManifest(o *BootOptions) *HashDBManifest {
+	m := &HashDBManifest{Version: manifestVersion, Backend: o.HashDBDriver, KeyLen: o.KeyLen, Offsets: o.Offsets}
+	if his.hashDB != nil {
+		m.Backend, m.ShardMode = hashDBBackend(his.hashDB)
+		return m
+	}
+	if m.Backend == "sqlite3" {
+		m.ShardMode = o.ShardMode
+	}
+	return m
+} // end func expectedManifest
+
+// hashDBBackend returns the backend name and SQLite3 shard mode of db for the manifest.
+func hashDBBackend(db HashDB) (backend string, shardMode int) {
+	switch db := db.(type) {
+	case *SQL:
+		return "mysql", 0
+	case *SQLite3DB:
+		return "sqlite3", SHARD_SINGLE_DB
+	case *SQLite3ShardedDB:
+		return "sqlite3", db.shardMode
+	default:
+		return fmt.Sprintf("%T", db), 0
+	}
+} // end func hashDBBackend
+
+// readManifest reads HashDBManifestFile from dir. Returns nil if it does not exist.
+func readManifest(dir string) (*HashDBManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, HashDBManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := &HashDBManifest{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch key {
+		case "version":
+			m.Version, err = strconv.Atoi(value)
+		case "backend":
+			m.Backend = value
+		case "shardmode":
+			m.ShardMode, err = strconv.Atoi(value)
+		case "keylen":
+			m.KeyLen, err = strconv.Atoi(value)
+		case "offsets":
+			m.Offsets, err = strconv.Atoi(value)
+		case "converting":
+			m.Converting = value == "1"
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad line '%s' in %s: %w", line, HashDBManifestFile, ErrInvalidConfig)
+		}
+	}
+	if m.Version <= 0 || m.Backend == "" {
+		return nil, fmt.Errorf("%s is incomplete: %w", HashDBManifestFile, ErrInvalidConfig)
+	}
+	return m, nil
+} // end func readManifest
+
+// writeManifest stores m as HashDBManifestFile in dir.
+func writeManifest(dir string, m *HashDBManifest) error {
+	fp := filepath.Join(dir, HashDBManifestFile)
+	tmp := fp + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ERROR writeManifest: %w", err)
+	}
+	data := fmt.Appendf(nil, "version=%d\nbackend=%s\nshardmode=%d\nkeylen=%d\noffsets=%d\n",
+		m.Version, m.Backend, m.ShardMode, m.KeyLen, m.Offsets)
+	if m.Converting {
+		data = append(data, "converting=1\n"...)
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR writeManifest: %w", err)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR writeManifest Sync: %w", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("ERROR writeManifest Close: %w", err)
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		return fmt.Errorf("ERROR writeManifest Rename: %w", err)
+	}
+	syncDir(dir)
+	return nil
+} // end func writeManifest
+
+// shardDBName matches the database files of the SQLite3 shard modes > 0
+var shardDBName = regexp.MustCompile(`^hashdb_[0-9a-f]{3}\.sqlite3$`)
+
+// detectShardMode returns the SQLite3 shard mode of the databases in dir,
+// -1 if there are none or they match no mode.
+func detectShardMode(dir string) int {
+	files, err := shardFiles(dir)
+	if err != nil {
+		return -1
+	}
+	single, sharded := false, 0
+	for _, path := range files {
+		name := filepath.Base(path)
+		switch {
+		case name == "hashdb.sqlite3":
+			single = true
+		case shardDBName.MatchString(name):
+			sharded++
+		}
+	}
+	switch {
+	case single && sharded == 0:
+		return SHARD_SINGLE_DB
+	case single:
+		return -1
+	}
+	for _, mode := range []int{SHARD_FULL_SPLIT, SHARD_16_256, SHARD_64_64, SHARD_128_32, SHARD_512_8} {
+		if numDBs, _, _ := GetShardConfig(mode); numDBs == sharded {
+			return mode
+		}
+	}
+	return -1
+} // end func detectShardMode
+
+// legacyManifest returns the manifest of a hashDB created before HashDBManifestFile existed
+// or nil if there is none. Such a hashDB stores offsets as OffsetsText.
+func (his *HISTORY) legacyManifest(want *HashDBManifest, newHisDat bool) *HashDBManifest {
+	m := &HashDBManifest{Version: manifestVersion, Backend: want.Backend, KeyLen: want.KeyLen, Offsets: OffsetsText}
+	if his.hashDB != nil && newHisDat {
+		// a preset hashDB created its databases before BootHistory created history.dat
+		return nil
+	}
+	switch want.Backend {
+	case "sqlite3":
+		if m.ShardMode = detectShardMode(his.DIR); m.ShardMode < 0 {
+			return nil
+		}
+		return m
+	case "mysql":
+		// the databases are not in HistoryDir: an existing history.dat has a hashDB
+		if newHisDat {
+			return nil
+		}
+		return m
+	}
+	return nil
+} // end func legacyManifest
+
+// checkManifest compares the hashDB in HistoryDir with o before BootHistory opens it and returns its manifest.
+// A mismatch is an error. o.Offsets OffsetsKeep is set to the encoding of the hashDB.
+// With o.AutoMigrate another shard mode or offset encoding is migrated:
+// o.ShardMode is set to the mode of the hashDB and the mode to migrate to is returned, else -1.
+// Without a hashDB the manifest is made from o. A new or changed manifest is marked unsaved:
+// BootHistory writes it once the hashDB is open.
+func (his *HISTORY) checkManifest(o *BootOptions, newHisDat bool) (have *HashDBManifest, migrateTo int, err error) {
+	want := his.expectedManifest(o)
+	if his.hashDB != nil {
+		o.ShardMode = want.ShardMode
+	}
+	have, err = readManifest(his.DIR)
+	if err != nil {
+		return nil, -1, fmt.Errorf("ERROR checkManifest: %w", err)
+	}
+	if have != nil && have.Backend == "sqlite3" && detectShardMode(his.DIR) < 0 {
+		// the databases got removed to rebuild the hashDB from history.dat
+		log.Printf("WARN BootHistory %s without databases: creates a new hashDB", HashDBManifestFile)
+		have = nil
+	}
+	if have == nil {
+		if have = his.legacyManifest(want, newHisDat); have == nil {
+			if want.Offsets == OffsetsKeep {
+				want.Offsets, o.Offsets = OffsetsVarint, OffsetsVarint
+			}
+			want.unsaved = true
+			return want, -1, nil
+		}
+		log.Printf("BootHistory found a hashDB without %s: backend=%s shardmode=%d offsets=%d", HashDBManifestFile, have.Backend, have.ShardMode, have.Offsets)
+		have.unsaved = true
+	}
+	if have.Version > manifestVersion {
+		return nil, -1, fmt.Errorf("ERROR BootHistory %s version=%d is newer than %d: %w", HashDBManifestFile, have.Version, manifestVersion, ErrHashDBMismatch)
+	}
+	if have.Backend != want.Backend {
+		return nil, -1, fmt.Errorf("ERROR BootHistory hashDB backend='%s' but the hashDB in '%s' is '%s': %w", want.Backend, his.DIR, have.Backend, ErrHashDBMismatch)
+	}
+	if have.KeyLen != want.KeyLen {
+		return nil, -1, fmt.Errorf("ERROR BootHistory KeyLen=%d but the hashDB has KeyLen=%d: %w", want.KeyLen, have.KeyLen, ErrKeyLenMismatch)
+	}
+	if want.Offsets == OffsetsKeep {
+		want.Offsets, o.Offsets = have.Offsets, have.Offsets
+	}
+	if have.Offsets != want.Offsets {
+		if !o.AutoMigrate {
+			return nil, -1, fmt.Errorf("ERROR BootHistory Offsets=%d but the hashDB has offset encoding %d, set AutoMigrate or run ConvertHashDBOffsets: %w", want.Offsets, have.Offsets, ErrHashDBMismatch)
+		}
+		log.Printf("BootHistory converts the offsets of the hashDB from encoding %d to %d", have.Offsets, want.Offsets)
+	}
+	if have.ShardMode != want.ShardMode {
+		if his.hashDB != nil {
+			// a preset hashDB is open already
+			return nil, -1, fmt.Errorf("ERROR BootHistory the preset hashDB has shard mode %d but the hashDB in '%s' has %d: %w", want.ShardMode, his.DIR, have.ShardMode, ErrHashDBMismatch)
+		}
+		if !o.AutoMigrate {
+			return nil, -1, fmt.Errorf("ERROR BootHistory ShardMode=%d but the hashDB has shard mode %d, set AutoMigrate to migrate it: %w", want.ShardMode, have.ShardMode, ErrHashDBMismatch)
+		}
+		log.Printf("BootHistory opens the hashDB with shard mode %d and migrates it to %d", have.ShardMode, want.ShardMode)
+		o.ShardMode = have.ShardMode
+		return have, want.ShardMode, nil
+	}
+	if have.Version < manifestVersion {
+		have.Version = manifestVersion
+		have.unsaved = true
+	}
+	return have, -1, nil
+} // end func checkManifest
+
+// openOffsets sets the offset encoding of the opened hashDB to that of its manifest m.
+// It converts the hashDB to enc if they differ or a conversion did not finish.
+// An unsaved manifest gets written.
+func (his *HISTORY) openOffsets(m *HashDBManifest, enc int) error {
+	if m.unsaved {
+		if err := writeManifest(his.DIR, m); err != nil {
+			return err
+		}
+		m.unsaved = false
+	}
+	c, ok := his.hashDB.(offsetCoder)
+	if !ok {
+		// a custom backend stores offsets its own way
+		if m.Offsets != enc || m.Converting {
+			m.Offsets, m.Converting = enc, false
+			return writeManifest(his.DIR, m)
+		}
+		return nil
+	}
+	c.setOffsetEncoding(m.Offsets)
+	if m.Offsets == enc && !m.Converting {
+		return nil
+	}
+	_, err := his.convertOffsets(c, m, enc)
+	return err
+} // end func openOffsets
+
+// convertOffsets converts the hashDB c with manifest m to offset encoding enc.
+// The manifest marks the conversion until it is done: BootHistory repeats an interrupted conversion.
+func (his *HISTORY) convertOffsets(c offsetCoder, m *HashDBManifest, enc int) (keys uint64, err error) {
+	start := time.Now()
+	log.Printf("converting the offsets of the hashDB from encoding %d to %d", m.Offsets, enc)
+	m.Offsets, m.Converting = enc, true
+	if err := writeManifest(his.DIR, m); err != nil {
+		return 0, err
+	}
+	if keys, err = c.convertOffsets(enc); err != nil {
+		return keys, fmt.Errorf("ERROR convertOffsets: %w: %w", ErrBackendUnavailable, err)
+	}
+	m.Converting = false
+	if err := writeManifest(his.DIR, m); err != nil {
+		return keys, err
+	}
+	log.Printf("converted the offsets of %d keys to encoding %d took=(%d ms)", keys, enc, time.Since(start).Milliseconds())
+	return keys, nil
+} // end func convertOffsets
+
+// ConvertHashDBOffsets converts the SQLite3 or MySQL hashDB of the history in historyDir to offset encoding enc
+// and returns the number of converted keys. The history must not be booted and needs a HashDBManifestFile.
+// BootHistory with BootOptions.AutoMigrate and Offsets=enc does the same.
+func ConvertHashDBOffsets(historyDir string, enc int) (uint64, error) {
+	if enc != OffsetsText && enc != OffsetsVarint {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets unknown encoding=%d: %w", enc, ErrInvalidConfig)
+	}
+	if utils.FileExists(filepath.Join(historyDir, RunningMarkerFile)) {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets found %s: history is booted or was not closed: %w", RunningMarkerFile, ErrAlreadyBooted)
+	}
+	m, err := readManifest(historyDir)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets: %w", err)
+	}
+	if m == nil {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets no %s in '%s': boot the history once: %w", HashDBManifestFile, historyDir, ErrInvalidConfig)
+	}
+	his := &HISTORY{DIR: historyDir}
+	db, err := his.openHashDB(m.Backend, m.ShardMode)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets: %w", err)
+	}
+	defer db.Close()
+	c, ok := db.(offsetCoder)
+	if !ok {
+		return 0, fmt.Errorf("ERROR ConvertHashDBOffsets backend '%s' has no offset encoding: %w", m.Backend, ErrInvalidConfig)
+	}
+	c.setOffsetEncoding(m.Offsets)
+	if m.Offsets == enc && !m.Converting {
+		return 0, nil
+	}
+	return his.convertOffsets(c, m, enc)
+} // end func ConvertHashDBOffsets
@@ -0,0 +1,523 @@
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-while/go-utils"
+)
+
+// ShardMigrateDir is the folder in HistoryDir where MigrateShardMode builds the hashDB of the new shard mode.
+const ShardMigrateDir = "hashdb.migrate"
+
+// ShardSwapMarkerFile exists while MigrateShardMode moves the databases of the new shard mode into HistoryDir.
+// If BootHistory finds it the swap gets finished.
+const ShardSwapMarkerFile = "hashdb.swap"
+
+// shardOldDir takes the databases of the old shard mode during the swap.
+const shardOldDir = "hashdb.old"
+
+// flagPause stops a hashDB_Worker until HistoryIndex.resume is closed. See pauseWorkers.
+const flagPause = -4
+
+// MigrateStats is returned by MigrateShardMode.
+type MigrateStats struct {
+	FromMode   int           // shard mode before
+	ToMode     int           // shard mode after
+	Keys       uint64        // keys copied
+	Offsets    uint64        // offsets copied
+	DualWrites uint64        // offsets written to both while copying
+	Duration   time.Duration // runtime
+}
+
+// shardMigration is set in HISTORY.migration while MigrateShardMode copies the hashDB.
+type shardMigration struct {
+	// batchQueue.flush and insertOffset hold RLock while they write both backends, the copy holds Lock per prefix
+	mux        sync.RWMutex
+	target     *SQLite3ShardedDB
+	failed     atomic.Bool
+	dualWrites atomic.Uint64
+}
+
+// insert writes batch to the target too. Called by batchQueue.flush and insertOffset with mux held.
+func (m *shardMigration) insert(batch []*OffsetData) {
+	if len(batch) == 0 || m.failed.Load() {
+		return
+	}
+	if err := m.target.InsertOffsets(batch); err != nil {
+		log.Printf("ERROR MigrateShardMode dual write items=%d err='%v'", len(batch), err)
+		m.failed.Store(true)
+		return
+	}
+	m.dualWrites.Add(uint64(len(batch)))
+} // end func insert
+
+// shardRow is a row of a hashDB table: key without prefix and encoded offsets.
+type shardRow struct {
+	h string
+	o []byte
+}
+
+// shardScanner reads the index prefix by prefix. SQLite3DB and SQLite3ShardedDB implement it.
+// prefix is the 3 char hex prefix of the keys: 0x000-0xfff.
+type shardScanner interface {
+	scanPrefix(prefix int) ([]shardRow, error)
+	countPrefix(prefix int) (rows uint64, offsets uint64, err error)
+}
+
+// MigrateShardMode moves the SQLite3 hashDB to shard mode toMode while the history keeps running.
+// The index is copied prefix by prefix into ShardMigrateDir. Meanwhile new offsets are written
+// to both layouts. Then the hashDB_Workers pause, keys and offsets of both layouts are compared
+// and the new databases replace the old ones in HistoryDir. Expire, Compact and ReplayHisDat wait.
+// Boot the history with BootOptions.ShardMode = toMode afterwards: HashDBManifestFile has the new mode.
+func (his *HISTORY) MigrateShardMode(toMode int) (*MigrateStats, error) {
+	his.mux.Lock()
+	if his.stop == nil || his.IndexChan == nil {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR MigrateShardMode: %w", ErrNotBooted)
+	}
+	if his.isClosed() {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR MigrateShardMode: %w", ErrClosed)
+	}
+	source, ok := his.hashDB.(shardScanner)
+	if !ok {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR MigrateShardMode hashDB %T is no SQLite3 backend: %w", his.hashDB, ErrInvalidConfig)
+	}
+	fromMode := his.ShardMode
+	if toMode < SHARD_SINGLE_DB || toMode > SHARD_512_8 || toMode == fromMode {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR MigrateShardMode from=%d to=%d: %w", fromMode, toMode, ErrInvalidConfig)
+	}
+	// Close waits for us before it closes the hashDB
+	his.bgWG.Add(1)
+	his.mux.Unlock()
+	defer his.bgWG.Done()
+
+	// nothing else may write the hashDB but the workers
+	for _, lock := range []chan struct{}{his.lockCompact, his.lockExpire, his.lockReplay} {
+		if !LOCKfunc(lock, "MigrateShardMode") {
+			return nil, fmt.Errorf("ERROR MigrateShardMode: Compact, Expire or ReplayHisDat running")
+		}
+		defer UNLOCKfunc(lock, "MigrateShardMode")
+	}
+	return his.migrateShardMode(source, fromMode, toMode)
+} // end func MigrateShardMode
+
+func (his *HISTORY) migrateShardMode(source shardScanner, fromMode int, toMode int) (*MigrateStats, error) {
+	start := time.Now()
+	stats := &MigrateStats{FromMode: fromMode, ToMode: toMode}
+	migrateDir := filepath.Join(his.DIR, ShardMigrateDir)
+	if err := os.RemoveAll(migrateDir); err != nil {
+		return nil, fmt.Errorf("ERROR MigrateShardMode: %w", err)
+	}
+	if err := os.MkdirAll(migrateDir, 0755); err != nil {
+		return nil, fmt.Errorf("ERROR MigrateShardMode: %w", err)
+	}
+	target, err := NewSQLite3ShardedDB(&ShardConfig{Mode: toMode, BaseDir: migrateDir, MaxOpenPerDB: 8, Timeout: 30, StmtCacheSize: his.opts.StmtCacheSize}, true)
+	if err != nil {
+		os.RemoveAll(migrateDir)
+		return nil, fmt.Errorf("ERROR MigrateShardMode: %w: %w", ErrBackendUnavailable, err)
+	}
+	enc := OffsetsText
+	if c, ok := source.(offsetCoder); ok {
+		enc = c.offsetEncoding()
+	}
+	target.setOffsetEncoding(enc)
+	m := &shardMigration{target: target}
+	swapped := false
+	defer func() {
+		if !swapped {
+			his.migration.Store(nil)
+			m.mux.Lock() // no flush writes the target anymore
+			target.Close()
+			m.mux.Unlock()
+			os.RemoveAll(migrateDir)
+		}
+	}()
+
+	// 1. dual write: every flush after the barrier sees the migration
+	his.migration.Store(m)
+	if err := his.workerBarrier(); err != nil {
+		return nil, err
+	}
+
+	// 2. copy prefix by prefix
+	log.Printf("MigrateShardMode copying hashDB from mode %d to %d", fromMode, toMode)
+	for prefix := 0; prefix < 4096; prefix++ {
+		if his.isClosed() {
+			return nil, fmt.Errorf("ERROR MigrateShardMode stopped at prefix=%03x: %w", prefix, ErrClosed)
+		}
+		m.mux.Lock()
+		rows, err := source.scanPrefix(prefix)
+		if err == nil {
+			err = target.putPrefix(prefix, rows)
+		}
+		m.mux.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("ERROR MigrateShardMode prefix=%03x: %w: %w", prefix, ErrBackendUnavailable, err)
+		}
+		if m.failed.Load() {
+			return nil, fmt.Errorf("ERROR MigrateShardMode dual write failed: %w", ErrBackendUnavailable)
+		}
+		stats.Keys += uint64(len(rows))
+		if prefix%256 == 255 {
+			logf(DEBUG, "MigrateShardMode prefix=%03x keys=%d", prefix, stats.Keys)
+		}
+	}
+
+	// 3. pause the workers and compare both layouts
+	resume, err := his.pauseWorkers()
+	if err != nil {
+		return nil, err
+	}
+	defer resume()
+	if m.failed.Load() {
+		return nil, fmt.Errorf("ERROR MigrateShardMode dual write failed: %w", ErrBackendUnavailable)
+	}
+	stats.Keys = 0
+	for prefix := 0; prefix < 4096; prefix++ {
+		rowsA, offsetsA, err := source.countPrefix(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR MigrateShardMode verify source prefix=%03x: %w: %w", prefix, ErrBackendUnavailable, err)
+		}
+		rowsB, offsetsB, err := target.countPrefix(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR MigrateShardMode verify target prefix=%03x: %w: %w", prefix, ErrBackendUnavailable, err)
+		}
+		if rowsA != rowsB || offsetsA != offsetsB {
+			return nil, fmt.Errorf("ERROR MigrateShardMode verify prefix=%03x keys=%d/%d offsets=%d/%d: %w", prefix, rowsA, rowsB, offsetsA, offsetsB, ErrBackendUnavailable)
+		}
+		stats.Keys += rowsA
+		stats.Offsets += offsetsA
+	}
+	stats.DualWrites = m.dualWrites.Load()
+
+	// 4. swap the databases: the workers wait, nobody uses the hashDB
+	manifest := &HashDBManifest{Version: manifestVersion, Backend: "sqlite3", ShardMode: toMode, KeyLen: his.opts.KeyLen, Offsets: enc}
+	if err := writeManifest(migrateDir, manifest); err != nil {
+		return nil, err
+	}
+	his.migration.Store(nil)
+	swapped = true
+	target.Close()
+	if err := his.hashDB.Close(); err != nil {
+		log.Printf("WARN MigrateShardMode closing old hashDB err='%v'", err)
+	}
+	if err := his.swapShardFiles(toMode); err != nil {
+		// the marker stays: the next boot finishes the swap
+		his.SetHashDB(&failedHashDB{err: err})
+		his.indexLost.Store(true)
+		return nil, err
+	}
+	his.mux.Lock()
+	his.hashDB, his.SQLite3Pool = nil, nil
+	if _, err := his.openHashDB("sqlite3", toMode); err != nil {
+		his.hashDB = &failedHashDB{err: err}
+		his.mux.Unlock()
+		his.indexLost.Store(true)
+		return nil, fmt.Errorf("ERROR MigrateShardMode reopen: %w", err)
+	}
+	if c, ok := his.hashDB.(offsetCoder); ok {
+		c.setOffsetEncoding(enc)
+	}
+	his.opts.ShardMode = toMode
+	his.mux.Unlock()
+	stats.Duration = time.Since(start)
+	log.Printf("MigrateShardMode done mode %d -> %d keys=%d offsets=%d dualWrites=%d took=(%d ms)",
+		fromMode, toMode, stats.Keys, stats.Offsets, stats.DualWrites, stats.Duration.Milliseconds())
+	return stats, nil
+} // end func migrateShardMode
+
+// pauseWorkers stops all hashDB_Workers after they committed their batch queue.
+// Nobody uses the hashDB until resume is called.
+func (his *HISTORY) pauseWorkers() (resume func(), err error) {
+	ch := make(chan struct{})
+	resume = sync.OnceFunc(func() { close(ch) })
+	replies := make([]chan int, len(his.indexChans))
+	for i, indexchan := range his.indexChans {
+		replies[i] = make(chan int, 1)
+		select {
+		case indexchan <- &HistoryIndex{Offset: flagPause, IndexRetChan: replies[i], resume: ch}:
+		case <-his.workersDone:
+			resume()
+			return nil, fmt.Errorf("ERROR pauseWorkers hashDB_Workers stopped: %w", ErrClosed)
+		}
+	}
+	for _, reply := range replies {
+		select {
+		case isDup := <-reply:
+			if isDup != CaseAdded {
+				resume()
+				return nil, fmt.Errorf("ERROR pauseWorkers batch flush failed: %w", ErrBackendUnavailable)
+			}
+		case <-his.workersDone:
+			resume()
+			return nil, fmt.Errorf("ERROR pauseWorkers hashDB_Workers stopped: %w", ErrClosed)
+		}
+	}
+	return resume, nil
+} // end func pauseWorkers
+
+// failedHashDB replaces the hashDB if MigrateShardMode could not open the new one.
+// Lookups return CaseRetry until the history is booted again.
+type failedHashDB struct {
+	err error
+}
+
+func (f *failedHashDB) GetOffsets(key string) ([]int64, error) {
+	return nil, f.err
+}
+
+func (f *failedHashDB) InsertOffset(key string, offset int64) error {
+	return f.err
+}
+
+func (f *failedHashDB) Close() error {
+	return nil
+}
+
+func (f *failedHashDB) Stats() map[string]interface{} {
+	return map[string]interface{}{"backend": "failed", "error": f.err.Error()}
+}
+
+// shardFiles returns the database files and the manifest of the SQLite3 hashDB in dir.
+func shardFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"hashdb.sqlite3*", "hashdb_*.sqlite3*", HashDBManifestFile} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+} // end func shardFiles
+
+// moveFiles moves files into dir.
+func moveFiles(files []string, dir string) error {
+	for _, path := range files {
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+	syncDir(dir)
+	return nil
+} // end func moveFiles
+
+// writeSwapMarker persists the phase of the swap to mode: "old" moves the old databases out
+// of HistoryDir, "new" moves the new ones in.
+func (his *HISTORY) writeSwapMarker(phase string, mode int) error {
+	path := filepath.Join(his.DIR, ShardSwapMarkerFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%s %d\n", phase, mode)), 0644); err != nil {
+		return err
+	}
+	if fh, err := os.Open(tmp); err == nil {
+		fh.Sync()
+		fh.Close()
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(his.DIR)
+	return nil
+} // end func writeSwapMarker
+
+// swapShardFiles replaces the databases in HistoryDir with those in ShardMigrateDir.
+// The databases must be closed. A crash leaves ShardSwapMarkerFile: BootHistory finishes the swap.
+func (his *HISTORY) swapShardFiles(mode int) error {
+	if err := his.writeSwapMarker("old", mode); err != nil {
+		return fmt.Errorf("ERROR swapShardFiles marker: %w", err)
+	}
+	return his.finishShardSwap("old", mode)
+} // end func swapShardFiles
+
+// finishShardSwap runs the swap from phase on: "old" or "new".
+func (his *HISTORY) finishShardSwap(phase string, mode int) error {
+	oldDir := filepath.Join(his.DIR, shardOldDir)
+	migrateDir := filepath.Join(his.DIR, ShardMigrateDir)
+	if phase == "old" {
+		// nothing of the new mode is in HistoryDir yet: all database files there are old
+		if err := os.MkdirAll(oldDir, 0755); err != nil {
+			return fmt.Errorf("ERROR finishShardSwap: %w", err)
+		}
+		files, err := shardFiles(his.DIR)
+		if err == nil {
+			err = moveFiles(files, oldDir)
+		}
+		if err != nil {
+			return fmt.Errorf("ERROR finishShardSwap moving old databases: %w", err)
+		}
+		syncDir(his.DIR)
+		if err := his.writeSwapMarker("new", mode); err != nil {
+			return fmt.Errorf("ERROR finishShardSwap marker: %w", err)
+		}
+	}
+	files, err := shardFiles(migrateDir)
+	if err == nil {
+		err = moveFiles(files, his.DIR)
+	}
+	if err != nil {
+		return fmt.Errorf("ERROR finishShardSwap moving new databases: %w", err)
+	}
+	if err := os.Remove(filepath.Join(his.DIR, ShardSwapMarkerFile)); err != nil {
+		return fmt.Errorf("ERROR finishShardSwap removing %s: %w", ShardSwapMarkerFile, err)
+	}
+	syncDir(his.DIR)
+	os.RemoveAll(migrateDir)
+	os.RemoveAll(oldDir)
+	return nil
+} // end func finishShardSwap
+
+// checkShardSwap is called by BootHistory before the hashDB is opened.
+// It finishes a swap of MigrateShardMode and returns its shard mode, else -1.
+// An unfinished copy in ShardMigrateDir is removed.
+func (his *HISTORY) checkShardSwap() (int, error) {
+	path := filepath.Join(his.DIR, ShardSwapMarkerFile)
+	if !utils.FileExists(path) {
+		os.RemoveAll(filepath.Join(his.DIR, ShardMigrateDir))
+		return -1, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1, fmt.Errorf("ERROR checkShardSwap: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || (fields[0] != "old" && fields[0] != "new") {
+		return -1, fmt.Errorf("ERROR checkShardSwap bad %s='%s': %w", ShardSwapMarkerFile, data, ErrInvalidConfig)
+	}
+	mode, err := strconv.Atoi(fields[1])
+	if err != nil || mode < SHARD_SINGLE_DB || mode > SHARD_512_8 {
+		return -1, fmt.Errorf("ERROR checkShardSwap bad %s='%s': %w", ShardSwapMarkerFile, data, ErrInvalidConfig)
+	}
+	log.Printf("WARN BootHistory found %s: finishing the swap to shard mode %d", ShardSwapMarkerFile, mode)
+	if err := his.finishShardSwap(fields[0], mode); err != nil {
+		return -1, err
+	}
+	return mode, nil
+} // end func checkShardSwap
+
+// scanPrefix implements shardScanner
+func (s *SQLite3DB) scanPrefix(prefix int) ([]shardRow, error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReturnDB(db)
+	return scanTable(db, fmt.Sprintf("s%03x", prefix))
+}
+
+// countPrefix implements shardScanner
+func (s *SQLite3DB) countPrefix(prefix int) (rows uint64, offsets uint64, err error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.ReturnDB(db)
+	return countTable(db, fmt.Sprintf("s%03x", prefix))
+}
+
+// scanPrefix implements shardScanner
+func (s *SQLite3ShardedDB) scanPrefix(prefix int) ([]shardRow, error) {
+	dbIndex, table := prefix/s.tablesPerDB, prefix%s.tablesPerDB
+	db, err := s.DBPools[dbIndex].GetDB(true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.DBPools[dbIndex].ReturnDB(db)
+	return scanTable(db, s.tableName(table))
+}
+
+// countPrefix implements shardScanner
+func (s *SQLite3ShardedDB) countPrefix(prefix int) (rows uint64, offsets uint64, err error) {
+	dbIndex, table := prefix/s.tablesPerDB, prefix%s.tablesPerDB
+	db, err := s.DBPools[dbIndex].GetDB(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.DBPools[dbIndex].ReturnDB(db)
+	return countTable(db, s.tableName(table))
+}
+
+// putPrefix replaces all rows of prefix with rows in one transaction
+func (s *SQLite3ShardedDB) putPrefix(prefix int, rows []shardRow) error {
+	dbIndex, table := prefix/s.tablesPerDB, prefix%s.tablesPerDB
+	tableName := s.tableName(table)
+	db, err := s.DBPools[dbIndex].GetDB(true)
+	if err != nil {
+		return err
+	}
+	defer s.DBPools[dbIndex].ReturnDB(db)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", tableName)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (h, o) VALUES (?, ?)", tableName))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.h, row.o); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+// scanTable returns all rows of table.
+func scanTable(db *sql.DB, table string) ([]shardRow, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT h, o FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []shardRow
+	for rows.Next() {
+		var row shardRow
+		if err := rows.Scan(&row.h, &row.o); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+} // end func scanTable
+
+// countTable returns the number of keys and offsets in table.
+func countTable(db *sql.DB, table string) (rows uint64, offsets uint64, err error) {
+	result, err := db.Query(fmt.Sprintf("SELECT o FROM %s", table))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer result.Close()
+	var o []byte
+	for result.Next() {
+		if err := result.Scan(&o); err != nil {
+			return rows, offsets, err
+		}
+		n, err := countOffsets(o)
+		if err != nil {
+			return rows, offsets, err
+		}
+		rows++
+		offsets += uint64(n)
+	}
+	return rows, offsets, result.Err()
+} // end func countTable
@@ -0,0 +1,275 @@
+package history
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+var (
+	// HisDatMmapMax is the default address-space budget for history.dat.
+	// Beyond it lines are read with ReadAt. 0 disables mmap.
+	HisDatMmapMax int64 = defaultMmapMax()
+	// HisDatMmapGrow: the mapping grows once history.dat grew by this many bytes.
+	// Until then new lines are read with ReadAt.
+	HisDatMmapGrow int64 = 64 * 1024 * 1024
+)
+
+// maxMmap is the upper limit of BootOptions.MmapMax
+var maxMmap int64 = func() int64 {
+	if strconv.IntSize == 32 {
+		return 1 << 30
+	}
+	return 1 << 46
+}()
+
+func defaultMmapMax() int64 {
+	if strconv.IntSize == 32 {
+		return 256 * 1024 * 1024
+	}
+	return 64 * 1024 * 1024 * 1024
+} // end func defaultMmapMax
+
+// hisDatReader reads a segment of history.dat for hashDB_Worker and Lookup without a syscall per lookup.
+// The first MmapMax bytes are mapped read-only, the rest is read with ReadAt on a shared fd.
+// ReadAt is safe for concurrent use.
+type hisDatReader struct {
+	mux    sync.RWMutex
+	fh     *os.File
+	mm     mmap.MMap // nil if nothing is mapped
+	max    int64     // address-space budget
+	grow   int64     // remap after the file grew by this many bytes
+	growMu sync.Mutex
+	closed bool
+}
+
+// hashBufPool holds the buffers of readHashAt: {sha256}\t
+var hashBufPool = sync.Pool{New: func() any { b := make([]byte, 67); return &b }}
+
+func newHisDatReader(path string, mmapMax int64, grow int64) (*hisDatReader, error) {
+	fh, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	r := &hisDatReader{fh: fh, max: mmapMax, grow: max(grow, 1)}
+	if err := r.remap(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return r, nil
+} // end func newHisDatReader
+
+// ReadAt reads from the mapping if p fits into it, else from the shared fd.
+func (r *hisDatReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mux.RLock()
+	if off >= 0 && off+int64(len(p)) <= int64(len(r.mm)) {
+		n := copy(p, r.mm[off:])
+		r.mux.RUnlock()
+		return n, nil
+	}
+	mapped := int64(len(r.mm))
+	n, err := r.fh.ReadAt(p, off)
+	r.mux.RUnlock()
+	if r.max > mapped && off-mapped >= r.grow {
+		// history.dat grew: map the new part
+		go r.growMap(mapped)
+	}
+	return n, err
+} // end func ReadAt
+
+// growMap maps the file again if nobody did it since mapped was read.
+func (r *hisDatReader) growMap(mapped int64) {
+	if !r.growMu.TryLock() {
+		return
+	}
+	defer r.growMu.Unlock()
+	r.mux.RLock()
+	done := r.closed || int64(len(r.mm)) != mapped
+	r.mux.RUnlock()
+	if done {
+		return
+	}
+	if err := r.remap(); err != nil {
+		log.Printf("ERROR hisDatReader remap err='%v'", err)
+	}
+} // end func growMap
+
+// remap maps min(size, max) bytes of the file.
+func (r *hisDatReader) remap() error {
+	if r.max <= 0 {
+		return nil
+	}
+	fileInfo, err := r.fh.Stat()
+	if err != nil {
+		return err
+	}
+	size := min(fileInfo.Size(), r.max)
+	if size <= 0 {
+		return nil
+	}
+	mm, err := mmap.MapRegion(r.fh, int(size), mmap.RDONLY, 0, 0)
+	if err != nil {
+		return fmt.Errorf("mmap size=%d: %w", size, err)
+	}
+	r.mux.Lock()
+	old := r.mm
+	r.mm = mm
+	r.mux.Unlock()
+	if old != nil {
+		return old.Unmap()
+	}
+	return nil
+} // end func remap
+
+// reopen switches to a new file at path: Compact renamed it over history.dat.
+func (r *hisDatReader) reopen(path string) error {
+	fh, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	r.growMu.Lock()
+	defer r.growMu.Unlock()
+	r.mux.Lock()
+	oldfh, oldmm := r.fh, r.mm
+	r.fh, r.mm = fh, nil
+	r.mux.Unlock()
+	if oldmm != nil {
+		oldmm.Unmap()
+	}
+	oldfh.Close()
+	return r.remap()
+} // end func reopen
+
+func (r *hisDatReader) Close() error {
+	r.growMu.Lock()
+	defer r.growMu.Unlock()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.closed = true
+	if r.mm != nil {
+		r.mm.Unmap()
+		r.mm = nil
+	}
+	return r.fh.Close()
+} // end func Close
+
+// segReader routes reads to one hisDatReader per segment of history.dat.
+// Segments are opened on first use. The mmap budget MmapMax applies to every segment.
+type segReader struct {
+	mux     sync.Mutex
+	his     *HISTORY
+	readers map[int]*hisDatReader
+	gone    map[int]bool // dropped by Expire
+	mmapMax int64
+	grow    int64
+}
+
+func newSegReader(his *HISTORY, mmapMax int64, grow int64) *segReader {
+	return &segReader{his: his, readers: make(map[int]*hisDatReader), gone: make(map[int]bool), mmapMax: mmapMax, grow: grow}
+} // end func newSegReader
+
+// get returns the reader of segment seg or nil if the segment does not exist.
+func (sr *segReader) get(seg int) (*hisDatReader, error) {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	if r := sr.readers[seg]; r != nil {
+		return r, nil
+	}
+	if sr.gone[seg] {
+		return nil, nil
+	}
+	r, err := newHisDatReader(sr.his.segmentPath(seg), sr.mmapMax, sr.grow)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sr.readers[seg] = r
+	return r, nil
+} // end func get
+
+// ReadAt reads at the position of offset in its segment. A missing segment reads as EOF.
+func (sr *segReader) ReadAt(p []byte, offset int64) (int, error) {
+	seg, local := splitOffset(offset)
+	r, err := sr.get(seg)
+	if err != nil {
+		return 0, err
+	}
+	if r == nil {
+		return 0, io.EOF
+	}
+	return r.ReadAt(p, local)
+} // end func ReadAt
+
+// reopen switches segment seg to the file renamed over it by Compact.
+func (sr *segReader) reopen(seg int) error {
+	r, err := sr.get(seg)
+	if err != nil || r == nil {
+		return err
+	}
+	return r.reopen(sr.his.segmentPath(seg))
+} // end func reopen
+
+// drop closes segment seg: Expire removes it. Reads return EOF from now on.
+func (sr *segReader) drop(seg int) {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	sr.gone[seg] = true
+	if r := sr.readers[seg]; r != nil {
+		r.Close()
+		delete(sr.readers, seg)
+	}
+} // end func drop
+
+func (sr *segReader) Close() error {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	var errs []error
+	for seg, r := range sr.readers {
+		if err := r.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(sr.readers, seg)
+	}
+	return errors.Join(errs...)
+} // end func Close
+
+// readHashAt returns the hash of the line at offset or eofhash past the end of its segment.
+func (sr *segReader) readHashAt(offset int64) (string, error) {
+	return readHashAt(sr, offset, sr.his.settings.Fv)
+} // end func readHashAt
+
+// readHashAt returns the hash of the record of format at offset in r or eofhash past its end.
+func readHashAt(r io.ReaderAt, offset int64, format int) (string, error) {
+	bufp := hashBufPool.Get().(*[]byte)
+	defer hashBufPool.Put(bufp)
+	buf := *bufp
+	if format == FormatBinary {
+		buf = buf[:binArrivalPos] // tag + raw sha256
+	}
+	n, err := r.ReadAt(buf, offset)
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			return eofhash, nil
+		}
+		return "", err
+	}
+	if format == FormatBinary {
+		if buf[0] != binRecordTag {
+			return "", fmt.Errorf("ERROR readHashAt BAD record @offset=%d tag=%x", offset, buf[0])
+		}
+		return hex.EncodeToString(buf[binHashPos:]), nil
+	}
+	if buf[0] != '{' || buf[65] != '}' || buf[66] != '\t' {
+		return "", fmt.Errorf("ERROR readHashAt BAD line @offset=%d result='%s'", offset, buf)
+	}
+	return string(buf[1:65]), nil
+} // end func readHashAt
@@ -4,9 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/go-while/go-utils"
@@ -14,70 +14,55 @@ import (
 
 type SQL struct {
 	mux     sync.RWMutex
-	ctr     sync.RWMutex // counter
-	DBs     chan *DBconn
+	ctr     sync.RWMutex    // counter
+	slots   []chan *DBconn  // free connection of every slot, db=nil until it is opened
+	slotOf  map[*sql.DB]int // slot of every open connection. held by ctr
+	next    atomic.Uint32   // first slot GetDB tries
 	dsn     string
 	maxOpen int
 	isOpen  int
 	timeout int64
+	offsets int         // offset encoding: OffsetsText or OffsetsVarint
+	stmts   *stmtCaches // prepared statements per connection
 } // end func SQLhandler
 
-func (his *HISTORY) hashDB_Init(driver string) {
-	switch driver {
-	case "mysql":
-		// Initialize MySQL RocksDB connection pool
-		opts := &DBopts{
-			username: "nntp_history",   // You can make these configurable
-			password: "password",       // You can make these configurable
-			hostname: "localhost:3306", // You can make these configurable
-			dbname:   "nntp_history",   // You can make these configurable
-			params:   "?charset=utf8mb4&parseTime=True&loc=Local",
-			maxopen:  64, // You can make this configurable
-			initopen: 16, // You can make this configurable
-			tcpmode:  "tcp",
-			timeout:  30,
-		}
-
-		var err error
-		his.MySQLPool, err = NewSQLpool(opts, true) // true = create tables
-		if err != nil {
-			log.Fatalf("ERROR hashDB_Init failed to initialize MySQL pool: %v", err)
-		}
-		log.Printf("MySQL RocksDB pool initialized successfully")
-
-	//case "sqlite3":
-	//	// pass
-	default:
-		log.Fatalf("hashDB_Init driver %s not implemented", driver)
+// hashDB_Init starts the index pipeline (hashDB_Index and hashDB_Worker) on top of any HashDB backend.
+func (his *HISTORY) hashDB_Init(db HashDB) error {
+	if db == nil {
+		return fmt.Errorf("ERROR hashDB_Init db=nil: %w", ErrBackendUnavailable)
 	}
+	his.hashDB = db
 
 	// Initialize charsMap and indexChans
 	his.charsMap = make(map[string]int, NumCacheDBs)
 	his.indexChans = make([]chan *HistoryIndex, NumCacheDBs)
-	for i, char := range ROOTDBS {
+	for i, char := range his.rootDBs {
 		his.charsMap[char] = i
 		his.indexChans[i] = make(chan *HistoryIndex, 16)
 	}
+	his.IndexChan = make(chan *HistoryIndex, his.opts.NumQueueIndexChan)
 
 	// Start workers
-	for i, char := range ROOTDBS {
+	his.workerWG.Add(len(his.rootDBs) + 1) // + hashDB_Index
+	for i, char := range his.rootDBs {
 		// dont move this up into the first for loop or it drops race conditions for nothing...
 		go his.hashDB_Worker(char, i, his.indexChans[i])
 	}
 	go his.hashDB_Index()
-	//his.ReplayHisDat() // TODO!
+	return nil
 } // end func hashDB_Init
 
 type DBopts struct {
-	username string
-	password string
-	hostname string
-	dbname   string
-	params   string
-	maxopen  int
-	initopen int
-	tcpmode  string
-	timeout  int64
+	username  string
+	password  string
+	hostname  string
+	dbname    string
+	params    string
+	maxopen   int
+	initopen  int
+	tcpmode   string
+	timeout   int64
+	stmtcache int // prepared statements per connection. 0 disables the cache, StmtCacheAuto: stmtCacheAuto
 }
 
 type DBconn struct {
@@ -106,7 +91,7 @@ func NewSQLpool(opts *DBopts, createTables bool) (*SQL, error) {
 	if createTables && opts.initopen <= 0 {
 		opts.initopen = 1
 	}
-	s := &SQL{}
+	s := &SQL{stmts: newStmtCaches(opts.stmtcache, stmtCacheAuto(4096, opts.maxopen), mysqlQuery)}
 	if opts.timeout < 5 {
 		opts.timeout = 5
 		if opts.params == "" {
@@ -127,14 +112,18 @@ func NewSQLpool(opts *DBopts, createTables bool) (*SQL, error) {
 		opts.tcpmode = "tcp"
 	}
 	s.maxOpen = opts.maxopen
-	s.DBs = make(chan *DBconn, s.maxOpen)
+	s.slots = make([]chan *DBconn, s.maxOpen)
+	for i := range s.slots {
+		s.slots[i] = make(chan *DBconn, 1)
+		s.slots[i] <- &DBconn{}
+	}
+	s.slotOf = make(map[*sql.DB]int, s.maxOpen)
 	s.dsn = fmt.Sprintf("%s:%s@%s(%s)/%s%s", opts.username, opts.password, opts.tcpmode, opts.hostname, opts.dbname, opts.params)
-	for i := 0; i < opts.initopen; i++ {
-		db, err := s.GetDB(false)
+	for i := 0; i < min(opts.initopen, s.maxOpen); i++ {
+		db, err := s.getSlotDB(i, true) // counts isOpen
 		if err != nil {
 			return nil, err
 		}
-		s.isOpen++
 		s.ReturnDB(db)
 	}
 
@@ -146,37 +135,76 @@ func NewSQLpool(opts *DBopts, createTables bool) (*SQL, error) {
 	return s, nil
 } // end func NewSQLpool
 
-func (s *SQL) InsertOffset(key string, offset int64, db *sql.DB) error {
-	if db == nil {
-		adb, err := s.GetDB(true)
-		if err != nil {
-			return err
-		}
-		db = adb
-		defer s.ReturnDB(db)
+func (s *SQL) InsertOffset(key string, offset int64) error {
+	db, err := s.getTableDB(keyTable(key))
+	if err != nil {
+		return err
 	}
+	defer s.ReturnDB(db)
 
-	query := fmt.Sprintf("INSERT INTO s%s (h,o) VALUES ('%s','%d,') ON DUPLICATE KEY UPDATE o=CONCAT(o, '%d,')", key[:3], key[3:], offset, offset)
-	_, err := db.Exec(query)
+	tail := appendOffsets(nil, s.offsets, offset)
+	_, err = s.stmts.exec(db, stmtUpsert, "s"+key[:3], key[3:], newOffsetsValue(s.offsets, tail), tail)
 	if err != nil {
-		log.Printf("ERROR history InsertOffset query='%s' err='%v'", query, err)
+		log.Printf("ERROR history InsertOffset key='%s' err='%v'", key, err)
 		return err
 	}
 	return nil
 } // end func InsertOffset
 
-func (s *SQL) GetOffsets(key string, db *sql.DB) ([]int64, error) {
-	if db == nil {
-		adb, err := s.GetDB(true)
-		if err != nil {
-			return nil, err
+// InsertOffsets implements HashDBBatcher: one transaction per table
+func (s *SQL) InsertOffsets(batch []*OffsetData) error {
+	keys, values := groupOffsets(batch, s.offsets)
+	tables := make(map[string][]string)
+	var order []string
+	for _, key := range keys {
+		if _, exists := tables[key[:3]]; !exists {
+			order = append(order, key[:3])
+		}
+		tables[key[:3]] = append(tables[key[:3]], key)
+	}
+	for _, table := range order {
+		if err := s.insertTable(table, tables[table], values); err != nil {
+			return err
 		}
-		db = adb
-		defer s.ReturnDB(db)
 	}
+	return nil
+} // end func InsertOffsets
 
-	var offsetsStr string
-	err := db.QueryRow("SELECT o FROM s"+key[:3]+" WHERE h = ? LIMIT 1", key[3:]).Scan(&offsetsStr)
+// insertTable appends values of keys of table in one transaction on the connection of table.
+func (s *SQL) insertTable(table string, keys []string, values map[string][]byte) error {
+	db, err := s.getTableDB(keyTable(table))
+	if err != nil {
+		return err
+	}
+	defer s.ReturnDB(db)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR history InsertOffsets table=s%s Begin err='%v'", table, err)
+		return err
+	}
+	for _, key := range keys {
+		if _, err := s.stmts.txExec(tx, db, stmtUpsert, "s"+table, key[3:], newOffsetsValue(s.offsets, values[key]), values[key]); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR history InsertOffsets table=s%s key='%s' err='%v'", table, key, err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR history InsertOffsets table=s%s Commit err='%v'", table, err)
+		return err
+	}
+	return nil
+} // end func insertTable
+
+func (s *SQL) GetOffsets(key string) ([]int64, error) {
+	db, err := s.getTableDB(keyTable(key))
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReturnDB(db)
+
+	var value []byte
+	err = s.stmts.queryRow(db, stmtSelect, "s"+key[:3], key[3:]).Scan(&value)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -184,19 +212,57 @@ func (s *SQL) GetOffsets(key string, db *sql.DB) ([]int64, error) {
 		log.Printf("ERROR history GetOffsets err='%v'", err)
 		return nil, err
 	}
-	var offsets []int64
-	if len(offsetsStr) > 0 {
-		offs := strings.Split(offsetsStr, ",")
-		for _, offsetStr := range offs {
-			offset := utils.Str2int64(offsetStr)
-			if offset > 0 {
-				offsets = append(offsets, offset)
+	offsets, err := decodeOffsets(nil, value)
+	if err != nil {
+		log.Printf("ERROR history GetOffsets key='%s' err='%v'", key, err)
+		return nil, err
+	}
+	return offsets, nil
+} // end func GetOffsets
+
+// offsetEncoding implements offsetCoder
+func (s *SQL) offsetEncoding() int {
+	return s.offsets
+} // end func offsetEncoding
+
+// setOffsetEncoding implements offsetCoder
+func (s *SQL) setOffsetEncoding(enc int) {
+	s.offsets = enc
+} // end func setOffsetEncoding
+
+// convertOffsets implements offsetCoder: converts all 4096 tables.
+// Tables with a LONGTEXT column get a LONGBLOB column.
+func (s *SQL) convertOffsets(enc int) (keys uint64, err error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReturnDB(db)
+	for _, char := range generateCombinations(HEXCHARS, 3, []string{}, []string{}) {
+		if enc == OffsetsVarint {
+			// tables created with LONGBLOB or altered by an interrupted run are skipped
+			var dataType string
+			if err := db.QueryRow("SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = 'o'", "s"+char).Scan(&dataType); err != nil {
+				log.Printf("ERROR history convertOffsets table=s%s DATA_TYPE err='%v'", char, err)
+				return keys, err
+			}
+			if !strings.EqualFold(dataType, "longblob") {
+				if _, err := db.Exec("ALTER TABLE `s" + char + "` MODIFY `o` LONGBLOB NULL"); err != nil {
+					log.Printf("ERROR history convertOffsets table=s%s ALTER err='%v'", char, err)
+					return keys, err
+				}
 			}
 		}
-		return offsets, nil
+		k, err := convertOffsetsTable(db, "s"+char, enc)
+		if err != nil {
+			log.Printf("ERROR history convertOffsets table=s%s err='%v'", char, err)
+			return keys, err
+		}
+		keys += k
 	}
-	return nil, nil
-} // end func GetOffsets
+	s.offsets = enc
+	return keys, nil
+} // end func convertOffsets
 
 func (s *SQL) NewConn() (*sql.DB, error) {
 	// [username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]
@@ -224,11 +290,11 @@ func (s *SQL) ShortHashDB_CreateTables() error {
 		for _, c2 := range cs {
 			for _, c3 := range cs {
 				// Create table s[0-f][0-f][0-f] with 7-char shortened hash key
-				query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `s%s%s%s` (`h` char(7) NOT NULL, `o` LONGTEXT NULL, PRIMARY KEY (`h`)) ENGINE=RocksDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", string(c1), string(c2), string(c3))
+				query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `s%s%s%s` (`h` char(7) NOT NULL, `o` LONGBLOB NULL, PRIMARY KEY (`h`)) ENGINE=RocksDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;", string(c1), string(c2), string(c3))
 				_, err := db.Exec(query)
 				if err != nil {
 					log.Printf("ERROR history CreateTables query='%s' err='%v'", query, err)
-					os.Exit(1)
+					return fmt.Errorf("ERROR ShortHashDB_CreateTables: %w: %w", ErrBackendUnavailable, err)
 				}
 			}
 		}
@@ -236,88 +302,201 @@ func (s *SQL) ShortHashDB_CreateTables() error {
 	return nil
 } // end func ShortHashDB_CreateTables
 
+// GetDB returns a free connection of any slot. wait=false returns nil if all are in use.
 func (s *SQL) GetDB(wait bool) (db *sql.DB, err error) {
-	if wait {
-		s.ctr.RLock()
-		if s.isOpen > 0 {
-			s.ctr.RUnlock()
-			dbconn := <-s.DBs
-			if dbconn.timeout > utils.UnixTimeSec() {
-				db = dbconn.db
-				return
-			}
-			// dbconn is timeout
-			if dbconn.db != nil {
-				err = dbconn.db.Ping()
-				if err != nil {
-					log.Printf("WARN history GetDB 'ping' failed err='%v'", err)
-					dbconn.db = nil
-				}
-			}
-			if dbconn.db != nil {
-				db = dbconn.db
-				return
-			}
-			db, err = s.NewConn()
-			if err != nil {
-				s.ctr.Lock()
-				s.isOpen--
-				s.ctr.Unlock()
-			}
+	first := int(s.next.Add(1))
+	for i := range s.slots {
+		if db, err = s.getSlotDB((first+i)%len(s.slots), false); db != nil || err != nil {
 			return
 		}
-		s.ctr.RUnlock()
-	} // end if wait
+	}
+	if !wait {
+		return nil, nil
+	}
+	return s.getSlotDB(first%len(s.slots), true)
+} // end func GetDB
 
-	select {
-	case dbconn := <-s.DBs:
-		db = dbconn.db
-		return
+// tableSlot returns the connection slot of table 0-4095: every slot serves a range of the tables.
+// A connection prepares the statements of its tables only.
+func (s *SQL) tableSlot(table int) int {
+	if table < 0 || table >= 4096 {
+		return 0
+	}
+	return table * len(s.slots) / 4096
+} // end func tableSlot
 
-	default:
-		s.ctr.Lock()
-		defer s.ctr.Unlock()
-		if s.isOpen < s.maxOpen {
-			db, err = s.NewConn()
-			if err != nil {
-				return
-			}
-			s.isOpen++
+// getTableDB waits for the connection of the slot of table.
+func (s *SQL) getTableDB(table int) (*sql.DB, error) {
+	return s.getSlotDB(s.tableSlot(table), true)
+} // end func getTableDB
+
+// getSlotDB returns the connection of slot and opens it if needed. wait=false returns nil if it is in use.
+func (s *SQL) getSlotDB(slot int, wait bool) (*sql.DB, error) {
+	var dbconn *DBconn
+	var ok bool
+	if wait {
+		dbconn, ok = <-s.slots[slot]
+	} else {
+		select {
+		case dbconn, ok = <-s.slots[slot]:
+		default:
+			return nil, nil
 		}
-	} // end select
-	return
-} // end func GetDB
+	}
+	if !ok {
+		return nil, fmt.Errorf("ERROR history GetDB: %w", ErrClosed)
+	}
+	if dbconn.db != nil && dbconn.timeout <= utils.UnixTimeSec() {
+		// dbconn is timeout
+		if err := dbconn.db.Ping(); err != nil {
+			log.Printf("WARN history GetDB 'ping' failed err='%v'", err)
+			s.forgetDB(dbconn.db)
+			dbconn.db = nil
+		}
+	}
+	if dbconn.db != nil {
+		return dbconn.db, nil
+	}
+	db, err := s.NewConn()
+	if err != nil {
+		s.slots[slot] <- &DBconn{}
+		return nil, err
+	}
+	s.ctr.Lock()
+	s.isOpen++
+	s.slotOf[db] = slot
+	s.ctr.Unlock()
+	return db, nil
+} // end func getSlotDB
+
+// forgetDB closes db and its statements.
+func (s *SQL) forgetDB(db *sql.DB) (slot int, ok bool) {
+	s.stmts.drop(db)
+	db.Close()
+	s.ctr.Lock()
+	if slot, ok = s.slotOf[db]; ok {
+		delete(s.slotOf, db)
+		s.isOpen--
+	}
+	s.ctr.Unlock()
+	return slot, ok
+} // end func forgetDB
 
 func (s *SQL) ReturnDB(db *sql.DB) {
-	s.DBs <- &DBconn{db: db, timeout: utils.UnixTimeSec() + s.timeout}
+	if db == nil {
+		return
+	}
+	s.ctr.RLock()
+	slot, ok := s.slotOf[db]
+	s.ctr.RUnlock()
+	if !ok {
+		return
+	}
+	s.slots[slot] <- &DBconn{db: db, timeout: utils.UnixTimeSec() + s.timeout}
 } // end func ReturnDB
 
 func (s *SQL) CloseDB(db *sql.DB) {
-	db.Close()
-	s.ctr.Lock()
-	s.isOpen--
-	s.ctr.Unlock()
+	if slot, ok := s.forgetDB(db); ok {
+		s.slots[slot] <- &DBconn{}
+	}
 } // end func CloseDB
 
+// ClosePool closes the connections. It waits until connections in use are returned.
 func (s *SQL) ClosePool() {
 	log.Printf("sql.ClosePool")
 	defer log.Printf("sql.ClosePool returned")
-	for {
-		dbconn := <-s.DBs
-		if dbconn.db != nil {
-			dbconn.db.Close()
+	s.stmts.dropAll()
+	for _, slot := range s.slots {
+		dbconn, ok := <-slot
+		if !ok {
+			continue // closed before
 		}
-		s.ctr.Lock()
-		s.isOpen--
-		isopen := s.isOpen
-		s.ctr.Unlock()
-		log.Printf("sql.ClosePool: open %d/%d", isopen, s.maxOpen)
-		if isopen == 0 {
-			return
+		if dbconn.db != nil {
+			s.forgetDB(dbconn.db)
 		}
-	} // end for
+		close(slot)
+	}
 } // end func ClosePool
 
+// Close implements HashDB
+func (s *SQL) Close() error {
+	s.ClosePool()
+	return nil
+} // end func Close
+
+// RemoveOffsets implements HashDBRemover: one transaction for all tables
+func (s *SQL) RemoveOffsets(batch []*OffsetData) (int, error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReturnDB(db)
+	removed, err := sqlRemoveOffsets(db, batch, s.offsets, func(key string) string { return "s" + key[:3] })
+	if err != nil {
+		log.Printf("ERROR history RemoveOffsets err='%v'", err)
+		return 0, err
+	}
+	return removed, nil
+} // end func RemoveOffsets
+
+// PruneOffsets implements HashDBPruner
+func (s *SQL) PruneOffsets(from int64) (keys int, offsets int, err error) {
+	return s.RemapOffsets(pruneBelow(from))
+} // end func PruneOffsets
+
+// RemapOffsets implements HashDBRemapper: scans all 4096 tables
+func (s *SQL) RemapOffsets(remap func(offset int64) (int64, bool)) (keys int, offsets int, err error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.ReturnDB(db)
+	for _, char := range generateCombinations(HEXCHARS, 3, []string{}, []string{}) {
+		k, o, err := remapOffsetsTable(db, "s"+char, s.offsets, remap)
+		if err != nil {
+			log.Printf("ERROR history RemapOffsets table=s%s err='%v'", char, err)
+			return keys, offsets, err
+		}
+		keys += k
+		offsets += o
+	}
+	return keys, offsets, nil
+} // end func RemapOffsets
+
+// Stats implements HashDB
+func (s *SQL) Stats() map[string]interface{} {
+	cache := s.StmtCacheStats()
+	s.ctr.RLock()
+	defer s.ctr.RUnlock()
+	return map[string]interface{}{
+		"backend":             "mysql",
+		"is_open":             s.isOpen,
+		"max_open":            s.maxOpen,
+		"stmt_cache":          cache,
+		"stmt_cache_hit_rate": cache.HitRate(),
+	}
+} // end func Stats
+
+// StmtCacheStats returns the counters of the prepared statement cache
+func (s *SQL) StmtCacheStats() StmtCacheStats {
+	return s.stmts.stats()
+} // end func StmtCacheStats
+
+// setStmtCacheSize sets the prepared statements per connection
+func (s *SQL) setStmtCacheSize(size int) {
+	s.stmts.setSize(size)
+} // end func setStmtCacheSize
+
+// mysqlQuery returns the SQL of statement kind of table for stmtCaches.
+func mysqlQuery(kind int, table string) string {
+	if kind == stmtSelect {
+		return "SELECT o FROM " + table + " WHERE h = ? LIMIT 1"
+	}
+	return "INSERT INTO " + table + " (h,o) VALUES (?,?) ON DUPLICATE KEY UPDATE o=CONCAT(o, ?)"
+} // end func mysqlQuery
+
+// SetMaxOpen sets the reported max_open.
+// Deprecated: the pool keeps one connection per slot of DBopts.maxopen, tableSlot depends on them.
 func (s *SQL) SetMaxOpen(maxopen int) {
 	if maxopen < 0 {
 		maxopen = 0
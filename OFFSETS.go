@@ -0,0 +1,147 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// offset encodings of the hashDB, stored in HashDBManifestFile
+const (
+	OffsetsKeep   = -1 // BootOptions.Offsets: the encoding of the existing hashDB, OffsetsVarint for a new one
+	OffsetsText   = 0  // decimal offsets, each followed by a comma
+	OffsetsVarint = 1  // offsetsV1 followed by the offsets as uvarint
+)
+
+// offsetsV1 is the first byte of a value in OffsetsVarint.
+// A value in OffsetsText starts with a digit: GetOffsets reads both.
+const offsetsV1 = 0x01
+
+// HashDBOffsets is the default of BootOptions.Offsets: OffsetsKeep, OffsetsText or OffsetsVarint.
+// OffsetsKeep leaves an existing hashDB in the encoding of its manifest.
+var HashDBOffsets = OffsetsKeep
+
+// offsetCoder is implemented by the SQL backends. They store offsets in encoding OffsetsText or OffsetsVarint.
+type offsetCoder interface {
+	offsetEncoding() int
+	setOffsetEncoding(enc int)
+	// convertOffsets rewrites all values in encoding enc and switches to it
+	convertOffsets(enc int) (keys uint64, err error)
+}
+
+// appendOffsets appends offsets in encoding enc to buf without the header of the value.
+func appendOffsets(buf []byte, enc int, offsets ...int64) []byte {
+	for _, offset := range offsets {
+		if enc == OffsetsVarint {
+			buf = binary.AppendUvarint(buf, uint64(offset))
+		} else {
+			buf = strconv.AppendInt(buf, offset, 10)
+			buf = append(buf, ',')
+		}
+	}
+	return buf
+} // end func appendOffsets
+
+// encodeOffsets returns the value of a new key with offsets in encoding enc.
+func encodeOffsets(enc int, offsets ...int64) []byte {
+	if enc == OffsetsVarint {
+		return appendOffsets([]byte{offsetsV1}, enc, offsets...)
+	}
+	return appendOffsets(nil, enc, offsets...)
+} // end func encodeOffsets
+
+// newOffsetsValue returns the value stored for a new key whose offsets in encoding enc are tail.
+func newOffsetsValue(enc int, tail []byte) []byte {
+	if enc == OffsetsVarint {
+		return append([]byte{offsetsV1}, tail...)
+	}
+	return tail
+} // end func newOffsetsValue
+
+// decodeOffsets appends the offsets of value to dst. value may be in any encoding.
+// Offsets <= 0 in OffsetsText are skipped like before.
+func decodeOffsets(dst []int64, value []byte) ([]int64, error) {
+	if len(value) == 0 {
+		return dst, nil
+	}
+	switch c := value[0]; {
+	case c == offsetsV1:
+		for i := 1; i < len(value); {
+			offset, n := binary.Uvarint(value[i:])
+			if n <= 0 {
+				return dst, fmt.Errorf("ERROR decodeOffsets bad varint at %d of %d bytes", i, len(value))
+			}
+			dst = append(dst, int64(offset))
+			i += n
+		}
+	case c >= '0' && c <= '9':
+		start := 0
+		for i, c := range value {
+			if c != ',' {
+				continue
+			}
+			if offset, err := strconv.ParseInt(string(value[start:i]), 10, 64); err == nil && offset > 0 {
+				dst = append(dst, offset)
+			}
+			start = i + 1
+		}
+	default:
+		return dst, fmt.Errorf("ERROR decodeOffsets unknown version 0x%02x", c)
+	}
+	return dst, nil
+} // end func decodeOffsets
+
+// countOffsets returns the number of offsets in value.
+func countOffsets(value []byte) (int, error) {
+	offsets, err := decodeOffsets(nil, value)
+	return len(offsets), err
+} // end func countOffsets
+
+// convertOffsetsTable rewrites all values of table which are not in encoding enc.
+// Works with SQLite3 and MySQL.
+func convertOffsetsTable(db *sql.DB, table string, enc int) (keys uint64, err error) {
+	rows, err := db.Query("SELECT h, o FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	update := make(map[string][]byte)
+	for rows.Next() {
+		var h string
+		var o []byte
+		if err := rows.Scan(&h, &o); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if len(o) == 0 || (o[0] == offsetsV1) == (enc == OffsetsVarint) {
+			continue // empty or converted already
+		}
+		offsets, err := decodeOffsets(nil, o)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("key='%s': %w", h, err)
+		}
+		update[h] = encodeOffsets(enc, offsets...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(update) == 0 {
+		return 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for h, value := range update {
+		if _, err := tx.Exec("UPDATE "+table+" SET o = ? WHERE h = ?", value, h); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return uint64(len(update)), nil
+} // end func convertOffsetsTable
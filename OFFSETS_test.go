@@ -0,0 +1,60 @@
+package history
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestOffsetsVarintRoundTrip(t *testing.T) {
+	for _, offsets := range [][]int64{
+		{0},
+		{1},
+		{127, 128},
+		{1, 300, 1 << 40},
+		{math.MaxInt64},
+	} {
+		value := encodeOffsets(OffsetsVarint, offsets...)
+		if value[0] != offsetsV1 {
+			t.Fatalf("encodeOffsets(%v) starts with 0x%02x", offsets, value[0])
+		}
+		got, err := decodeOffsets(nil, value)
+		if err != nil || !slices.Equal(got, offsets) {
+			t.Errorf("decodeOffsets(encodeOffsets(%v))=%v err='%v'", offsets, got, err)
+		}
+		// an insert appends to the stored value
+		value = append(value, appendOffsets(nil, OffsetsVarint, 42)...)
+		if got, _ := decodeOffsets(nil, value); !slices.Equal(got, append(slices.Clone(offsets), 42)) {
+			t.Errorf("decodeOffsets of %v appended 42=%v", offsets, got)
+		}
+	}
+}
+
+func TestDecodeOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []int64
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"text", "1,2,", []int64{1, 2}, false},
+		{"text written by encodeOffsets", string(encodeOffsets(OffsetsText, 7, 1<<40)), []int64{7, 1 << 40}, false},
+		{"legacy text skips <= 0", "0,5,-1,9,", []int64{5, 9}, false},
+		{"legacy text skips garbage", "3,x,4,", []int64{3, 4}, false},
+		{"legacy text without trailing comma", "3,4", []int64{3}, false},
+		{"unknown version", "\x02\x01", nil, true},
+		{"bad varint", "\x01\x80", nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeOffsets(nil, []byte(tc.value))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeOffsets(%q) err='%v' wantErr=%t", tc.value, err, tc.wantErr)
+			}
+			if !tc.wantErr && !slices.Equal(got, tc.want) {
+				t.Errorf("decodeOffsets(%q)=%v want %v", tc.value, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package history
+
+import (
+	"log"
+)
+
+// BootOptions configures one HISTORY instance.
+// Pass it to BootHistoryWithOptions.
+// NewBootOptions returns BootOptions filled from the package-level globals
+// which BootHistory used to read.
+type BootOptions struct {
+	HistoryDir string // path to folder: history/
+	KeyLen     int    // must be KeyLen
+
+	// hashDB backend
+	UseHashDB     bool   // false: uses L1 cache for lightweight duplicate detection
+	HashDB        HashDB // use this backend. nil: opens HashDBDriver
+	HashDBDriver  string // "mysql" or "sqlite3"
+	ShardMode     int    // SQLite3 shard mode: SHARD_SINGLE_DB ... SHARD_512_8
+	Offsets       int    // offset encoding: OffsetsKeep, OffsetsText or OffsetsVarint
+	AutoMigrate   bool   // migrate a hashDB of another shard mode or offset encoding. false: BootHistory refuses it
+	StmtCacheSize int    // prepared statements per hashDB connection. 0 disables the cache, StmtCacheAuto sizes it by the backend
+
+	// ReplayHisDat at boot
+	ForcedReplay   bool // replay history.dat from the first line, ignoring the checkpoint
+	NoReplayHisDat bool // don't replay at boot even if the hashDB is behind history.dat
+
+	// historyServer
+	BootHisCli       bool            // true: don't start a historyServer
+	ServerTCPAddr    string          // "" disables tcp listener
+	ServerSocketPath string          // "" disables unix socket listener
+	ACL              map[string]bool // allowed remote IPs for tcp listener
+
+	// cache settings
+	CacheExpires   int64 // seconds
+	CachePurge     int64 // seconds
+	EvictsCapacity int   // size of cache extend channels
+	ReserveTimeout int64 // seconds a hash stays reserved by Reserve
+
+	// limits
+	BatchFlushEvery   int64 // milliseconds
+	BatchFlushMax     int   // offsets per hashDB_Worker batch. <= 1 disables batching
+	IndexParallel     int   // number of hashDB_Index goroutines
+	NumQueueWriteChan int   // capacity of WriterChan
+	WriterWindow      int   // max HistoryObjects history_Writer processes at once
+	NumQueueIndexChan int   // capacity of IndexChan
+
+	// expiry
+	ExpireEvery      int64 // seconds between Expire runs. 0 disables the schedule
+	ExpireAfter      int64 // seconds after Arrival for lines without Expires. 0: never
+	Remember         int64 // seconds after Arrival an expired entry still rejects its hash
+	ExpireRemoveKeys bool  // remove expired entries older than Remember from the hashDB
+
+	// durability of history.dat
+	SyncMode  int   // SyncNone, SyncInterval, SyncLines or SyncAlways
+	SyncEvery int64 // milliseconds with SyncInterval, lines with SyncLines
+
+	// record format of a new history.dat: FormatText or FormatBinary
+	Format int
+
+	// segments of history.dat
+	SegmentSize  int64 // bytes per segment. 0: no rotation by size
+	SegmentEvery int64 // seconds per segment. 0: no rotation by time
+
+	// reading history.dat
+	MmapMax int64 // bytes of history.dat mapped into memory. 0 reads only with ReadAt
+
+	CPUProfile bool // writes cpu.pprof.out
+}
+
+// NewBootOptions returns BootOptions filled with the values of the package-level globals.
+func NewBootOptions(history_dir string, keylen int) *BootOptions {
+	return &BootOptions{
+		HistoryDir:        history_dir,
+		KeyLen:            keylen,
+		UseHashDB:         UseHashDB,
+		HashDBDriver:      HashDBDriver,
+		ShardMode:         HashDBShardMode,
+		Offsets:           HashDBOffsets,
+		AutoMigrate:       HashDBAutoMigrate,
+		StmtCacheSize:     HashDBStmtCache,
+		ForcedReplay:      ForcedReplay,
+		NoReplayHisDat:    NoReplayHisDat,
+		BootHisCli:        BootHisCli,
+		ServerTCPAddr:     DefaultServerTCPAddr,
+		ServerSocketPath:  DefaultSocketPath,
+		ACL:               DefaultACL,
+		CacheExpires:      L1CacheExpires,
+		CachePurge:        L1Purge,
+		EvictsCapacity:    DefaultEvictsCapacity,
+		ReserveTimeout:    DefaultReserveTimeout,
+		BatchFlushEvery:   BatchFlushEvery,
+		BatchFlushMax:     BatchFlushMax,
+		IndexParallel:     IndexParallel,
+		NumQueueWriteChan: NumQueueWriteChan,
+		WriterWindow:      WriterWindow,
+		NumQueueIndexChan: NumQueueIndexChan,
+		ExpireEvery:       DefaultExpireEvery,
+		ExpireAfter:       DefaultExpireAfter,
+		Remember:          DefaultRemember,
+		ExpireRemoveKeys:  ExpireRemoveKeys,
+		SyncMode:          HisDatSyncMode,
+		SyncEvery:         HisDatSyncEvery,
+		Format:            HisDatFormat,
+		SegmentSize:       HisDatSegmentSize,
+		SegmentEvery:      HisDatSegmentEvery,
+		MmapMax:           HisDatMmapMax,
+		CPUProfile:        CPUProfile,
+	}
+} // end func NewBootOptions
+
+// sanitize applies the lower and upper limits BootHistory used to enforce on the globals.
+func (o *BootOptions) sanitize() {
+	if o.HistoryDir == "" {
+		o.HistoryDir = "history"
+	}
+	if o.NumQueueWriteChan <= 0 {
+		o.NumQueueWriteChan = 1
+	}
+	if o.NumQueueIndexChan <= 0 {
+		o.NumQueueIndexChan = 1
+	}
+	if o.WriterWindow <= 0 {
+		o.WriterWindow = 1
+	}
+	if o.BatchFlushEvery <= 2500 { // milliseconds
+		o.BatchFlushEvery = 2500
+	}
+	if o.CachePurge <= 0 { // seconds
+		o.CachePurge = 1
+	}
+	if o.CacheExpires <= 0 { // seconds
+		o.CacheExpires = 1
+	}
+	if o.EvictsCapacity <= 0 {
+		o.EvictsCapacity = 1
+	}
+	if o.ReserveTimeout <= 0 { // seconds
+		o.ReserveTimeout = 1
+	}
+	// hashDB_Index receives a HistoryIndex struct and passes it down to hashDB_Worker['0-9a-f']
+	if o.IndexParallel <= 0 {
+		o.IndexParallel = 1
+	} else if o.IndexParallel > NumCacheDBs {
+		o.IndexParallel = NumCacheDBs
+	}
+	if o.ExpireEvery < 0 { // seconds
+		o.ExpireEvery = 0
+	}
+	if o.ExpireAfter < 0 { // seconds
+		o.ExpireAfter = 0
+	}
+	if o.Remember < 0 { // seconds
+		o.Remember = 0
+	}
+	switch o.SyncMode {
+	case SyncNone, SyncInterval, SyncLines, SyncAlways:
+		// pass
+	default:
+		log.Printf("WARN BootHistory unknown SyncMode=%d: using SyncNone", o.SyncMode)
+		o.SyncMode = SyncNone
+	}
+	if o.SyncEvery <= 0 {
+		o.SyncEvery = 1
+	}
+	switch o.Format {
+	case FormatText, FormatBinary:
+		// pass
+	default:
+		log.Printf("WARN BootHistory unknown Format=%d: using FormatText", o.Format)
+		o.Format = FormatText
+	}
+	if o.SegmentSize < 0 {
+		o.SegmentSize = 0
+	} else if o.SegmentSize > maxSegmentSize {
+		o.SegmentSize = maxSegmentSize
+	}
+	if o.SegmentEvery < 0 { // seconds
+		o.SegmentEvery = 0
+	}
+	if o.MmapMax < 0 {
+		o.MmapMax = 0
+	} else if o.MmapMax > maxMmap {
+		o.MmapMax = maxMmap
+	}
+	if o.StmtCacheSize < 0 {
+		o.StmtCacheSize = StmtCacheAuto
+	}
+	switch o.Offsets {
+	case OffsetsKeep, OffsetsText, OffsetsVarint:
+		// pass
+	default:
+		log.Printf("WARN BootHistory unknown Offsets=%d: keeps the offset encoding", o.Offsets)
+		o.Offsets = OffsetsKeep
+	}
+	if o.HashDBDriver == "" {
+		o.HashDBDriver = "mysql"
+	}
+} // end func sanitize
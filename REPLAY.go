@@ -0,0 +1,363 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ReplayBatchSize: ReplayHisDat commits N offsets per batch and writes its checkpoint after every batch.
+	ReplayBatchSize int = 16384
+)
+
+// ReplayCheckpointFile is stored in HistoryDir next to history.dat.
+// It holds the offset in history.dat up to which the hashDB is known to be complete.
+// Close writes it after a clean shutdown, ReplayHisDat after every batch.
+const ReplayCheckpointFile = "history.replay"
+
+// flagReplay asks a hashDB_Worker to insert the missing offsets of HistoryIndex.batch. See replayBatch.
+const flagReplay = -6
+
+// ReplayStats is returned by ReplayHisDat.
+type ReplayStats struct {
+	From     int64         // first offset replayed
+	To       int64         // end of the last complete line replayed
+	Lines    uint64        // history lines read
+	Inserted uint64        // offsets added to the hashDB
+	Skipped  uint64        // offsets already in the hashDB
+	BadLines uint64        // lines which are not a history line: ignored
+	Duration time.Duration // runtime
+}
+
+// ReplayHisDat rebuilds the hashDB from history.dat.
+// It streams all lines after the checkpoint to the end of history.dat
+// and inserts hash[:10] -> offset in batches of ReplayBatchSize.
+// Offsets already in the hashDB are skipped: a replay can be repeated or resumed at any time.
+// BootHistory runs it when the checkpoint is behind history.dat,
+// unless BootOptions.NoReplayHisDat is set.
+func (his *HISTORY) ReplayHisDat() (*ReplayStats, error) {
+	from, err := his.readReplayCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	return his.ReplayHisDatFrom(from)
+} // end func ReplayHisDat
+
+// ReplayHisDatFrom works like ReplayHisDat but starts at offset from.
+// from must be the start of a line. from <= 0 replays history.dat from the first line.
+func (his *HISTORY) ReplayHisDatFrom(from int64) (*ReplayStats, error) {
+	his.mux.Lock()
+	if his.hashDB == nil {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR ReplayHisDat hashDB=nil: %w", ErrBackendUnavailable)
+	}
+	if his.isClosed() {
+		his.mux.Unlock()
+		return nil, fmt.Errorf("ERROR ReplayHisDat: %w", ErrClosed)
+	}
+	// Close waits for us before it closes the hashDB
+	his.bgWG.Add(1)
+	his.mux.Unlock()
+	defer his.bgWG.Done()
+	return his.replayHisDat(from)
+} // end func ReplayHisDatFrom
+
+// replayAtBoot is called by checkHashDB before hashDB_Init starts the workers.
+// forced replays from the first line like ForcedReplay.
+func (his *HISTORY) replayAtBoot(forced bool) (*ReplayStats, error) {
+	from := int64(0)
+	if !his.opts.ForcedReplay && !forced {
+		checkpoint, err := his.readReplayCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint >= his.Offset {
+			logf(DEBUG2, "ReplayHisDat hashDB is up to date checkpoint=%d", checkpoint)
+			return nil, nil
+		}
+		from = checkpoint
+	}
+	if his.opts.NoReplayHisDat {
+		log.Printf("WARN ReplayHisDat disabled: hashDB may be behind history.dat from=%d size=%d", from, his.Offset)
+		// keep the checkpoint for the next boot
+		his.indexLost.Store(true)
+		return nil, nil
+	}
+	return his.replayHisDat(from)
+} // end func replayAtBoot
+
+func (his *HISTORY) replayHisDat(from int64) (*ReplayStats, error) {
+	if !LOCKfunc(his.lockReplay, "ReplayHisDat") {
+		return nil, fmt.Errorf("ERROR ReplayHisDat already running")
+	}
+	defer UNLOCKfunc(his.lockReplay, "ReplayHisDat")
+
+	segs, err := his.listSegments()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR ReplayHisDat listSegments: %w: %w", ErrHisDat, err)
+	}
+	fromSeg, local := splitOffset(from)
+	if fileInfo, err := os.Stat(his.segmentPath(fromSeg)); err == nil && local > fileInfo.Size() {
+		log.Printf("WARN ReplayHisDat checkpoint=%d > size=%d: replay all", from, fileInfo.Size())
+		from, fromSeg = 0, 0
+	}
+
+	start := time.Now()
+	stats := &ReplayStats{From: -1, To: from}
+	log.Printf("ReplayHisDat start hisDat='%s' from=%d", his.hisDat, from)
+	batch := make([]*OffsetData, 0, ReplayBatchSize)
+	now := time.Now().Unix()
+	for _, seg := range segs {
+		if seg < fromSeg {
+			continue
+		}
+		segFrom := segmentOffset(seg, 0)
+		if seg == fromSeg {
+			segFrom = from
+		}
+		if err := his.replaySegment(seg, segFrom, &batch, now, stats); err != nil {
+			return stats, err
+		}
+	}
+	if err := his.replayBatch(batch, stats.To, stats); err != nil {
+		return stats, err
+	}
+	if stats.From < 0 {
+		stats.From = from
+	}
+	stats.Duration = time.Since(start)
+	log.Printf("ReplayHisDat done from=%d to=%d lines=%d inserted=%d skipped=%d bad=%d took=(%d ms)",
+		stats.From, stats.To, stats.Lines, stats.Inserted, stats.Skipped, stats.BadLines, stats.Duration.Milliseconds())
+	return stats, nil
+} // end func replayHisDat
+
+// replaySegment streams the lines of segment seg from offset from into batch.
+func (his *HISTORY) replaySegment(seg int, from int64, batch *[]*OffsetData, now int64, stats *ReplayStats) error {
+	file, err := os.OpenFile(his.segmentPath(seg), os.O_RDONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("ERROR ReplayHisDat: %w: %w", ErrHisDat, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	// skip the header
+	header, err := reader.ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("ERROR ReplayHisDat reading header of segment %d err='%v': %w", seg, err, ErrBadHeader)
+	}
+	_, local := splitOffset(from)
+	if first := int64(len(header)); local < first {
+		local = first
+	}
+	if _, err := file.Seek(local, io.SeekStart); err != nil {
+		return fmt.Errorf("ERROR ReplayHisDat Seek from=%d: %w: %w", from, ErrHisDat, err)
+	}
+	reader.Reset(file)
+	offset := segmentOffset(seg, local)
+	if stats.From < 0 {
+		stats.From = offset
+	}
+	stats.To = offset
+	rs := newRecordScanner(reader, his.settings.Fv)
+	for {
+		rec, n, err := rs.next()
+		if err == errBadRecord {
+			stats.BadLines++
+			log.Printf("ERROR ReplayHisDat overlong line ends at offset=%d", offset+n)
+			offset += n
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				his.indexLost.Store(true)
+				return fmt.Errorf("ERROR ReplayHisDat read offset=%d: %w: %w", offset, ErrHisDat, err)
+			}
+			if n > 0 {
+				// partial record at the end: history_Writer did not flush it yet
+				logf(DEBUG2, "ReplayHisDat ignores partial record offset=%d len=%d", offset, n)
+			}
+			break
+		}
+		hash, ok := recordHash(rec, his.settings.Fv)
+		if !ok {
+			stats.BadLines++
+			log.Printf("ERROR ReplayHisDat bad record offset=%d record='%s'", offset, strings.TrimSpace(string(rec)))
+		} else if his.opts.ExpireRemoveKeys && his.isForgottenRecord(rec, now) {
+			// Expire removed it from the hashDB
+			stats.Lines++
+			stats.Skipped++
+		} else {
+			stats.Lines++
+			*batch = append(*batch, &OffsetData{Shorthash: hash[:10], Offset: offset})
+		}
+		offset += n
+		if len(*batch) >= ReplayBatchSize {
+			if err := his.replayBatch(*batch, offset, stats); err != nil {
+				return err
+			}
+			*batch = (*batch)[:0]
+			logf(BootVerbose, "ReplayHisDat offset=%d lines=%d inserted=%d skipped=%d", offset, stats.Lines, stats.Inserted, stats.Skipped)
+		}
+	}
+	stats.To = offset
+	return nil
+} // end func replaySegment
+
+// replayBatch inserts all offsets of batch which are not in the hashDB yet
+// and moves the checkpoint to end.
+// On a booted history the hashDB_Workers own the keys: the batch goes through them, see replayOffsets.
+func (his *HISTORY) replayBatch(batch []*OffsetData, end int64, stats *ReplayStats) error {
+	if his.isClosed() {
+		his.indexLost.Store(true)
+		return fmt.Errorf("ERROR ReplayHisDat stopped at offset=%d: %w", stats.To, ErrClosed)
+	}
+	if his.IndexChan != nil {
+		inserted, err := his.batchViaWorkers(flagReplay, batch, "ReplayHisDat")
+		if err != nil {
+			his.indexLost.Store(true)
+			return err
+		}
+		stats.Inserted += uint64(inserted)
+		stats.Skipped += uint64(len(batch) - inserted)
+		stats.To = end
+		return his.writeReplayCheckpoint(end)
+	}
+	missing, err := his.replayMissing(batch)
+	if err != nil {
+		his.indexLost.Store(true)
+		return err
+	}
+	stats.Skipped += uint64(len(batch) - len(missing))
+	if len(missing) > 0 {
+		if batcher, ok := his.hashDB.(HashDBBatcher); ok {
+			err = batcher.InsertOffsets(missing)
+		} else {
+			for _, od := range missing {
+				if err = his.hashDB.InsertOffset(od.Shorthash, od.Offset); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			his.indexLost.Store(true)
+			return fmt.Errorf("ERROR ReplayHisDat insert offset=%d err='%v': %w", stats.To, err, ErrBackendUnavailable)
+		}
+		stats.Inserted += uint64(len(missing))
+	}
+	stats.To = end
+	return his.writeReplayCheckpoint(end)
+} // end func replayBatch
+
+// replayMissing returns the offsets of batch which are not in the hashDB.
+func (his *HISTORY) replayMissing(batch []*OffsetData) ([]*OffsetData, error) {
+	known := make(map[string]map[int64]struct{}, len(batch))
+	missing := make([]*OffsetData, 0, len(batch))
+	for _, od := range batch {
+		have, exists := known[od.Shorthash]
+		if !exists {
+			offsets, err := his.hashDB.GetOffsets(od.Shorthash)
+			if err != nil {
+				return nil, fmt.Errorf("ERROR ReplayHisDat GetOffsets key='%s' err='%v': %w", od.Shorthash, err, ErrBackendUnavailable)
+			}
+			have = make(map[int64]struct{}, len(offsets))
+			for _, offset := range offsets {
+				have[offset] = struct{}{}
+			}
+			known[od.Shorthash] = have
+		}
+		if _, exists := have[od.Offset]; exists {
+			continue
+		}
+		// a line listed twice in batch is inserted once
+		have[od.Offset] = struct{}{}
+		missing = append(missing, od)
+	}
+	return missing, nil
+} // end func replayMissing
+
+// replayOffsets runs in the hashDB_Worker which owns bq: it commits bq first,
+// so offsets queued by the writer are seen and not inserted twice.
+// Returns CaseAdded and sets hi.found to the number of inserted offsets.
+func (his *HISTORY) replayOffsets(bq *batchQueue, hi *HistoryIndex) int {
+	if his.remap.Load() != nil {
+		return CaseRetry
+	}
+	if err := bq.flush(his); err != nil {
+		return CaseError
+	}
+	missing, err := his.replayMissing(hi.batch)
+	if err != nil {
+		log.Printf("ERROR hashDB_Worker [%s] %v", bq.char, err)
+		return CaseError
+	}
+	for _, od := range missing {
+		bq.add(od.Shorthash, od.Offset)
+	}
+	if err := bq.flush(his); err != nil {
+		return CaseError
+	}
+	hi.found = int64(len(missing))
+	return CaseAdded
+} // end func replayOffsets
+
+// parseHistoryLineHash returns the hash of a history line: {sha256}\t...
+func parseHistoryLineHash(line []byte) (string, bool) {
+	if len(line) < 67 || line[0] != '{' || line[65] != '}' || line[66] != '\t' {
+		return "", false
+	}
+	for _, c := range line[1:65] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", false
+		}
+	}
+	return string(line[1:65]), true
+} // end func parseHistoryLineHash
+
+// readReplayCheckpoint returns the offset stored in ReplayCheckpointFile or 0 if there is none.
+func (his *HISTORY) readReplayCheckpoint() (int64, error) {
+	data, err := os.ReadFile(his.DIR + "/" + ReplayCheckpointFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("ERROR readReplayCheckpoint: %w", err)
+	}
+	checkpoint, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	if err != nil || checkpoint < 0 {
+		log.Printf("WARN readReplayCheckpoint bad data='%s': replay all", bytes.TrimSpace(data))
+		return 0, nil
+	}
+	return checkpoint, nil
+} // end func readReplayCheckpoint
+
+// writeReplayCheckpoint stores offset in ReplayCheckpointFile.
+func (his *HISTORY) writeReplayCheckpoint(offset int64) error {
+	fp := his.DIR + "/" + ReplayCheckpointFile
+	tmp := fp + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("ERROR writeReplayCheckpoint: %w", err)
+	}
+	if _, err := fmt.Fprintf(fh, "%d\n", offset); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR writeReplayCheckpoint: %w", err)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR writeReplayCheckpoint Sync: %w", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("ERROR writeReplayCheckpoint Close: %w", err)
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		return fmt.Errorf("ERROR writeReplayCheckpoint Rename: %w", err)
+	}
+	return nil
+} // end func writeReplayCheckpoint
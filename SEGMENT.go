@@ -0,0 +1,167 @@
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// HisDatSegmentSize starts a new segment of history.dat after N bytes. 0: no rotation by size
+	HisDatSegmentSize int64 = 0
+	// HisDatSegmentEvery starts a new segment of history.dat after N seconds. 0: no rotation by time
+	HisDatSegmentEvery int64 = 0
+)
+
+// Segments of history.dat: history.dat is segment 0, then history.dat.0001, history.dat.0002 ...
+// An offset holds the segment in the upper bits and the position in the segment in the lower 40 bits.
+// Offsets in history.dat do not change: a history without segments works like before.
+const (
+	segmentShift     = 40
+	segmentLocalMask = 1<<segmentShift - 1
+	// maxSegmentSize is the upper limit of BootOptions.SegmentSize: the position must fit into 40 bits
+	maxSegmentSize = segmentLocalMask - 1024*1024*1024
+)
+
+// segmentOffset returns the offset of position local in segment seg.
+func segmentOffset(seg int, local int64) int64 {
+	return int64(seg)<<segmentShift | local
+} // end func segmentOffset
+
+// splitOffset returns segment and position of offset.
+func splitOffset(offset int64) (seg int, local int64) {
+	return int(offset >> segmentShift), offset & segmentLocalMask
+} // end func splitOffset
+
+// segmentPath returns the path of segment seg.
+func (his *HISTORY) segmentPath(seg int) string {
+	if seg == 0 {
+		return his.hisDat
+	}
+	return fmt.Sprintf("%s.%04d", his.hisDat, seg)
+} // end func segmentPath
+
+// listSegments returns the sorted numbers of all segments in HistoryDir.
+// Segment 0 is history.dat and listed if it exists.
+func (his *HISTORY) listSegments() ([]int, error) {
+	matches, err := filepath.Glob(his.hisDat + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	if _, err := os.Stat(his.hisDat); err == nil {
+		segs = append(segs, 0)
+	}
+	for _, path := range matches {
+		seg, err := strconv.Atoi(strings.TrimPrefix(path, his.hisDat+"."))
+		if err != nil || seg <= 0 {
+			continue // history.dat.compact, history.dat.0002.tmp ...
+		}
+		segs = append(segs, seg)
+	}
+	sort.Ints(segs)
+	return segs, nil
+} // end func listSegments
+
+// readSegmentHeader returns the settings and the header length incl. LF of the file at path.
+func readSegmentHeader(path string) (*HistorySettings, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrHisDat, err)
+	}
+	defer file.Close()
+	header, err := bufio.NewReaderSize(file, ZEROPADLEN+1).ReadSlice('\n')
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading header of '%s' err='%v': %w", path, err, ErrBadHeader)
+	}
+	settings := &HistorySettings{}
+	if err := gobDecodeHeader(header[:len(header)-1], settings); err != nil {
+		return nil, 0, fmt.Errorf("%v: %w", err, ErrBadHeader)
+	}
+	return settings, int64(len(header)), nil
+} // end func readSegmentHeader
+
+// rotateDue returns true if history_Writer has to start a new segment before the next window.
+func (his *HISTORY) rotateDue(hw *historyWindow) bool {
+	_, local := splitOffset(his.Offset)
+	if local <= hw.segHeader {
+		return false // nothing written to this segment yet
+	}
+	if his.opts.SegmentSize > 0 && local >= his.opts.SegmentSize {
+		return true
+	}
+	return his.opts.SegmentEvery > 0 && time.Now().Unix()-hw.segCreated >= his.opts.SegmentEvery
+} // end func rotateDue
+
+// rotateSegment closes the current segment and continues in a new one.
+// The new segment gets its header before it appears under its name: a crash leaves no segment without header.
+func (his *HISTORY) rotateSegment(hw *historyWindow) error {
+	if err := hw.dw.Flush(); err != nil {
+		return fmt.Errorf("ERROR rotateSegment Flush: %w: %w", ErrHisDat, err)
+	}
+	// the old segment is complete and durable before the first line goes to the new one
+	if err := his.syncHisDat(hw); err != nil {
+		return err
+	}
+	seg, _ := splitOffset(his.Offset)
+	seg++
+	path := his.segmentPath(seg)
+	now := time.Now().Unix()
+	settings := his.settings
+	settings.Sg, settings.Ct = seg, now
+	var headerdata []byte
+	if _, err := gobEncodeHeader(&headerdata, &settings); err != nil {
+		return fmt.Errorf("ERROR rotateSegment gobEncodeHeader: %w", err)
+	}
+	tmp := path + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("ERROR rotateSegment: %w: %w", ErrHisDat, err)
+	}
+	var headerLen int64
+	if err := writeHistoryHeader(bufio.NewWriterSize(fh, ZEROPADLEN+1), headerdata, &headerLen, true); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR rotateSegment writeHistoryHeader: %w: %w", ErrHisDat, err)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR rotateSegment Sync: %w: %w", ErrHisDat, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		fh.Close()
+		return fmt.Errorf("ERROR rotateSegment Rename: %w: %w", ErrHisDat, err)
+	}
+	syncDir(his.DIR)
+	if err := hw.fh.Close(); err != nil {
+		log.Printf("ERROR rotateSegment closing segment %d err='%v'", seg-1, err)
+	}
+	hw.fh = fh
+	hw.dw.Reset(fh)
+	hw.segHeader, hw.segCreated = headerLen, now
+	his.Offset = segmentOffset(seg, headerLen)
+	his.segment.Store(int32(seg))
+	log.Printf("history_Writer rotated to segment %d fp='%s'", seg, path)
+	return nil
+} // end func rotateSegment
+
+// dropSegment removes segment seg after Expire forgot all its lines.
+// history.dat holds the settings: segment 0 is cut back to its header.
+func (his *HISTORY) dropSegment(seg int) error {
+	if his.reader != nil {
+		his.reader.drop(seg)
+	}
+	if seg == 0 {
+		_, headerLen, err := readSegmentHeader(his.hisDat)
+		if err != nil {
+			return err
+		}
+		return os.Truncate(his.hisDat, headerLen)
+	}
+	return os.Remove(his.segmentPath(seg))
+} // end func dropSegment
@@ -21,73 +21,134 @@ const (
 )
 
 var (
-	ACL        AccessControlList
 	DefaultACL map[string]bool // can be set before booting
 )
 
-func (his *HISTORY) startServer(tcpListen string, socketPath string) {
-	if BootHisCli {
-		return
+// startServer opens the listeners and returns an error if one fails.
+// Accepting connections runs in background.
+func (his *HISTORY) startServer(tcpListen string, socketPath string) error {
+	if his.opts.BootHisCli {
+		return nil
 	}
 	//if his.useHashDB {
 	//	his.Wait4HashDB()
 	//}
 	// socket listener
-	go func() {
-		if socketPath == "" {
-			return
-		}
+	if socketPath != "" {
 		os.Remove(socketPath)
 		listener, err := net.Listen("unix", socketPath)
 		if err != nil {
-			log.Printf("ERROR HistoryServer  creating socket err='%v'", err)
-			os.Exit(1)
+			return fmt.Errorf("ERROR HistoryServer creating socket: %w: %w", ErrListen, err)
 		}
+		his.listeners = append(his.listeners, listener)
 		log.Printf("HistoryServer UnixSocket: %s", socketPath)
-		defer listener.Close()
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("ERROR HistoryServer accepting socket err='%v'", err)
-				return
+		his.bgWG.Add(1)
+		go func() {
+			defer his.bgWG.Done()
+			defer listener.Close()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if his.isClosed() {
+						return
+					}
+					log.Printf("ERROR HistoryServer accepting socket err='%v'", err)
+					return
+				}
+				if !his.trackConn(conn) {
+					return
+				}
+				go his.handleSocketConn(conn, "", true)
 			}
-			go his.handleSocketConn(conn, "", true)
-		}
-	}()
+		}()
+	}
 
 	// tcp listener
-	go func() {
-		if tcpListen == "" {
-			return
-		}
-		ACL.SetupACL()
+	if tcpListen != "" {
+		his.acl.SetupACL(his.opts.ACL)
 		listener, err := net.Listen("tcp", tcpListen)
 		if err != nil {
-			log.Printf("ERROR HistoryServer creating tcpListen err='%v'", err)
-			os.Exit(1)
+			his.closeListeners()
+			return fmt.Errorf("ERROR HistoryServer creating tcpListen: %w: %w", ErrListen, err)
 		}
+		his.listeners = append(his.listeners, listener)
 		log.Printf("HistoryServer ListenTCP: %s", tcpListen)
-		defer listener.Close()
-		for {
-			conn, err := listener.Accept()
-			raddr := getRemoteIP(conn)
-			if err != nil {
-				log.Printf("ERROR HistoryServer  accepting tcp err='%v'", err)
-				return
-			}
-			if !checkACL(conn) {
-				log.Printf("HistoryServer !ACL: '%s'", raddr)
-				conn.Close()
-				continue
+		his.bgWG.Add(1)
+		go func() {
+			defer his.bgWG.Done()
+			defer listener.Close()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if his.isClosed() {
+						return
+					}
+					log.Printf("ERROR HistoryServer  accepting tcp err='%v'", err)
+					return
+				}
+				raddr := getRemoteIP(conn)
+				if !his.checkACL(conn) {
+					log.Printf("HistoryServer !ACL: '%s'", raddr)
+					conn.Close()
+					continue
+				}
+				log.Printf("HistoryServer newC: '%s'", raddr)
+				if !his.trackConn(conn) {
+					return
+				}
+				go his.handleSocketConn(conn, raddr, false)
 			}
-			log.Printf("HistoryServer newC: '%s'", raddr)
-			go his.handleSocketConn(conn, raddr, false)
-		}
-	}()
+		}()
+	}
+	return nil
 } // end func startServer
 
+// closeListeners closes all listeners opened by startServer
+func (his *HISTORY) closeListeners() {
+	for _, listener := range his.listeners {
+		listener.Close()
+	}
+	his.listeners = nil
+} // end func closeListeners
+
+// trackConn registers conn so Close can close it.
+// Returns false and closes conn if the history is closing.
+func (his *HISTORY) trackConn(conn net.Conn) bool {
+	his.connMux.Lock()
+	defer his.connMux.Unlock()
+	if his.isClosed() {
+		conn.Close()
+		return false
+	}
+	if his.conns == nil {
+		his.conns = make(map[net.Conn]struct{})
+	}
+	his.conns[conn] = struct{}{}
+	his.bgWG.Add(1)
+	return true
+} // end func trackConn
+
+// untrackConn closes conn and removes it from the tracked connections.
+func (his *HISTORY) untrackConn(conn net.Conn) {
+	conn.Close()
+	his.connMux.Lock()
+	delete(his.conns, conn)
+	his.connMux.Unlock()
+	his.bgWG.Done()
+} // end func untrackConn
+
+// closeConns closes all historyServer connections.
+// handleSocketConn returns on the next read.
+func (his *HISTORY) closeConns() {
+	his.connMux.Lock()
+	for conn := range his.conns {
+		conn.Close()
+	}
+	his.connMux.Unlock()
+} // end func closeConns
+
 func (his *HISTORY) handleSocketConn(conn net.Conn, raddr string, socket bool) {
-	defer conn.Close()
+	defer his.untrackConn(conn)
 	tp := textproto.NewConn(conn)
 	if !socket {
 		// send welcome banner to incoming tcp connection
@@ -134,7 +195,8 @@ forever:
 			}
 			his.mux.Unlock()
 		case "STOP":
-			his.CLOSE_HISTORY()
+			// Close waits for this connection to return
+			go his.CLOSE_HISTORY()
 			tp.PrintfLine("502 CLOSE_HISTORY")
 			break forever
 		case "QUIT":
@@ -241,26 +303,38 @@ func getRemoteIP(conn net.Conn) string {
 	return "x"
 }
 
-func checkACL(conn net.Conn) bool {
-	return ACL.IsAllowed(getRemoteIP(conn))
+func (his *HISTORY) checkACL(conn net.Conn) bool {
+	return his.acl.IsAllowed(getRemoteIP(conn))
+}
+
+// SetACL allows (val=true) or removes (val=false) a remote IP for the tcp listener of this history
+func (his *HISTORY) SetACL(ip string, val bool) {
+	his.acl.SetACL(ip, val)
 }
 
 type AccessControlList struct {
-	mux sync.RWMutex
-	acl map[string]bool
+	mux   sync.RWMutex
+	acl   map[string]bool
+	setup bool // SetupACL ran
 }
 
-func (a *AccessControlList) SetupACL() {
+// SetupACL copies defaultACL: the ACL of every history changes on its own.
+// Entries set by SetACL before win over defaultACL.
+func (a *AccessControlList) SetupACL(defaultACL map[string]bool) {
 	a.mux.Lock()
 	defer a.mux.Unlock()
-	if a.acl != nil {
+	if a.setup {
 		return
 	}
-	if DefaultACL != nil {
-		a.acl = DefaultACL
-		return
+	a.setup = true
+	if a.acl == nil {
+		a.acl = make(map[string]bool, len(defaultACL))
+	}
+	for ip, val := range defaultACL {
+		if _, exists := a.acl[ip]; !exists {
+			a.acl[ip] = val
+		}
 	}
-	a.acl = make(map[string]bool)
 }
 
 func (a *AccessControlList) IsAllowed(ip string) bool {
@@ -273,9 +347,13 @@ func (a *AccessControlList) IsAllowed(ip string) bool {
 func (a *AccessControlList) SetACL(ip string, val bool) {
 	a.mux.Lock()
 	defer a.mux.Unlock()
-	if !val { // unset
+	if a.acl == nil {
+		a.acl = make(map[string]bool)
+	}
+	if !val && a.setup { // unset
 		delete(a.acl, ip)
 		return
 	}
+	// before SetupACL a removal is kept as false: the default does not add ip again
 	a.acl[ip] = val
 }
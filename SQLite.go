@@ -4,8 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-while/go-utils"
@@ -14,13 +14,20 @@ import (
 
 type SQLite3DB struct {
 	mux     sync.RWMutex
-	ctr     sync.RWMutex // counter
-	DBs     chan *SQLite3Conn
+	ctr     sync.RWMutex        // counter
+	slots   []chan *SQLite3Conn // free connection of every slot, db=nil until it is opened
+	slotOf  map[*sql.DB]int     // slot of every open connection. held by ctr
+	next    atomic.Uint32       // first slot GetDB tries
+	tables  int                 // tables of the database: tableSlot spreads them over the slots
 	dsn     string
 	maxOpen int
 	isOpen  int
 	timeout int64
 	dbPath  string
+	closed  bool          // set by Close
+	stopOpt chan struct{} // stops StartOptimizer
+	offsets int           // offset encoding: OffsetsText or OffsetsVarint
+	stmts   *stmtCaches   // prepared statements per connection
 }
 
 type SQLite3Conn struct {
@@ -29,11 +36,21 @@ type SQLite3Conn struct {
 }
 
 type SQLite3Opts struct {
-	dbPath   string
-	params   string
-	maxOpen  int
-	initOpen int
-	timeout  int64
+	dbPath    string
+	params    string
+	maxOpen   int
+	initOpen  int
+	timeout   int64
+	stmtCache int // prepared statements per connection. 0 disables the cache, StmtCacheAuto: stmtCacheAuto
+	tables    int // tables of the database. 0: 4096
+}
+
+// sqliteQuery returns the SQL of a cached statement of table.
+func sqliteQuery(kind int, table string) string {
+	if kind == stmtUpsert {
+		return "INSERT INTO " + table + " (h, o) VALUES (?, ?) ON CONFLICT(h) DO UPDATE SET o = CAST(COALESCE(o, X'') || ? AS BLOB)"
+	}
+	return "SELECT o FROM " + table + " WHERE h = ? LIMIT 1"
 }
 
 func NewSQLite3Pool(opts *SQLite3Opts, createTables bool) (*SQLite3DB, error) {
@@ -43,14 +60,22 @@ func NewSQLite3Pool(opts *SQLite3Opts, createTables bool) (*SQLite3DB, error) {
 	if createTables && opts.initOpen <= 0 {
 		opts.initOpen = 1
 	}
+	if opts.tables <= 0 {
+		opts.tables = 4096
+	}
 
-	s := &SQLite3DB{dbPath: opts.dbPath}
+	s := &SQLite3DB{dbPath: opts.dbPath, tables: opts.tables, stmts: newStmtCaches(opts.stmtCache, stmtCacheAuto(opts.tables, opts.maxOpen), sqliteQuery)}
 	if opts.timeout < 5 {
 		opts.timeout = 5
 	}
 	s.timeout = opts.timeout
 	s.maxOpen = opts.maxOpen
-	s.DBs = make(chan *SQLite3Conn, s.maxOpen)
+	s.slots = make([]chan *SQLite3Conn, s.maxOpen)
+	for i := range s.slots {
+		s.slots[i] = make(chan *SQLite3Conn, 1)
+		s.slots[i] <- &SQLite3Conn{}
+	}
+	s.slotOf = make(map[*sql.DB]int, s.maxOpen)
 
 	// Build DSN with optimizations
 	if opts.params == "" {
@@ -59,12 +84,11 @@ func NewSQLite3Pool(opts *SQLite3Opts, createTables bool) (*SQLite3DB, error) {
 	s.dsn = opts.dbPath + opts.params
 
 	// Initialize connection pool
-	for i := 0; i < opts.initOpen; i++ {
-		db, err := s.GetDB(false)
+	for i := 0; i < min(opts.initOpen, s.maxOpen); i++ {
+		db, err := s.getSlotDB(i, true) // counts isOpen
 		if err != nil {
 			return nil, err
 		}
-		s.isOpen++
 		s.ReturnDB(db)
 	}
 
@@ -127,7 +151,7 @@ func (s *SQLite3DB) CreateTables() error {
 				query := fmt.Sprintf(`
 					CREATE TABLE IF NOT EXISTS %s (
 						h CHAR(7) NOT NULL PRIMARY KEY,
-						o TEXT
+						o BLOB
 					) WITHOUT ROWID;
 				`, tableName)
 
@@ -151,27 +175,19 @@ func (s *SQLite3DB) CreateTables() error {
 	return nil
 }
 
-func (s *SQLite3DB) InsertOffset(key string, offset int64, db *sql.DB) error {
-	if db == nil {
-		adb, err := s.GetDB(true)
-		if err != nil {
-			return err
-		}
-		db = adb
-		defer s.ReturnDB(db)
+func (s *SQLite3DB) InsertOffset(key string, offset int64) error {
+	db, err := s.getTableDB(keyTable(key))
+	if err != nil {
+		return err
 	}
+	defer s.ReturnDB(db)
 
-	tableName := fmt.Sprintf("s%s", key[:3])
+	tableName := "s" + key[:3]
 	hashKey := key[3:]
 
-	// Use UPSERT (INSERT OR REPLACE) with concatenation
-	query := fmt.Sprintf(`
-		INSERT INTO %s (h, o) VALUES (?, ?)
-		ON CONFLICT(h) DO UPDATE SET o = COALESCE(o, '') || ?
-	`, tableName)
-
-	offsetStr := fmt.Sprintf("%d,", offset)
-	_, err := db.Exec(query, hashKey, offsetStr, offsetStr)
+	// UPSERT appends to the offsets of an existing key
+	tail := appendOffsets(nil, s.offsets, offset)
+	_, err = s.stmts.exec(db, stmtUpsert, tableName, hashKey, newOffsetsValue(s.offsets, tail), tail)
 	if err != nil {
 		log.Printf("ERROR SQLite3 InsertOffset table=%s key=%s offset=%d err='%v'", tableName, hashKey, offset, err)
 		return err
@@ -179,22 +195,87 @@ func (s *SQLite3DB) InsertOffset(key string, offset int64, db *sql.DB) error {
 	return nil
 }
 
-func (s *SQLite3DB) GetOffsets(key string, db *sql.DB) ([]int64, error) {
-	if db == nil {
-		adb, err := s.GetDB(true)
+// InsertOffsets implements HashDBBatcher: one transaction per connection slot of the tables
+func (s *SQLite3DB) InsertOffsets(batch []*OffsetData) error {
+	keys, values := groupOffsets(batch, s.offsets)
+	if len(keys) == 0 {
+		return nil
+	}
+	slotKeys, order := s.slotKeys(keys, keyTable)
+	for _, slot := range order {
+		db, err := s.getSlotDB(slot, true)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		db = adb
-		defer s.ReturnDB(db)
+		err = sqliteInsertOffsetsTx(db, s.stmts, slotKeys[slot], values, s.offsets, func(key string) string { return "s" + key[:3] })
+		s.ReturnDB(db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyTable returns the table index of key in the 4096 tables of a database: its hex prefix.
+func keyTable(key string) int {
+	if len(key) < 3 {
+		return 0
+	}
+	table, err := hexToInt(key[:3])
+	if err != nil || table < 0 {
+		return 0 // the statement fails on the table name
 	}
+	return table
+}
 
-	tableName := fmt.Sprintf("s%s", key[:3])
+// slotKeys groups keys by the connection slot of their table. table returns the table index of a key.
+func (s *SQLite3DB) slotKeys(keys []string, table func(key string) int) (slotKeys map[int][]string, order []int) {
+	slotKeys = make(map[int][]string)
+	for _, key := range keys {
+		slot := s.tableSlot(table(key))
+		if _, exists := slotKeys[slot]; !exists {
+			order = append(order, slot)
+		}
+		slotKeys[slot] = append(slotKeys[slot], key)
+	}
+	return slotKeys, order
+}
+
+// sqliteInsertOffsetsTx appends values of keys in encoding enc in one transaction.
+// table returns the table name of a key. stmts holds the statements of db.
+func sqliteInsertOffsetsTx(db *sql.DB, stmts *stmtCaches, keys []string, values map[string][]byte, enc int, table func(key string) string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR SQLite3 InsertOffsets Begin err='%v'", err)
+		return err
+	}
+	for _, key := range keys {
+		tableName := table(key)
+		if _, err := stmts.txExec(tx, db, stmtUpsert, tableName, key[3:], newOffsetsValue(enc, values[key]), values[key]); err != nil {
+			tx.Rollback()
+			log.Printf("ERROR SQLite3 InsertOffsets table=%s key=%s err='%v'", tableName, key[3:], err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR SQLite3 InsertOffsets Commit err='%v'", err)
+		return err
+	}
+	return nil
+}
+
+func (s *SQLite3DB) GetOffsets(key string) ([]int64, error) {
+	db, err := s.getTableDB(keyTable(key))
+	if err != nil {
+		return nil, err
+	}
+	defer s.ReturnDB(db)
+
+	tableName := "s" + key[:3]
 	hashKey := key[3:]
 
-	var offsetsStr string
-	query := fmt.Sprintf("SELECT o FROM %s WHERE h = ? LIMIT 1", tableName)
-	err := db.QueryRow(query, hashKey).Scan(&offsetsStr)
+	var value []byte
+	err = s.stmts.queryRow(db, stmtSelect, tableName, hashKey).Scan(&value)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -202,98 +283,246 @@ func (s *SQLite3DB) GetOffsets(key string, db *sql.DB) ([]int64, error) {
 		log.Printf("ERROR SQLite3 GetOffsets table=%s key=%s err='%v'", tableName, hashKey, err)
 		return nil, err
 	}
+	offsets, err := decodeOffsets(nil, value)
+	if err != nil {
+		log.Printf("ERROR SQLite3 GetOffsets table=%s key=%s err='%v'", tableName, hashKey, err)
+		return nil, err
+	}
+	return offsets, nil
+}
 
-	var offsets []int64
-	if len(offsetsStr) > 0 {
-		offs := strings.Split(offsetsStr, ",")
-		for _, offsetStr := range offs {
-			if offsetStr != "" {
-				offset := utils.Str2int64(offsetStr)
-				if offset > 0 {
-					offsets = append(offsets, offset)
-				}
-			}
+// RemoveOffsets implements HashDBRemover: one transaction for all tables
+func (s *SQLite3DB) RemoveOffsets(batch []*OffsetData) (int, error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReturnDB(db)
+	removed, err := sqlRemoveOffsets(db, batch, s.offsets, func(key string) string { return "s" + key[:3] })
+	if err != nil {
+		log.Printf("ERROR SQLite3 RemoveOffsets err='%v'", err)
+		return 0, err
+	}
+	return removed, nil
+}
+
+// PruneOffsets implements HashDBPruner
+func (s *SQLite3DB) PruneOffsets(from int64) (keys int, offsets int, err error) {
+	return s.RemapOffsets(pruneBelow(from))
+}
+
+// RemapOffsets implements HashDBRemapper: scans all 4096 tables
+func (s *SQLite3DB) RemapOffsets(remap func(offset int64) (int64, bool)) (keys int, offsets int, err error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.ReturnDB(db)
+	for _, char := range generateCombinations(HEXCHARS, 3, []string{}, []string{}) {
+		k, o, err := remapOffsetsTable(db, "s"+char, s.offsets, remap)
+		if err != nil {
+			log.Printf("ERROR SQLite3 RemapOffsets table=s%s err='%v'", char, err)
+			return keys, offsets, err
 		}
+		keys += k
+		offsets += o
 	}
-	return offsets, nil
+	return keys, offsets, nil
+}
+
+// offsetEncoding implements offsetCoder
+func (s *SQLite3DB) offsetEncoding() int {
+	return s.offsets
+}
+
+// setOffsetEncoding implements offsetCoder
+func (s *SQLite3DB) setOffsetEncoding(enc int) {
+	s.offsets = enc
+}
+
+// convertOffsets implements offsetCoder: converts all 4096 tables
+func (s *SQLite3DB) convertOffsets(enc int) (keys uint64, err error) {
+	db, err := s.GetDB(true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReturnDB(db)
+	for _, char := range generateCombinations(HEXCHARS, 3, []string{}, []string{}) {
+		k, err := convertOffsetsTable(db, "s"+char, enc)
+		if err != nil {
+			log.Printf("ERROR SQLite3 convertOffsets table=s%s err='%v'", char, err)
+			return keys, err
+		}
+		keys += k
+	}
+	s.offsets = enc
+	return keys, nil
 }
 
+// GetDB returns a free connection of any slot. wait=false returns nil if all are in use.
 func (s *SQLite3DB) GetDB(wait bool) (db *sql.DB, err error) {
-	if wait {
-		s.ctr.RLock()
-		if s.isOpen > 0 {
-			s.ctr.RUnlock()
-			dbconn := <-s.DBs
-			if dbconn.timeout > utils.UnixTimeSec() {
-				db = dbconn.db
-				return
-			}
-			// dbconn is timeout, check if still valid
-			if dbconn.db != nil {
-				err = dbconn.db.Ping()
-				if err != nil {
-					log.Printf("WARN SQLite3 GetDB 'ping' failed err='%v'", err)
-					dbconn.db = nil
-				}
-			}
-			if dbconn.db != nil {
-				db = dbconn.db
-				return
-			}
-			db, err = s.NewConn()
-			if err != nil {
-				s.ctr.Lock()
-				s.isOpen--
-				s.ctr.Unlock()
-			}
+	first := int(s.next.Add(1))
+	for i := range s.slots {
+		if db, err = s.getSlotDB((first+i)%len(s.slots), false); db != nil || err != nil {
 			return
 		}
-		s.ctr.RUnlock()
 	}
+	if !wait {
+		return nil, nil
+	}
+	return s.getSlotDB(first%len(s.slots), true)
+}
 
-	select {
-	case dbconn := <-s.DBs:
-		db = dbconn.db
-		return
+// tableSlot returns the connection slot of table: every slot serves a range of the tables.
+// A connection prepares the statements of its tables only.
+func (s *SQLite3DB) tableSlot(table int) int {
+	if table < 0 || table >= s.tables {
+		return 0
+	}
+	return table * len(s.slots) / s.tables
+}
 
-	default:
-		s.ctr.Lock()
-		defer s.ctr.Unlock()
-		if s.isOpen < s.maxOpen {
-			db, err = s.NewConn()
-			if err != nil {
-				return
-			}
-			s.isOpen++
+// getTableDB waits for the connection of the slot of table.
+func (s *SQLite3DB) getTableDB(table int) (*sql.DB, error) {
+	return s.getSlotDB(s.tableSlot(table), true)
+}
+
+// getSlotDB returns the connection of slot and opens it if needed. wait=false returns nil if it is in use.
+func (s *SQLite3DB) getSlotDB(slot int, wait bool) (*sql.DB, error) {
+	var dbconn *SQLite3Conn
+	var ok bool
+	if wait {
+		dbconn, ok = <-s.slots[slot]
+	} else {
+		select {
+		case dbconn, ok = <-s.slots[slot]:
+		default:
+			return nil, nil
 		}
 	}
-	return
+	if !ok {
+		return nil, fmt.Errorf("ERROR SQLite3 GetDB db_path='%s': %w", s.dbPath, ErrClosed)
+	}
+	if dbconn.db != nil && dbconn.timeout <= utils.UnixTimeSec() {
+		// dbconn is timeout, check if still valid
+		if err := dbconn.db.Ping(); err != nil {
+			log.Printf("WARN SQLite3 GetDB 'ping' failed err='%v'", err)
+			s.forgetDB(dbconn.db)
+			dbconn.db = nil
+		}
+	}
+	if dbconn.db != nil {
+		return dbconn.db, nil
+	}
+	db, err := s.NewConn()
+	if err != nil {
+		s.slots[slot] <- &SQLite3Conn{}
+		return nil, err
+	}
+	s.ctr.Lock()
+	s.isOpen++
+	s.slotOf[db] = slot
+	s.ctr.Unlock()
+	return db, nil
+}
+
+// forgetDB closes db and its statements.
+func (s *SQLite3DB) forgetDB(db *sql.DB) (slot int, ok bool) {
+	s.stmts.drop(db)
+	db.Close()
+	s.ctr.Lock()
+	if slot, ok = s.slotOf[db]; ok {
+		delete(s.slotOf, db)
+		s.isOpen--
+	}
+	s.ctr.Unlock()
+	return slot, ok
 }
 
 func (s *SQLite3DB) ReturnDB(db *sql.DB) {
-	s.DBs <- &SQLite3Conn{db: db, timeout: utils.UnixTimeSec() + s.timeout}
+	if db == nil {
+		return
+	}
+	s.ctr.RLock()
+	slot, ok := s.slotOf[db]
+	s.ctr.RUnlock()
+	if !ok {
+		return
+	}
+	s.slots[slot] <- &SQLite3Conn{db: db, timeout: utils.UnixTimeSec() + s.timeout}
 }
 
 func (s *SQLite3DB) CloseDB(db *sql.DB) {
-	db.Close()
-	s.ctr.Lock()
-	s.isOpen--
-	s.ctr.Unlock()
+	if slot, ok := s.forgetDB(db); ok {
+		s.slots[slot] <- &SQLite3Conn{}
+	}
 }
 
+// ClosePool closes the connections. It waits until connections in use are returned.
 func (s *SQLite3DB) ClosePool() {
 	log.Printf("SQLite3 ClosePool")
 	defer log.Printf("SQLite3 ClosePool returned")
 
-	close(s.DBs)
-	for dbconn := range s.DBs {
+	s.stmts.dropAll()
+	for _, slot := range s.slots {
+		dbconn, ok := <-slot
+		if !ok {
+			continue // closed before
+		}
 		if dbconn.db != nil {
-			dbconn.db.Close()
+			s.forgetDB(dbconn.db)
 		}
-		s.ctr.Lock()
-		s.isOpen--
-		s.ctr.Unlock()
+		close(slot)
+	}
+}
+
+// Close implements HashDB
+func (s *SQLite3DB) Close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.stopOpt != nil {
+		close(s.stopOpt)
+	}
+	s.mux.Unlock()
+	s.ClosePool()
+	if isopen := s.GetIsOpen(); isopen > 0 {
+		return fmt.Errorf("ERROR SQLite3 Close db_path='%s' connections still open: %d", s.dbPath, isopen)
 	}
+	return nil
+}
+
+// Stats implements HashDB
+func (s *SQLite3DB) Stats() map[string]interface{} {
+	cache := s.StmtCacheStats()
+	return map[string]interface{}{
+		"backend":             "sqlite3",
+		"db_path":             s.dbPath,
+		"is_open":             s.GetIsOpen(),
+		"max_open":            s.maxOpen,
+		"stmt_cache":          cache,
+		"stmt_cache_hit_rate": cache.HitRate(),
+	}
+}
+
+// StmtCacheStats returns the counters of the prepared statement cache
+func (s *SQLite3DB) StmtCacheStats() StmtCacheStats {
+	return s.stmts.stats()
+}
+
+// setStmtCacheSize sets the prepared statements per connection
+func (s *SQLite3DB) setStmtCacheSize(size int) {
+	s.stmts.setSize(size)
+}
+
+func (s *SQLite3DB) GetIsOpen() int {
+	s.ctr.RLock()
+	isopen := s.isOpen
+	s.ctr.RUnlock()
+	return isopen
 }
 
 // Initialize SQLite3 for history system
@@ -306,11 +535,12 @@ func (his *HISTORY) InitSQLite3WithSharding(shardMode int) error {
 	if shardMode == SHARD_SINGLE_DB {
 		// Use original single-database implementation for backward compatibility
 		opts := &SQLite3Opts{
-			dbPath:   his.DIR + "/hashdb.sqlite3",
-			params:   "?cache=shared&mode=rwc&_journal_mode=WAL&_synchronous=NORMAL&_cache_size=100000&_temp_store=memory&_mmap_size=268435456",
-			maxOpen:  8, // SQLite works better with fewer connections
-			initOpen: 2,
-			timeout:  30,
+			dbPath:    his.DIR + "/hashdb.sqlite3",
+			params:    "?cache=shared&mode=rwc&_journal_mode=WAL&_synchronous=NORMAL&_cache_size=100000&_temp_store=memory&_mmap_size=268435456",
+			maxOpen:   8, // SQLite works better with fewer connections
+			initOpen:  2,
+			timeout:   30,
+			stmtCache: his.opts.StmtCacheSize,
 		}
 
 		pool, err := NewSQLite3Pool(opts, true)
@@ -320,15 +550,17 @@ func (his *HISTORY) InitSQLite3WithSharding(shardMode int) error {
 
 		// Store as interface{} to avoid type issues with build tags
 		his.SQLite3Pool = pool
+		his.hashDB = pool
 
 		log.Printf("SQLite3 single-database pool initialized successfully at %s", opts.dbPath)
 	} else {
 		// Use sharded database implementation
 		config := &ShardConfig{
-			Mode:         shardMode,
-			BaseDir:      his.DIR,
-			MaxOpenPerDB: 8, // SQLite works better with fewer connections per DB
-			Timeout:      30,
+			Mode:          shardMode,
+			BaseDir:       his.DIR,
+			MaxOpenPerDB:  8, // SQLite works better with fewer connections per DB
+			Timeout:       30,
+			StmtCacheSize: his.opts.StmtCacheSize,
 		}
 
 		shardedDB, err := NewSQLite3ShardedDB(config, true)
@@ -338,6 +570,7 @@ func (his *HISTORY) InitSQLite3WithSharding(shardMode int) error {
 
 		// Store as interface{} to maintain compatibility
 		his.SQLite3Pool = shardedDB
+		his.hashDB = shardedDB
 
 		numDBs, tablesPerDB, description := GetShardConfig(shardMode)
 		log.Printf("SQLite3 sharded system initialized: %s (%d DBs, %d tables per DB)",
@@ -381,12 +614,23 @@ func (s *SQLite3DB) OptimizeDB() {
 
 // Start periodic optimization
 func (s *SQLite3DB) StartOptimizer() {
-	go func() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed || s.stopOpt != nil {
+		return
+	}
+	s.stopOpt = make(chan struct{})
+	go func(stop chan struct{}) {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			s.OptimizeDB()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.OptimizeDB()
+			}
 		}
-	}()
+	}(s.stopOpt)
 }
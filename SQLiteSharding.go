@@ -2,6 +2,7 @@ package history
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
@@ -21,6 +22,22 @@ const (
 	SHARD_512_8      = 5 // 512 DBs with 8 tables each
 )
 
+// Key layout of SQLite3ShardedDB
+//
+// A key is the first 3+KeyLen chars of a hash. Its 3 char hex prefix p (000-fff) selects
+// database p / tablesPerDB and table p % tablesPerDB, column h holds the remaining KeyLen chars.
+// Database and table together identify the prefix: a table never holds keys of two prefixes.
+//
+//	mode              DBs   tables/DB  database file               table
+//	SHARD_SINGLE_DB   1     4096       hashdb.sqlite3              s%03x p
+//	SHARD_FULL_SPLIT  4096  1          hashdb_%03x.sqlite3 p       shash
+//	SHARD_16_256      16    256        hashdb_%03d.sqlite3 p>>8    s%02x p&0xff
+//	SHARD_64_64       64    64         hashdb_%03d.sqlite3 p>>6    s%02x p&0x3f
+//	SHARD_128_32      128   32         hashdb_%03d.sqlite3 p>>5    s%02x p&0x1f
+//	SHARD_512_8       512   8          hashdb_%03d.sqlite3 p>>3    s%01x p&0x7
+//
+// MigrateShardMode moves existing databases to another shard mode.
+
 // SQLite3ShardedDB manages multiple SQLite databases for sharding
 type SQLite3ShardedDB struct {
 	mux         sync.RWMutex
@@ -32,14 +49,16 @@ type SQLite3ShardedDB struct {
 	baseDir     string
 	maxOpen     int
 	timeout     int64
+	offsets     int // offset encoding: OffsetsText or OffsetsVarint
 }
 
 // ShardConfig defines the sharding configuration
 type ShardConfig struct {
-	Mode         int    // Sharding mode (0-5)
-	BaseDir      string // Base directory for database files
-	MaxOpenPerDB int    // Max connections per database
-	Timeout      int64  // Connection timeout
+	Mode          int    // Sharding mode (0-5)
+	BaseDir       string // Base directory for database files
+	MaxOpenPerDB  int    // Max connections per database
+	Timeout       int64  // Connection timeout
+	StmtCacheSize int    // Prepared statements per connection, 0 disables the cache, StmtCacheAuto: 2 per table
 }
 
 // GetShardConfig returns the configuration for a given shard mode
@@ -64,6 +83,9 @@ func GetShardConfig(mode int) (numDBs, tablesPerDB int, description string) {
 
 // NewSQLite3ShardedDB creates a new sharded SQLite3 database system
 func NewSQLite3ShardedDB(config *ShardConfig, createTables bool) (*SQLite3ShardedDB, error) {
+	if config.Mode < SHARD_SINGLE_DB || config.Mode > SHARD_512_8 {
+		return nil, fmt.Errorf("ERROR NewSQLite3ShardedDB unknown shard mode=%d: %w", config.Mode, ErrInvalidConfig)
+	}
 	numDBs, tablesPerDB, description := GetShardConfig(config.Mode)
 
 	log.Printf("Initializing SQLite3 sharded system: %s", description)
@@ -101,11 +123,13 @@ func NewSQLite3ShardedDB(config *ShardConfig, createTables bool) (*SQLite3Sharde
 		}
 
 		opts := &SQLite3Opts{
-			dbPath:   dbPath,
-			params:   buildOptimizedParams(config.Mode),
-			maxOpen:  config.MaxOpenPerDB,
-			initOpen: 1,
-			timeout:  config.Timeout,
+			dbPath:    dbPath,
+			params:    buildOptimizedParams(config.Mode),
+			maxOpen:   config.MaxOpenPerDB,
+			initOpen:  1,
+			timeout:   config.Timeout,
+			stmtCache: config.StmtCacheSize,
+			tables:    tablesPerDB,
 		}
 
 		pool, err := NewSQLite3Pool(opts, false) // Don't create tables yet
@@ -140,102 +164,41 @@ func hexToInt(hexStr string) (int, error) {
 	return int(val), err
 }
 
-// getDBIndexFromHash determines which database to use based on hash
-func (s *SQLite3ShardedDB) getDBIndexFromHash(hash string) int {
-	if len(hash) < 3 {
-		return 0
+// shardOf returns database index and table index of key, see Key layout.
+func (s *SQLite3ShardedDB) shardOf(key string) (dbIndex int, table int, err error) {
+	if len(key) < 4 {
+		return 0, 0, fmt.Errorf("key='%s' too short", key)
 	}
-
-	switch s.shardMode {
-	case SHARD_SINGLE_DB:
-		return 0 // Always use the single database
-	case SHARD_FULL_SPLIT:
-		// Use first 3 characters to determine DB (4096 options)
-		prefix := hash[:3]
-		if val, err := hexToInt(prefix); err == nil {
-			return val % s.numDBs
-		}
-		return 0
-	case SHARD_16_256:
-		// Use first character (16 options)
-		if val, err := hexToInt(string(hash[0])); err == nil {
-			return val % s.numDBs
-		}
-		return 0
-	case SHARD_64_64:
-		// Use first 1.5 characters (64 options)
-		prefix := hash[:2]
-		if val, err := hexToInt(prefix); err == nil {
-			return (val / 4) % s.numDBs
-		}
-		return 0
-	case SHARD_128_32:
-		// Use first 2 characters, divide by 2 (128 options)
-		prefix := hash[:2]
-		if val, err := hexToInt(prefix); err == nil {
-			return (val / 2) % s.numDBs
-		}
-		return 0
-	case SHARD_512_8:
-		// Use first 2.25 characters (512 options)
-		prefix := hash[:3]
-		if val, err := hexToInt(prefix); err == nil {
-			return (val / 8) % s.numDBs
-		}
-		return 0
-	default:
-		return 0
+	prefix, err := hexToInt(key[:3])
+	if err != nil || key[0] == '-' || key[0] == '+' {
+		return 0, 0, fmt.Errorf("key='%s' has no hex prefix", key)
 	}
+	return prefix / s.tablesPerDB, prefix % s.tablesPerDB, nil
+}
+
+// getDBIndexFromHash returns the database of hash. hash must be a valid key, see shardOf.
+func (s *SQLite3ShardedDB) getDBIndexFromHash(hash string) int {
+	dbIndex, _, _ := s.shardOf(hash)
+	return dbIndex
 }
 
-// getTableNameFromHash determines which table to use within a database
+// getTableNameFromHash returns the table of hash within its database. hash must be a valid key, see shardOf.
 func (s *SQLite3ShardedDB) getTableNameFromHash(hash string) string {
-	if len(hash) < 3 {
-		return "s000"
-	}
+	_, table, _ := s.shardOf(hash)
+	return s.tableName(table)
+}
 
-	switch s.shardMode {
-	case SHARD_SINGLE_DB:
-		// Use first 3 characters for table name (4096 tables)
-		return fmt.Sprintf("s%s", hash[:3])
-	case SHARD_FULL_SPLIT:
-		// Each DB has only one table
+// tableName returns the name of table index table: s plus as many hex digits as tablesPerDB needs.
+func (s *SQLite3ShardedDB) tableName(table int) string {
+	switch s.tablesPerDB {
+	case 1:
 		return "shash"
-	case SHARD_16_256:
-		// Use characters 2-3 for table name within DB (256 tables per DB)
-		if len(hash) >= 3 {
-			return fmt.Sprintf("s%s", hash[1:3])
-		}
-		return "s00"
-	case SHARD_64_64:
-		// Use bits of character 2-3 for table name (64 tables per DB)
-		if len(hash) >= 3 {
-			prefix := hash[1:3]
-			if val, err := hexToInt(prefix); err == nil {
-				return fmt.Sprintf("s%02x", val%64)
-			}
-		}
-		return "s00"
-	case SHARD_128_32:
-		// Use lower bits for table name (32 tables per DB)
-		if len(hash) >= 3 {
-			prefix := hash[1:3]
-			if val, err := hexToInt(prefix); err == nil {
-				return fmt.Sprintf("s%02x", val%32)
-			}
-		}
-		return "s00"
-	case SHARD_512_8:
-		// Use lower bits for table name (8 tables per DB)
-		if len(hash) >= 3 {
-			prefix := hash[2:3]
-			if val, err := hexToInt(prefix); err == nil {
-				return fmt.Sprintf("s%01x", val%8)
-			}
-		}
-		return "s0"
+	case 4096:
+		return fmt.Sprintf("s%03x", table)
+	case 8:
+		return fmt.Sprintf("s%01x", table)
 	default:
-		return "s000"
+		return fmt.Sprintf("s%02x", table)
 	}
 }
 
@@ -262,13 +225,11 @@ func (s *SQLite3ShardedDB) createTablesForDB(dbIndex int) error {
 	}
 	defer s.DBPools[dbIndex].ReturnDB(db)
 
-	if s.shardMode == SHARD_FULL_SPLIT {
-		// Each DB has only one table
-		tableName := "shash"
+	for _, tableName := range s.getTableNamesForDB(dbIndex) {
 		query := fmt.Sprintf(`
 			CREATE TABLE IF NOT EXISTS %s (
 				h CHAR(7) NOT NULL PRIMARY KEY,
-				o TEXT
+				o BLOB
 			) WITHOUT ROWID;
 		`, tableName)
 
@@ -283,88 +244,38 @@ func (s *SQLite3ShardedDB) createTablesForDB(dbIndex int) error {
 		if err != nil {
 			log.Printf("WARN SQLite3 index creation failed for table %s: %v", tableName, err)
 		}
-	} else {
-		// Create multiple tables per database
-		tableNames := s.getTableNamesForDB(dbIndex)
-		for _, tableName := range tableNames {
-			query := fmt.Sprintf(`
-				CREATE TABLE IF NOT EXISTS %s (
-					h CHAR(7) NOT NULL PRIMARY KEY,
-					o TEXT
-				) WITHOUT ROWID;
-			`, tableName)
-
-			_, err := db.Exec(query)
-			if err != nil {
-				return fmt.Errorf("failed to create table %s: %v", tableName, err)
-			}
-
-			// Create index
-			indexQuery := fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_h ON %s(h);", tableName, tableName)
-			_, err = db.Exec(indexQuery)
-			if err != nil {
-				log.Printf("WARN SQLite3 index creation failed for table %s: %v", tableName, err)
-			}
-		}
 	}
 
 	return nil
 }
 
-// getTableNamesForDB returns all table names for a specific database
+// getTableNamesForDB returns all table names for a specific database.
+// Every database of a mode has the same tables.
 func (s *SQLite3ShardedDB) getTableNamesForDB(dbIndex int) []string {
-	var tableNames []string
-
-	switch s.shardMode {
-	case SHARD_SINGLE_DB:
-		// All 4096 tables in one database
-		cs := "0123456789abcdef"
-		for _, c1 := range cs {
-			for _, c2 := range cs {
-				for _, c3 := range cs {
-					tableNames = append(tableNames, fmt.Sprintf("s%s%s%s", string(c1), string(c2), string(c3)))
-				}
-			}
-		}
-	case SHARD_16_256:
-		// 256 tables per database
-		cs := "0123456789abcdef"
-		for _, c1 := range cs {
-			for _, c2 := range cs {
-				tableNames = append(tableNames, fmt.Sprintf("s%s%s", string(c1), string(c2)))
-			}
-		}
-	case SHARD_64_64:
-		// 64 tables per database
-		for i := 0; i < 64; i++ {
-			tableNames = append(tableNames, fmt.Sprintf("s%02x", i))
-		}
-	case SHARD_128_32:
-		// 32 tables per database
-		for i := 0; i < 32; i++ {
-			tableNames = append(tableNames, fmt.Sprintf("s%02x", i))
-		}
-	case SHARD_512_8:
-		// 8 tables per database
-		for i := 0; i < 8; i++ {
-			tableNames = append(tableNames, fmt.Sprintf("s%01x", i))
-		}
+	tableNames := make([]string, s.tablesPerDB)
+	for i := range tableNames {
+		tableNames[i] = s.tableName(i)
 	}
-
 	return tableNames
 }
 
-// GetDBAndTable returns the appropriate database connection and table name for a hash
+// GetDBAndTable returns the appropriate database connection and table name for a hash.
+// Waits for a free connection. Return the connection with ReturnDB.
 func (s *SQLite3ShardedDB) GetDBAndTable(hash string) (*sql.DB, string, int, error) {
-	dbIndex := s.getDBIndexFromHash(hash)
-	tableName := s.getTableNameFromHash(hash)
+	dbIndex, table, err := s.shardOf(hash)
+	if err != nil {
+		return nil, "", -1, fmt.Errorf("ERROR SQLite3Sharded GetDBAndTable: %v: %w", err, ErrInvalidConfig)
+	}
 
-	db, err := s.DBPools[dbIndex].GetDB(false)
+	db, err := s.DBPools[dbIndex].getTableDB(table)
 	if err != nil {
 		return nil, "", dbIndex, err
 	}
+	if db == nil {
+		return nil, "", dbIndex, fmt.Errorf("ERROR SQLite3Sharded GetDBAndTable db=%d no connection: %w", dbIndex, ErrBackendUnavailable)
+	}
 
-	return db, tableName, dbIndex, nil
+	return db, s.tableName(table), dbIndex, nil
 }
 
 // ReturnDB returns a database connection to its pool
@@ -374,14 +285,207 @@ func (s *SQLite3ShardedDB) ReturnDB(db *sql.DB, dbIndex int) {
 	}
 }
 
+// InsertOffset implements HashDB: appends offset to the offsets of key in its shard
+func (s *SQLite3ShardedDB) InsertOffset(key string, offset int64) error {
+	dbIndex, table, err := s.shardOf(key)
+	if err != nil {
+		return fmt.Errorf("ERROR SQLite3Sharded InsertOffset: %v: %w", err, ErrInvalidConfig)
+	}
+	tableName := s.tableName(table)
+	hashKey := key[3:]
+
+	db, err := s.DBPools[dbIndex].getTableDB(table)
+	if err != nil {
+		return err
+	}
+	defer s.DBPools[dbIndex].ReturnDB(db)
+
+	tail := appendOffsets(nil, s.offsets, offset)
+	if _, err := s.DBPools[dbIndex].stmts.exec(db, stmtUpsert, tableName, hashKey, newOffsetsValue(s.offsets, tail), tail); err != nil {
+		log.Printf("ERROR SQLite3Sharded InsertOffset db=%d table=%s key=%s offset=%d err='%v'", dbIndex, tableName, hashKey, offset, err)
+		return err
+	}
+	return nil
+}
+
+// InsertOffsets implements HashDBBatcher: one transaction per database and connection slot
+func (s *SQLite3ShardedDB) InsertOffsets(batch []*OffsetData) error {
+	keys, values := groupOffsets(batch, s.offsets)
+	dbKeys := make(map[int][]string)
+	var order []int
+	for _, key := range keys {
+		dbIndex, _, err := s.shardOf(key)
+		if err != nil {
+			return fmt.Errorf("ERROR SQLite3Sharded InsertOffsets: %v: %w", err, ErrInvalidConfig)
+		}
+		if _, exists := dbKeys[dbIndex]; !exists {
+			order = append(order, dbIndex)
+		}
+		dbKeys[dbIndex] = append(dbKeys[dbIndex], key)
+	}
+	table := func(key string) int {
+		_, table, _ := s.shardOf(key)
+		return table
+	}
+	for _, dbIndex := range order {
+		pool := s.DBPools[dbIndex]
+		slotKeys, slots := pool.slotKeys(dbKeys[dbIndex], table)
+		for _, slot := range slots {
+			db, err := pool.getSlotDB(slot, true)
+			if err != nil {
+				return err
+			}
+			err = sqliteInsertOffsetsTx(db, pool.stmts, slotKeys[slot], values, s.offsets, s.getTableNameFromHash)
+			pool.ReturnDB(db)
+			if err != nil {
+				log.Printf("ERROR SQLite3Sharded InsertOffsets db=%d err='%v'", dbIndex, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetOffsets implements HashDB: returns the offsets of key from its shard
+func (s *SQLite3ShardedDB) GetOffsets(key string) ([]int64, error) {
+	dbIndex, table, err := s.shardOf(key)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR SQLite3Sharded GetOffsets: %v: %w", err, ErrInvalidConfig)
+	}
+	tableName := s.tableName(table)
+	hashKey := key[3:]
+
+	db, err := s.DBPools[dbIndex].getTableDB(table)
+	if err != nil {
+		return nil, err
+	}
+	defer s.DBPools[dbIndex].ReturnDB(db)
+
+	var value []byte
+	err = s.DBPools[dbIndex].stmts.queryRow(db, stmtSelect, tableName, hashKey).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("ERROR SQLite3Sharded GetOffsets db=%d table=%s key=%s err='%v'", dbIndex, tableName, hashKey, err)
+		return nil, err
+	}
+	offsets, err := decodeOffsets(nil, value)
+	if err != nil {
+		log.Printf("ERROR SQLite3Sharded GetOffsets db=%d table=%s key=%s err='%v'", dbIndex, tableName, hashKey, err)
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// RemoveOffsets implements HashDBRemover: one transaction per database
+func (s *SQLite3ShardedDB) RemoveOffsets(batch []*OffsetData) (removed int, err error) {
+	dbBatch := make(map[int][]*OffsetData)
+	var order []int
+	for _, od := range batch {
+		dbIndex, _, err := s.shardOf(od.Shorthash)
+		if err != nil {
+			continue // was never inserted
+		}
+		if _, exists := dbBatch[dbIndex]; !exists {
+			order = append(order, dbIndex)
+		}
+		dbBatch[dbIndex] = append(dbBatch[dbIndex], od)
+	}
+	for _, dbIndex := range order {
+		db, err := s.DBPools[dbIndex].GetDB(true)
+		if err != nil {
+			return removed, err
+		}
+		n, err := sqlRemoveOffsets(db, dbBatch[dbIndex], s.offsets, s.getTableNameFromHash)
+		s.DBPools[dbIndex].ReturnDB(db)
+		if err != nil {
+			log.Printf("ERROR SQLite3Sharded RemoveOffsets db=%d err='%v'", dbIndex, err)
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// PruneOffsets implements HashDBPruner
+func (s *SQLite3ShardedDB) PruneOffsets(from int64) (keys int, offsets int, err error) {
+	return s.RemapOffsets(pruneBelow(from))
+}
+
+// RemapOffsets implements HashDBRemapper: scans all tables of all databases
+func (s *SQLite3ShardedDB) RemapOffsets(remap func(offset int64) (int64, bool)) (keys int, offsets int, err error) {
+	for dbIndex, pool := range s.DBPools {
+		tableNames := s.getTableNamesForDB(dbIndex)
+		db, err := pool.GetDB(true)
+		if err != nil {
+			return keys, offsets, err
+		}
+		for _, tableName := range tableNames {
+			k, o, err := remapOffsetsTable(db, tableName, s.offsets, remap)
+			if err != nil {
+				pool.ReturnDB(db)
+				log.Printf("ERROR SQLite3Sharded RemapOffsets db=%d table=%s err='%v'", dbIndex, tableName, err)
+				return keys, offsets, err
+			}
+			keys += k
+			offsets += o
+		}
+		pool.ReturnDB(db)
+	}
+	return keys, offsets, nil
+}
+
+// offsetEncoding implements offsetCoder
+func (s *SQLite3ShardedDB) offsetEncoding() int {
+	return s.offsets
+}
+
+// setOffsetEncoding implements offsetCoder
+func (s *SQLite3ShardedDB) setOffsetEncoding(enc int) {
+	s.offsets = enc
+}
+
+// convertOffsets implements offsetCoder: converts all tables of all databases
+func (s *SQLite3ShardedDB) convertOffsets(enc int) (keys uint64, err error) {
+	for dbIndex, pool := range s.DBPools {
+		db, err := pool.GetDB(true)
+		if err != nil {
+			return keys, err
+		}
+		for _, tableName := range s.getTableNamesForDB(dbIndex) {
+			k, err := convertOffsetsTable(db, tableName, enc)
+			if err != nil {
+				pool.ReturnDB(db)
+				log.Printf("ERROR SQLite3Sharded convertOffsets db=%d table=%s err='%v'", dbIndex, tableName, err)
+				return keys, err
+			}
+			keys += k
+		}
+		pool.ReturnDB(db)
+	}
+	s.offsets = enc
+	return keys, nil
+}
+
+// Stats implements HashDB
+func (s *SQLite3ShardedDB) Stats() map[string]interface{} {
+	stats := s.GetStats()
+	stats["backend"] = "sqlite3_sharded"
+	return stats
+}
+
 // Close closes all database connections
 func (s *SQLite3ShardedDB) Close() error {
+	var errs []error
 	for _, pool := range s.DBPools {
 		if pool != nil {
-			pool.ClosePool()
+			if err := pool.Close(); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 // GetStats returns statistics for all databases
@@ -400,16 +504,39 @@ func (s *SQLite3ShardedDB) GetStats() map[string]interface{} {
 		if pool != nil {
 			dbStats[i] = map[string]interface{}{
 				"db_index": i,
-				"is_open":  pool.isOpen,
+				"is_open":  pool.GetIsOpen(),
 				"db_path":  pool.dbPath,
 			}
 		}
 	}
 	stats["databases"] = dbStats
+	cache := s.StmtCacheStats()
+	stats["stmt_cache"] = cache
+	stats["stmt_cache_hit_rate"] = cache.HitRate()
 
 	return stats
 }
 
+// StmtCacheStats returns the prepared statement caches of all databases
+func (s *SQLite3ShardedDB) StmtCacheStats() StmtCacheStats {
+	var stats StmtCacheStats
+	for _, pool := range s.DBPools {
+		if pool != nil {
+			stats = stats.add(pool.StmtCacheStats())
+		}
+	}
+	return stats
+}
+
+// setStmtCacheSize sets the prepared statements per connection of all databases
+func (s *SQLite3ShardedDB) setStmtCacheSize(size int) {
+	for _, pool := range s.DBPools {
+		if pool != nil {
+			pool.setStmtCacheSize(size)
+		}
+	}
+}
+
 // getAdaptiveCacheSize returns optimal cache_size for each sharding mode
 func getAdaptiveCacheSize(mode int) int {
 	switch mode {
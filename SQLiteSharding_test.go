@@ -0,0 +1,113 @@
+package history
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// shardModes lists every shard mode with the expected location of key prefix abc (2748).
+var shardModes = []struct {
+	mode     int
+	numDBs   int
+	tables   int
+	abcDB    int
+	abcTable string
+}{
+	{SHARD_SINGLE_DB, 1, 4096, 0, "sabc"},
+	{SHARD_FULL_SPLIT, 4096, 1, 0xabc, "shash"},
+	{SHARD_16_256, 16, 256, 0xa, "sbc"},
+	{SHARD_64_64, 64, 64, 0xabc >> 6, "s3c"},
+	{SHARD_128_32, 128, 32, 0xabc >> 5, "s1c"},
+	{SHARD_512_8, 512, 8, 0xabc >> 3, "s4"},
+}
+
+func TestShardOfLayout(t *testing.T) {
+	for _, tc := range shardModes {
+		t.Run(fmt.Sprintf("mode%d", tc.mode), func(t *testing.T) {
+			numDBs, tables, _ := GetShardConfig(tc.mode)
+			if numDBs != tc.numDBs || tables != tc.tables {
+				t.Fatalf("GetShardConfig=%d/%d want %d/%d", numDBs, tables, tc.numDBs, tc.tables)
+			}
+			s := &SQLite3ShardedDB{shardMode: tc.mode, numDBs: numDBs, tablesPerDB: tables}
+			seen := make(map[string]int, 4096)
+			for prefix := 0; prefix < 4096; prefix++ {
+				key := fmt.Sprintf("%03x1234567", prefix)
+				dbIndex, table, err := s.shardOf(key)
+				if err != nil {
+					t.Fatalf("shardOf(%s) err='%v'", key, err)
+				}
+				if dbIndex < 0 || dbIndex >= numDBs || table < 0 || table >= tables {
+					t.Fatalf("shardOf(%s)=%d/%d out of range", key, dbIndex, table)
+				}
+				// database and table identify the prefix: keys of two prefixes never share a table
+				if dbIndex*tables+table != prefix {
+					t.Fatalf("shardOf(%s)=%d/%d does not map back to %03x", key, dbIndex, table, prefix)
+				}
+				loc := fmt.Sprintf("%d/%s", dbIndex, s.tableName(table))
+				if other, exists := seen[loc]; exists {
+					t.Fatalf("prefixes %03x and %03x share %s", other, prefix, loc)
+				}
+				seen[loc] = prefix
+			}
+			dbIndex, table, _ := s.shardOf("abc1234567")
+			if dbIndex != tc.abcDB || s.tableName(table) != tc.abcTable {
+				t.Errorf("abc -> %d/%s want %d/%s", dbIndex, s.tableName(table), tc.abcDB, tc.abcTable)
+			}
+			if got := s.getTableNameFromHash("abc1234567"); got != tc.abcTable {
+				t.Errorf("getTableNameFromHash=%s want %s", got, tc.abcTable)
+			}
+		})
+	}
+}
+
+func TestShardOfInvalidKeys(t *testing.T) {
+	s := &SQLite3ShardedDB{numDBs: 16, tablesPerDB: 256}
+	for _, key := range []string{"", "ab", "abc", "xyz1234567", "-011234567", "+011234567", "0g01234567"} {
+		if dbIndex, table, err := s.shardOf(key); err == nil {
+			t.Errorf("shardOf(%q)=%d/%d want an error", key, dbIndex, table)
+		}
+	}
+}
+
+// TestShardedRoundTrip stores keys which differ only in the prefix: each must get its own offsets back.
+func TestShardedRoundTrip(t *testing.T) {
+	prefixes := []string{"000", "007", "008", "0ff", "100", "7ff", "800", "abc", "fff"}
+	for _, tc := range shardModes {
+		if tc.mode == SHARD_FULL_SPLIT && testing.Short() {
+			continue // creates 4096 databases
+		}
+		t.Run(fmt.Sprintf("mode%d", tc.mode), func(t *testing.T) {
+			s, err := NewSQLite3ShardedDB(&ShardConfig{Mode: tc.mode, BaseDir: t.TempDir(), MaxOpenPerDB: 2, StmtCacheSize: StmtCacheAuto}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.setOffsetEncoding(OffsetsVarint)
+			var batch []*OffsetData
+			for i, prefix := range prefixes {
+				key := prefix + "1234567"
+				if err := s.InsertOffset(key, int64(1000+i)); err != nil {
+					t.Fatalf("InsertOffset(%s) err='%v'", key, err)
+				}
+				batch = append(batch, &OffsetData{Shorthash: key, Offset: int64(1<<40 + i)})
+			}
+			if err := s.InsertOffsets(batch); err != nil {
+				t.Fatalf("InsertOffsets err='%v'", err)
+			}
+			for i, prefix := range prefixes {
+				key := prefix + "1234567"
+				offsets, err := s.GetOffsets(key)
+				if err != nil {
+					t.Fatalf("GetOffsets(%s) err='%v'", key, err)
+				}
+				if want := []int64{int64(1000 + i), int64(1<<40 + i)}; !slices.Equal(offsets, want) {
+					t.Errorf("GetOffsets(%s)=%v want %v", key, offsets, want)
+				}
+			}
+			if offsets, err := s.GetOffsets("1231234567"); err != nil || len(offsets) != 0 {
+				t.Errorf("GetOffsets of a missing key=%v err='%v'", offsets, err)
+			}
+		})
+	}
+}
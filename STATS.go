@@ -33,19 +33,29 @@ func (his *HISTORY) GetCounter(k string) uint64 {
 func (his *HISTORY) WatchDB() { // MySQL database performance monitoring
 	// this function watches the performance of the MySQL RocksDB
 	his.mux.Lock()
-	if his.WBR {
+	if his.WBR || his.stop == nil || his.isClosed() { // running, not booted or closed
 		his.mux.Unlock()
 		return
 	}
 	his.WBR = true
+	his.bgWG.Add(1)
 	his.mux.Unlock()
+	defer his.bgWG.Done()
 
 	WatchDBTimer := 10 // every N seconds
 	uWatchDBTimer := uint64(WatchDBTimer)
 	var inserted uint64
 	var searches uint64
 	ticker := time.NewTicker(time.Duration(WatchDBTimer) * time.Second)
-	for range ticker.C {
+	defer ticker.Stop()
+forever:
+	for {
+		select {
+		case <-his.stop:
+			break forever
+		case <-ticker.C:
+			// pass
+		}
 		insertednow := his.GetCounter("inserted")
 		searchesnow := his.GetCounter("searches")
 		if insertednow > inserted {
@@ -61,5 +71,8 @@ func (his *HISTORY) WatchDB() { // MySQL database performance monitoring
 			searches = searchesnow
 		}
 	}
-	log.Printf("ERROR WatchDB returned!")
+	his.mux.Lock()
+	his.WBR = false
+	his.mux.Unlock()
+	log.Printf("WatchDB stopped")
 } // end func WatchDB
@@ -0,0 +1,255 @@
+package history
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// StmtCacheAuto sizes the statement cache by the tables a connection serves, see stmtCacheAuto.
+const StmtCacheAuto = -1
+
+// HashDBStmtCache is the default of BootOptions.StmtCacheSize:
+// prepared statements kept per connection of a hashDB pool. 0 disables the cache.
+// Every table needs an upsert and a select statement.
+var HashDBStmtCache = StmtCacheAuto
+
+// stmtCacheAuto returns the StmtCacheAuto size of a pool with conns connections over tables.
+// The pools give every connection a range of the tables (tableSlot): it keeps both statements
+// of each of them. A pool holds 2*tables statements: 8192 for 4096 tables, below the
+// max_prepared_stmt_count of MySQL (default 16382).
+func stmtCacheAuto(tables int, conns int) int {
+	if tables <= 0 || conns <= 0 {
+		return 0
+	}
+	return 2 * ((tables + conns - 1) / conns)
+} // end func stmtCacheAuto
+
+// stmtCacher is implemented by the SQL backends: openHashDB sizes the caches of a preset hashDB.
+type stmtCacher interface {
+	setStmtCacheSize(size int)
+}
+
+// statements of the hashDB cached per connection and table
+const (
+	stmtUpsert = iota // appends offsets: key, value of a new key, encoded offsets
+	stmtSelect        // selects the offsets of key
+)
+
+// stmtKey identifies a cached statement of a connection.
+type stmtKey struct {
+	kind  int
+	table string
+}
+
+type stmtEntry struct {
+	key  stmtKey
+	stmt *sql.Stmt
+}
+
+// stmtCache holds the prepared statements of one connection in LRU order.
+type stmtCache struct {
+	ll    *list.List // front: most recently used
+	items map[stmtKey]*list.Element
+}
+
+// stmtCaches holds a stmtCache per connection of a pool.
+// A connection is used by one goroutine at a time: a statement is not evicted while it runs.
+type stmtCaches struct {
+	mux       sync.Mutex
+	size      atomic.Int64 // statements per connection. <= 0 disables the cache
+	auto      int          // size of StmtCacheAuto
+	query     func(kind int, table string) string
+	conns     map[*sql.DB]*stmtCache
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// newStmtCaches returns the caches of a pool. query returns the SQL of a statement.
+// size StmtCacheAuto keeps auto statements.
+func newStmtCaches(size int, auto int, query func(kind int, table string) string) *stmtCaches {
+	sc := &stmtCaches{auto: auto, query: query, conns: make(map[*sql.DB]*stmtCache)}
+	sc.setSize(size)
+	return sc
+} // end func newStmtCaches
+
+// setSize changes the statements per connection. size StmtCacheAuto keeps auto statements.
+// A connection evicts its surplus statements with its next lookup or when it gets dropped.
+func (sc *stmtCaches) setSize(size int) {
+	if size < 0 {
+		size = sc.auto
+	}
+	sc.size.Store(int64(size))
+} // end func setSize
+
+// prepare returns the statement kind of table on db or nil if the cache is disabled.
+func (sc *stmtCaches) prepare(db *sql.DB, kind int, table string) (*sql.Stmt, error) {
+	size := int(sc.size.Load())
+	if size <= 0 {
+		return nil, nil
+	}
+	key := stmtKey{kind: kind, table: table}
+	sc.mux.Lock()
+	cache := sc.conns[db]
+	if cache == nil {
+		cache = &stmtCache{ll: list.New(), items: make(map[stmtKey]*list.Element)}
+		sc.conns[db] = cache
+	}
+	if elem := cache.items[key]; elem != nil {
+		cache.ll.MoveToFront(elem)
+		evicted := sc.trim(cache, size)
+		sc.mux.Unlock()
+		sc.closeEvicted(evicted)
+		sc.hits.Add(1)
+		return elem.Value.(*stmtEntry).stmt, nil
+	}
+	sc.mux.Unlock()
+	sc.misses.Add(1)
+
+	// prepare without the lock: only the goroutine holding db adds statements of db
+	stmt, err := db.Prepare(sc.query(kind, table))
+	if err != nil {
+		return nil, err
+	}
+	sc.mux.Lock()
+	if sc.conns[db] != cache {
+		// dropped meanwhile
+		sc.mux.Unlock()
+		stmt.Close()
+		return nil, nil
+	}
+	if elem := cache.items[key]; elem != nil {
+		sc.mux.Unlock()
+		stmt.Close()
+		return elem.Value.(*stmtEntry).stmt, nil
+	}
+	cache.items[key] = cache.ll.PushFront(&stmtEntry{key: key, stmt: stmt})
+	evicted := sc.trim(cache, size)
+	sc.mux.Unlock()
+	sc.closeEvicted(evicted)
+	return stmt, nil
+} // end func prepare
+
+// trim removes the least recently used statements of cache beyond size. sc.mux is held.
+func (sc *stmtCaches) trim(cache *stmtCache, size int) (evicted []*sql.Stmt) {
+	for cache.ll.Len() > size {
+		entry := cache.ll.Remove(cache.ll.Back()).(*stmtEntry)
+		delete(cache.items, entry.key)
+		evicted = append(evicted, entry.stmt)
+	}
+	return evicted
+} // end func trim
+
+// closeEvicted closes the statements trim removed.
+func (sc *stmtCaches) closeEvicted(evicted []*sql.Stmt) {
+	for _, stmt := range evicted {
+		stmt.Close()
+		sc.evictions.Add(1)
+	}
+} // end func closeEvicted
+
+// exec runs statement kind of table on db.
+func (sc *stmtCaches) exec(db *sql.DB, kind int, table string, args ...any) (sql.Result, error) {
+	stmt, err := sc.prepare(db, kind, table)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return db.Exec(sc.query(kind, table), args...)
+	}
+	return stmt.Exec(args...)
+} // end func exec
+
+// txExec runs statement kind of table of db in tx.
+func (sc *stmtCaches) txExec(tx *sql.Tx, db *sql.DB, kind int, table string, args ...any) (sql.Result, error) {
+	stmt, err := sc.prepare(db, kind, table)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return tx.Exec(sc.query(kind, table), args...)
+	}
+	return tx.Stmt(stmt).Exec(args...)
+} // end func txExec
+
+// queryRow runs statement kind of table on db.
+func (sc *stmtCaches) queryRow(db *sql.DB, kind int, table string, args ...any) *sql.Row {
+	stmt, err := sc.prepare(db, kind, table)
+	if err != nil || stmt == nil {
+		// an error of Prepare comes back from QueryRow
+		return db.QueryRow(sc.query(kind, table), args...)
+	}
+	return stmt.QueryRow(args...)
+} // end func queryRow
+
+// drop closes the statements of db: the connection gets closed.
+func (sc *stmtCaches) drop(db *sql.DB) {
+	sc.mux.Lock()
+	cache := sc.conns[db]
+	delete(sc.conns, db)
+	sc.mux.Unlock()
+	if cache == nil {
+		return
+	}
+	for elem := cache.ll.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*stmtEntry).stmt.Close()
+	}
+} // end func drop
+
+// dropAll closes the statements of all connections.
+func (sc *stmtCaches) dropAll() {
+	sc.mux.Lock()
+	conns := make([]*sql.DB, 0, len(sc.conns))
+	for db := range sc.conns {
+		conns = append(conns, db)
+	}
+	sc.mux.Unlock()
+	for _, db := range conns {
+		sc.drop(db)
+	}
+} // end func dropAll
+
+// StmtCacheStats counts the lookups of the prepared statement caches of a backend.
+type StmtCacheStats struct {
+	Size       int    // statements per connection
+	Statements int    // statements cached now
+	Hits       uint64 // lookups which found a statement
+	Misses     uint64 // lookups which prepared a statement
+	Evictions  uint64 // statements closed to stay within Size
+}
+
+// HitRate returns the share of lookups which found a statement: 0.0-1.0.
+func (st StmtCacheStats) HitRate() float64 {
+	if st.Hits+st.Misses == 0 {
+		return 0
+	}
+	return float64(st.Hits) / float64(st.Hits+st.Misses)
+} // end func HitRate
+
+// add sums the counters of st and other.
+func (st StmtCacheStats) add(other StmtCacheStats) StmtCacheStats {
+	st.Size = max(st.Size, other.Size)
+	st.Statements += other.Statements
+	st.Hits += other.Hits
+	st.Misses += other.Misses
+	st.Evictions += other.Evictions
+	return st
+} // end func add
+
+func (sc *stmtCaches) stats() StmtCacheStats {
+	sc.mux.Lock()
+	statements := 0
+	for _, cache := range sc.conns {
+		statements += cache.ll.Len()
+	}
+	sc.mux.Unlock()
+	return StmtCacheStats{
+		Size:       int(sc.size.Load()),
+		Statements: statements,
+		Hits:       sc.hits.Load(),
+		Misses:     sc.misses.Load(),
+		Evictions:  sc.evictions.Load(),
+	}
+} // end func stats
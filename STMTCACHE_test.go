@@ -0,0 +1,195 @@
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStmtDB returns a SQLite3 database with tables t0 ... t<n-1>.
+func testStmtDB(t *testing.T, n int) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "stmt.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	for i := 0; i < n; i++ {
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE t%d (h TEXT PRIMARY KEY, o BLOB)", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestStmtCacheLRU(t *testing.T) {
+	db := testStmtDB(t, 4)
+	sc := newStmtCaches(2, 0, sqliteQuery)
+	steps := []struct {
+		table     string
+		hit       bool
+		evictions uint64
+	}{
+		{"t0", false, 0},
+		{"t1", false, 0},
+		{"t0", true, 0},  // t0 is the most recently used now
+		{"t2", false, 1}, // evicts t1
+		{"t0", true, 1},
+		{"t1", false, 2}, // evicts t2
+		{"t2", false, 3}, // evicts t0
+		{"t1", true, 3},
+	}
+	var hits, misses uint64
+	for i, step := range steps {
+		if _, err := sc.exec(db, stmtUpsert, step.table, "key", []byte("1,"), []byte("1,")); err != nil {
+			t.Fatalf("step %d exec %s err='%v'", i, step.table, err)
+		}
+		if step.hit {
+			hits++
+		} else {
+			misses++
+		}
+		st := sc.stats()
+		if st.Hits != hits || st.Misses != misses || st.Evictions != step.evictions || st.Statements != min(i+1, 2) {
+			t.Fatalf("step %d %s: stats=%+v want hits=%d misses=%d evictions=%d", i, step.table, st, hits, misses, step.evictions)
+		}
+	}
+	sc.drop(db)
+	if st := sc.stats(); st.Statements != 0 {
+		t.Errorf("Statements=%d after drop", st.Statements)
+	}
+}
+
+func TestStmtCacheSize(t *testing.T) {
+	db := testStmtDB(t, 4)
+	sc := newStmtCaches(StmtCacheAuto, 4, sqliteQuery)
+	for _, table := range []string{"t0", "t1", "t2", "t3"} {
+		if err := sc.queryRow(db, stmtSelect, table, "key").Scan(new([]byte)); err != sql.ErrNoRows {
+			t.Fatalf("queryRow %s err='%v'", table, err)
+		}
+	}
+	if st := sc.stats(); st.Size != 4 || st.Statements != 4 || st.Evictions != 0 {
+		t.Fatalf("auto: stats=%+v", st)
+	}
+	// a smaller cache evicts the surplus with the next statement
+	sc.setSize(1)
+	sc.queryRow(db, stmtSelect, "t0", "key").Scan(new([]byte))
+	if st := sc.stats(); st.Size != 1 || st.Statements != 1 || st.Evictions != 3 {
+		t.Fatalf("setSize(1): stats=%+v", st)
+	}
+	sc.setSize(0)
+	if stmt, err := sc.prepare(db, stmtSelect, "t1"); stmt != nil || err != nil {
+		t.Fatalf("disabled cache prepared %v err='%v'", stmt, err)
+	}
+	sc.dropAll()
+}
+
+// TestTableSlots checks that every connection serves as many tables as stmtCacheAuto keeps statements for.
+func TestTableSlots(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tables int
+		conns  int
+		slot   func(table int) int
+	}{
+		{"sqlite3 4096 tables", 4096, 8, (&SQLite3DB{tables: 4096, slots: make([]chan *SQLite3Conn, 8)}).tableSlot},
+		{"sqlite3 256 tables", 256, 8, (&SQLite3DB{tables: 256, slots: make([]chan *SQLite3Conn, 8)}).tableSlot},
+		{"sqlite3 1 table", 1, 8, (&SQLite3DB{tables: 1, slots: make([]chan *SQLite3Conn, 8)}).tableSlot},
+		{"sqlite3 4096 tables 3 conns", 4096, 3, (&SQLite3DB{tables: 4096, slots: make([]chan *SQLite3Conn, 3)}).tableSlot},
+		{"mysql 4096 tables", 4096, 64, (&SQL{slots: make([]chan *DBconn, 64)}).tableSlot},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			perSlot := make([]int, tc.conns)
+			for table := 0; table < tc.tables; table++ {
+				slot := tc.slot(table)
+				if slot < 0 || slot >= tc.conns {
+					t.Fatalf("tableSlot(%d)=%d out of range", table, slot)
+				}
+				perSlot[slot]++
+			}
+			size := stmtCacheAuto(tc.tables, tc.conns)
+			for slot, tables := range perSlot {
+				if 2*tables > size {
+					t.Errorf("slot %d serves %d tables: %d statements, cache size %d", slot, tables, 2*tables, size)
+				}
+			}
+		})
+	}
+	if size := stmtCacheAuto(4096, 64); size != 128 {
+		t.Errorf("mysql stmtCacheAuto=%d want 128", size)
+	}
+}
+
+// TestStmtCacheHitRate runs inserts and lookups over all 4096 tables from concurrent goroutines:
+// with StmtCacheAuto every statement is prepared once and never evicted.
+func TestStmtCacheHitRate(t *testing.T) {
+	const keysPerTable = 2
+	for _, mode := range []int{SHARD_SINGLE_DB, SHARD_16_256} {
+		if mode != SHARD_SINGLE_DB && testing.Short() {
+			continue
+		}
+		t.Run(fmt.Sprintf("mode%d", mode), func(t *testing.T) {
+			var db interface {
+				HashDB
+				StmtCacheStats() StmtCacheStats
+			}
+			if mode == SHARD_SINGLE_DB {
+				pool, err := NewSQLite3Pool(&SQLite3Opts{dbPath: filepath.Join(t.TempDir(), "hashdb.sqlite3"), stmtCache: StmtCacheAuto}, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pool.setOffsetEncoding(OffsetsVarint)
+				db = pool
+			} else {
+				sharded, err := NewSQLite3ShardedDB(&ShardConfig{Mode: mode, BaseDir: t.TempDir(), StmtCacheSize: StmtCacheAuto}, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sharded.setOffsetEncoding(OffsetsVarint)
+				db = sharded
+			}
+			defer db.Close()
+			work := make(chan int)
+			errs := make(chan error, 16)
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for prefix := range work {
+						for k := 0; k < keysPerTable; k++ {
+							key := fmt.Sprintf("%03x%07d", prefix, k)
+							if err := db.InsertOffset(key, int64(prefix+1)); err != nil {
+								errs <- err
+								return
+							}
+							if _, err := db.GetOffsets(key); err != nil {
+								errs <- err
+								return
+							}
+						}
+					}
+				}()
+			}
+			for pass := 0; pass < 2; pass++ {
+				for prefix := 0; prefix < 4096; prefix++ {
+					work <- prefix
+				}
+			}
+			close(work)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			st := db.StmtCacheStats()
+			lookups := uint64(2 * 2 * 4096 * keysPerTable)
+			if st.Misses != 2*4096 || st.Hits != lookups-st.Misses || st.Evictions != 0 || st.Statements != 2*4096 {
+				t.Errorf("stats=%+v want misses=%d hits=%d no evictions", st, 2*4096, lookups-2*4096)
+			}
+			t.Logf("mode %d cache size=%d hit rate=%.2f", mode, st.Size, st.HitRate())
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package history
 
 import (
+	"context"
+	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -12,6 +15,8 @@ const (
 var (
 	IndexParallel     int = NumCacheDBs
 	NumQueueWriteChan int = NumCacheDBs
+	NumQueueIndexChan int = NumCacheDBs
+	WriterWindow      int = 256 // HistoryObjects per history_Writer window
 	HisDatWriteBuffer int = 4 * 1024
 )
 
@@ -20,27 +25,64 @@ type HISTORY struct {
 	 *   set, change, update values only inside (his *HISTORY) functions and
 	 *   don't forget mutex where needed or run into race conditions.
 	 */
-	DIR        string     // path to folder: history/
-	mux        sync.Mutex // global history mutex used to boot
-	cmux       sync.Mutex // sync counter mutex
-	Offset     int64      // the actual offset for history.dat
-	hisDat     string     // = "history/history.dat"
-	cutChar    int
-	WriterChan chan *HistoryObject  // history.dat writer channel
-	IndexChan  chan *HistoryIndex   // main index query channel
-	indexChans []chan *HistoryIndex // sub-index channels (dynamic based on NumCacheDBs)
-	charsMap   map[string]int
-	CutCharRO  int
-	keyalgo    int
-	keylen     int
-	Counter    map[string]uint64
-	WBR        bool     // WatchDBRunning
-	cEvCap     int      // cacheEvictsCapacity
-	indexPar   int      // IndexParallel
-	CPUfile    *os.File // ptr to file for cpu profiling
-	MEMfile    *os.File // ptr to file for mem profiling
+	DIR         string // path to folder: history/
+	opts        BootOptions
+	mux         sync.Mutex // history mutex used to boot
+	cmux        sync.Mutex // sync counter mutex
+	Offset      int64      // the actual offset for history.dat
+	hisDat      string     // = "history/history.dat"
+	cutChar     int
+	WriterChan  chan *HistoryObject  // history.dat writer channel
+	IndexChan   chan *HistoryIndex   // main index query channel
+	indexChans  []chan *HistoryIndex // sub-index channels (dynamic based on NumCacheDBs)
+	charsMap    map[string]int
+	rootDBs     []string      // ['000'...'fff'] chars of the hashDB_Workers
+	lockHistory chan struct{} // history_Writer lock
+	lockIndex   chan struct{} // hashDB_Index main lock
+	lockWorkers chan struct{} // hashDB_Worker sub locks
+	lockReplay  chan struct{} // ReplayHisDat lock
+	lockExpire  chan struct{} // Expire lock
+	expireLast  int64         // now of the last complete Expire run. held by lockExpire
+	expireRedo  atomic.Int64  // lowest arrival+Remember of entries UpdateEntry expired since the last run started, 0: none
+	lockCompact chan struct{} // Compact lock
+	pauseWriter chan *writerPause
+	remap       atomic.Pointer[offsetRemap]    // set while Compact remaps the hashDB
+	migration   atomic.Pointer[shardMigration] // set while MigrateShardMode copies the hashDB
+	reader      *segReader                     // shared read path of history.dat
+	settings    HistorySettings                // header of history.dat: copied into every segment
+	segment     atomic.Int32                   // segment history_Writer appends to
+	segCreated  int64                          // creation time of that segment at boot
+	segHeader   int64                          // header length of that segment at boot
+	inplaceMux  sync.Mutex                     // in-place writes to history.dat: UpdateEntry, Expire. held by Compact
+	acl         AccessControlList
+	listeners   []net.Listener        // historyServer listeners
+	conns       map[net.Conn]struct{} // historyServer connections
+	connMux     sync.Mutex            // protects conns
+	stop        chan struct{}         // closed by Close: rejects new requests and stops background goroutines
+	writerDone  chan struct{}         // closed when history_Writer returned
+	writerErr   error                 // last error of history_Writer. read after writerDone
+	indexDone   chan struct{}         // closed when hashDB_Index returned
+	workersDone chan struct{}         // closed when hashDB_Index and all hashDB_Workers returned
+	workerWG    sync.WaitGroup        // hashDB_Index and hashDB_Workers
+	bgWG        sync.WaitGroup        // historyServer, L1 cache and WatchDB goroutines
+	batchStats  batchCounter          // counters of hashDB_Worker batches
+	syncStats   syncCounter           // counters of history.dat fsyncs
+	reserved    reservations          // hashes reserved by Reserve
+	indexLost   atomic.Bool           // an offset did not reach the hashDB: Close keeps the replay checkpoint
+	consistency ConsistencyReport     // what BootHistory checked and fixed
+	CutCharRO   int
+	keyalgo     int
+	keylen      int
+	Counter     map[string]uint64
+	WBR         bool     // WatchDBRunning
+	cEvCap      int      // cacheEvictsCapacity
+	indexPar    int      // IndexParallel
+	CPUfile     *os.File // ptr to file for cpu profiling
+	MEMfile     *os.File // ptr to file for mem profiling
 	// TCPchan: used to send hobj via handleRConn to a remote historyServer
 	TCPchan chan *HistoryObject
+	// hashDB: index backend used by hashDB_Worker (MySQLPool, SQLite3Pool or a custom HashDB)
+	hashDB HashDB
 	// MySQL RocksDB connection pool
 	MySQLPool *SQL
 	// SQLite3 RocksDB-optimized connection pool (interface{} to avoid import issues)
@@ -56,8 +98,11 @@ type HISTORY struct {
 /* builds the history.dat header */
 type HistorySettings struct {
 	// constant values once DBs are initalized
-	Ka int // keyalgo
-	Kl int // keylen
+	Ka int   // keyalgo
+	Kl int   // keylen
+	Fv int   // record format: FormatText or FormatBinary
+	Sg int   // segment number of this file: 0 is history.dat
+	Ct int64 // unix time the file was created. 0: unknown
 	//Ki int // keyindex
 	//Bp int // bucketsperdb
 }
@@ -69,15 +114,20 @@ type HistoryObject struct {
 	Arrival       int64
 	Expires       int64
 	Date          int64
-	ResponseChan  chan int // receives a 0,1,2 :: pass|duplicate|retrylater
+	ResponseChan  chan int        // receives a 0,1,2 :: pass|duplicate|retrylater
+	ctx           context.Context // set by AddHistoryCtx: history_Writer skips the object if canceled
 }
 
 /* used to query the index */
 type HistoryIndex struct {
 	Hash         string
-	Char         string   // first N chars of hash
-	Offset       int64    // used to search: -1 or add: > 0 a hash
-	IndexRetChan chan int // receives a 0,1,2 :: pass|duplicate|retrylater
+	Char         string          // first N chars of hash
+	Offset       int64           // used to search: -1 or add: > 0 a hash
+	IndexRetChan chan int        // receives a 0,1,2 :: pass|duplicate|retrylater
+	ctx          context.Context // set by IndexQueryCtx: hashDB_Worker skips the query if canceled
+	found        int64           // set by hashDB_Worker with flagLocate before it replies CaseDupes
+	resume       chan struct{}   // flagPause: hashDB_Worker waits until it is closed
+	batch        []*OffsetData   // flagRemove, flagReplay: offsets of the keys of the worker, found gets the number done
 }
 
 type OffsetData struct {
@@ -0,0 +1,142 @@
+package history
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// fsync modes of history.dat
+const (
+	SyncNone     = iota // leave it to the OS. CaseAdded once the line is written and indexed
+	SyncInterval        // fsync every SyncEvery milliseconds. CaseAdded after the next fsync
+	SyncLines           // fsync every SyncEvery lines or latest after syncLinesMaxDelay. CaseAdded after the next fsync
+	SyncAlways          // fsync every window of history_Writer before its offsets go to the index
+)
+
+var (
+	// HisDatSyncMode is the default fsync mode of history.dat: SyncNone ... SyncAlways
+	HisDatSyncMode = SyncNone
+	// HisDatSyncEvery: milliseconds with SyncInterval, lines with SyncLines
+	HisDatSyncEvery int64 = 1000
+)
+
+// syncLinesMaxDelay: with SyncLines a response waits at most this long for the next fsync.
+const syncLinesMaxDelay = time.Second
+
+// SyncStats holds the counters of fsync calls on history.dat.
+type SyncStats struct {
+	Syncs        uint64        // successful fsyncs
+	Errors       uint64        // failed fsyncs
+	Lines        uint64        // lines made durable
+	LastLatency  time.Duration // duration of the last fsync
+	MaxLatency   time.Duration // duration of the slowest fsync
+	TotalLatency time.Duration // sum of all fsync durations
+}
+
+// AvgLatency returns the average duration of a fsync.
+func (ss SyncStats) AvgLatency() time.Duration {
+	if ss.Syncs == 0 {
+		return 0
+	}
+	return ss.TotalLatency / time.Duration(ss.Syncs)
+} // end func AvgLatency
+
+type syncCounter struct {
+	mux   sync.Mutex
+	stats SyncStats
+}
+
+// GetSyncStats returns a copy of the fsync counters.
+func (his *HISTORY) GetSyncStats() SyncStats {
+	his.syncStats.mux.Lock()
+	stats := his.syncStats.stats
+	his.syncStats.mux.Unlock()
+	return stats
+} // end func GetSyncStats
+
+func (his *HISTORY) countSync(lines uint64, latency time.Duration, err error) {
+	his.syncStats.mux.Lock()
+	defer his.syncStats.mux.Unlock()
+	ss := &his.syncStats.stats
+	if err != nil {
+		ss.Errors++
+		return
+	}
+	ss.Syncs++
+	ss.Lines += lines
+	ss.LastLatency = latency
+	if latency > ss.MaxLatency {
+		ss.MaxLatency = latency
+	}
+	ss.TotalLatency += latency
+} // end func countSync
+
+// ack responds CaseAdded once the line of hobj is as durable as the fsync mode demands.
+// Other replies are sent at once.
+func (his *HISTORY) ack(hw *historyWindow, hobj *HistoryObject, isDup int) {
+	if isDup != CaseAdded {
+		respond(hobj, isDup)
+		return
+	}
+	switch his.opts.SyncMode {
+	case SyncInterval, SyncLines:
+		hw.unsynced = append(hw.unsynced, hobj)
+	default:
+		respond(hobj, isDup)
+	}
+} // end func ack
+
+// syncPolicy is called by history_Writer after every window.
+func (his *HISTORY) syncPolicy(hw *historyWindow) error {
+	switch his.opts.SyncMode {
+	case SyncInterval:
+		if len(hw.unsynced) > 0 && hw.syncTimer == nil {
+			hw.syncTimer = time.NewTimer(time.Duration(his.opts.SyncEvery) * time.Millisecond)
+		}
+	case SyncLines:
+		if hw.wroteLines-hw.syncedLines >= uint64(his.opts.SyncEvery) {
+			return his.syncHisDat(hw)
+		}
+		if len(hw.unsynced) > 0 && hw.syncTimer == nil {
+			hw.syncTimer = time.NewTimer(syncLinesMaxDelay)
+		}
+	}
+	return nil
+} // end func syncPolicy
+
+// syncC returns the channel of the running sync timer or nil.
+func (hw *historyWindow) syncC() <-chan time.Time {
+	if hw.syncTimer == nil {
+		return nil
+	}
+	return hw.syncTimer.C
+} // end func syncC
+
+// syncHisDat fsyncs history.dat and sends the responses waiting for it.
+// The bufio.Writer must be flushed before.
+func (his *HISTORY) syncHisDat(hw *historyWindow) error {
+	if hw.syncTimer != nil {
+		hw.syncTimer.Stop()
+		hw.syncTimer = nil
+	}
+	start := time.Now()
+	err := hw.fh.Sync()
+	his.countSync(hw.wroteLines-hw.syncedLines, time.Since(start), err)
+	isDup := CaseAdded
+	if err != nil {
+		log.Printf("ERROR history_Writer fh.Sync err='%v'", err)
+		isDup = CaseError
+	} else {
+		hw.syncedLines = hw.wroteLines
+	}
+	for _, hobj := range hw.unsynced {
+		respond(hobj, isDup)
+	}
+	hw.unsynced = hw.unsynced[:0]
+	if err != nil {
+		return fmt.Errorf("ERROR history_Writer fh.Sync: %w: %w", ErrHisDat, err)
+	}
+	return nil
+} // end func syncHisDat
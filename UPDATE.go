@@ -0,0 +1,169 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// flagLocate asks a hashDB_Worker for the offset of a hash. See locate.
+const flagLocate = -3
+
+// UpdateEntry rewrites Expires and StorageToken of the line of hash in place.
+// newExpires > 0 sets a new Expires, 0 sets never expires and < 0 keeps it.
+// An empty newToken keeps the StorageToken, else it must have the same length as the old one:
+// offsets must not move. A token made only of 'X' marks the entry as expired, see Expire.
+//
+// The line is found through the hashDB and rewritten with WriteAt while history_Writer keeps appending.
+// Returns ErrNotFound if hash is not in history.
+func (his *HISTORY) UpdateEntry(hash string, newExpires int64, newToken string) error {
+	if len(hash) < 64 {
+		return fmt.Errorf("ERROR UpdateEntry hash='%s' too short", hash)
+	}
+	if newExpires > 9999999999 {
+		return fmt.Errorf("ERROR UpdateEntry newExpires=%d has more than 10 digits", newExpires)
+	}
+	if strings.ContainsAny(newToken, "\t\n") {
+		return fmt.Errorf("ERROR UpdateEntry newToken='%s' contains tab or newline", newToken)
+	}
+	if his.isClosed() {
+		return fmt.Errorf("ERROR UpdateEntry: %w", ErrClosed)
+	}
+	// Compact holds inplaceMux while it copies history.dat
+	his.inplaceMux.Lock()
+	defer his.inplaceMux.Unlock()
+	offset, err := his.locate(hash)
+	if err != nil {
+		return err
+	}
+	seg, local := splitOffset(offset)
+	file, err := os.OpenFile(his.segmentPath(seg), os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("ERROR UpdateEntry: %w: %w", ErrHisDat, err)
+	}
+	defer file.Close()
+	hl, line, err := readRecordAt(file, local, his.settings.Fv)
+	if err != nil {
+		return fmt.Errorf("ERROR UpdateEntry offset=%d: %w", offset, err)
+	}
+	if hl.hash != hash {
+		return fmt.Errorf("ERROR UpdateEntry offset=%d holds hash='%s': %w", offset, hl.hash, ErrNotFound)
+	}
+	if newToken != "" && len(newToken) != len(hl.token) {
+		return fmt.Errorf("ERROR UpdateEntry newToken='%s' length %d != %d", newToken, len(newToken), len(hl.token))
+	}
+	if newToken != "" && isExpiredToken([]byte(newToken)) && !isExpiredToken(hl.token) {
+		// Expire removes the key once Remember passed, even if its last run skipped the entry
+		his.redoExpire(hl.arrival + his.opts.Remember)
+	}
+	if his.settings.Fv == FormatBinary {
+		return his.updateRecord(file, offset, line, newExpires, newToken)
+	}
+	// patch a copy of the fixed-width fields: expires~date\ttoken
+	fields := append([]byte(nil), line[lineExpiresPos:len(line)-1]...)
+	if newExpires >= 0 {
+		expiresStr := DefExpiresStr
+		if newExpires > 0 {
+			expiresStr = fmt.Sprintf("%010d", newExpires)
+		}
+		copy(fields, expiresStr)
+	}
+	if newToken != "" {
+		copy(fields[lineTokenPos-lineExpiresPos:], newToken)
+	}
+	if _, err := file.WriteAt(fields, local+lineExpiresPos); err != nil {
+		return fmt.Errorf("ERROR UpdateEntry WriteAt offset=%d: %w: %w", offset, ErrHisDat, err)
+	}
+	if his.opts.SyncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("ERROR UpdateEntry Sync: %w: %w", ErrHisDat, err)
+		}
+	}
+	return nil
+} // end func UpdateEntry
+
+// updateRecord patches expires and token of the binary record rec at offset.
+func (his *HISTORY) updateRecord(file *os.File, offset int64, rec []byte, newExpires int64, newToken string) error {
+	_, local := splitOffset(offset)
+	fields := append([]byte(nil), rec[binExpiresPos:]...)
+	if newExpires >= 0 {
+		binary.BigEndian.PutUint64(fields, uint64(newExpires))
+	}
+	if newToken != "" {
+		fields[binTokenPos-binExpiresPos] = newToken[0]
+	}
+	if _, err := file.WriteAt(fields, local+binExpiresPos); err != nil {
+		return fmt.Errorf("ERROR UpdateEntry WriteAt offset=%d: %w: %w", offset, ErrHisDat, err)
+	}
+	if his.opts.SyncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("ERROR UpdateEntry Sync: %w: %w", ErrHisDat, err)
+		}
+	}
+	return nil
+} // end func updateRecord
+
+// locate returns the offset of the line of hash in history.dat.
+// It asks the hashDB_Worker of hash: offsets waiting in its batch queue are found too.
+func (his *HISTORY) locate(hash string) (int64, error) {
+	if his.IndexChan == nil {
+		return 0, fmt.Errorf("ERROR locate: %w", ErrNoHashDB)
+	}
+	hi := &HistoryIndex{Hash: hash, Offset: flagLocate, IndexRetChan: make(chan int, 1)}
+	indexchan := his.indexChans[his.charsMap[strings.ToLower(hash[:his.cutChar])]]
+	select {
+	case indexchan <- hi:
+	case <-his.workersDone:
+		return 0, fmt.Errorf("ERROR locate hashDB_Worker stopped: %w", ErrClosed)
+	}
+	select {
+	case isDup := <-hi.IndexRetChan:
+		switch isDup {
+		case CaseDupes:
+			return hi.found, nil
+		case CasePass:
+			return 0, fmt.Errorf("ERROR locate hash='%s': %w", hash, ErrNotFound)
+		default:
+			return 0, fmt.Errorf("ERROR locate hash='%s' hashDB_Worker busy: %w", hash, ErrBackendUnavailable)
+		}
+	case <-his.workersDone:
+		return 0, fmt.Errorf("ERROR locate hashDB_Worker stopped: %w", ErrClosed)
+	}
+} // end func locate
+
+// matchOffset returns the offset of offsets whose line holds hash or 0.
+func (his *HISTORY) matchOffset(offsets []int64, char string, hash string) int64 {
+	for _, offset := range offsets {
+		var hashFromFile string
+		if err := his.FseekHistoryMessageHash(nil, offset, char, &hashFromFile); err != nil {
+			continue
+		}
+		if hashFromFile == hash {
+			return offset
+		}
+	}
+	return 0
+} // end func matchOffset
+
+// readHistoryLineAt reads and parses the line at offset.
+func readHistoryLineAt(file io.ReaderAt, offset int64) (historyLine, []byte, error) {
+	// a line has the fixed length lineTokenPos + token + LF: tokens are short
+	buf := make([]byte, lineTokenPos+256)
+	n, err := file.ReadAt(buf, offset)
+	if n == 0 && err != nil {
+		return historyLine{}, nil, fmt.Errorf("%w: %w", ErrHisDat, err)
+	}
+	end := bytes.IndexByte(buf[:n], '\n')
+	if end < 0 {
+		return historyLine{}, nil, fmt.Errorf("no complete line: %w", ErrHisDat)
+	}
+	line := buf[:end+1]
+	hl, ok := parseHistoryLine(line)
+	if !ok {
+		return historyLine{}, nil, fmt.Errorf("bad line='%s': %w", strings.TrimSuffix(string(line), "\n"), ErrHisDat)
+	}
+	return hl, line, nil
+} // end func readHistoryLineAt
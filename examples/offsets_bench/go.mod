@@ -0,0 +1,20 @@
+module offsets_bench
+
+go 1.23.3
+
+toolchain go1.24.3
+
+replace github.com/go-while/nntp-history => ../../
+
+require (
+	github.com/go-while/nntp-history v0.0.0-00010101000000-000000000000
+	github.com/mattn/go-sqlite3 v1.14.28
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/edsrzf/mmap-go v1.2.0 // indirect
+	github.com/go-sql-driver/mysql v1.9.3 // indirect
+	github.com/go-while/go-utils v0.0.0-20230918235104-5ae08e3da7c2 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-while/nntp-history"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// offsets_bench compares the offset encodings of the hashDB: OffsetsText and OffsetsVarint.
+// It fills the same keys into a SQLite3 hashDB of each encoding, reads them back
+// and prints the time and the size of the databases. Then it converts the text hashDB.
+func main() {
+	dir := flag.String("dir", "offsets_bench", "work dir, removed before and after the run")
+	keys := flag.Int("keys", 200000, "number of keys")
+	perKey := flag.Int("offsets", 2, "offsets per key")
+	mode := flag.Int("mode", history.SHARD_16_256, "SQLite3 shard mode")
+	batch := flag.Int("batch", 1000, "offsets per InsertOffsets")
+	flag.Parse()
+
+	if err := os.RemoveAll(*dir); err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(*dir)
+
+	// the same keys and offsets for both encodings
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]*history.OffsetData, 0, *keys**perKey)
+	for i := 0; i < *keys; i++ {
+		key := fmt.Sprintf("%010x", rnd.Int63()&(1<<40-1))
+		for j := 0; j < *perKey; j++ {
+			data = append(data, &history.OffsetData{Shorthash: key, Offset: 4096 + rnd.Int63n(1<<34)})
+		}
+	}
+
+	for _, enc := range []int{history.OffsetsText, history.OffsetsVarint} {
+		run(filepath.Join(*dir, fmt.Sprintf("enc%d", enc)), enc, *mode, *batch, data, *keys)
+	}
+
+	// convert a copy of the text hashDB
+	start := time.Now()
+	converted, err := history.ConvertHashDBOffsets(filepath.Join(*dir, "enc0"), history.OffsetsVarint)
+	if err != nil {
+		log.Fatalf("ConvertHashDBOffsets err='%v'", err)
+	}
+	log.Printf("converted %d keys from text to varint took=%s size=%s",
+		converted, time.Since(start), human(dbSize(filepath.Join(*dir, "enc0"))))
+}
+
+// run fills data into a new hashDB with offset encoding enc and reads every key back.
+func run(dir string, enc int, mode int, batch int, data []*history.OffsetData, keys int) {
+	opts := history.NewBootOptions(dir, history.KeyLen)
+	opts.HashDBDriver = "sqlite3"
+	opts.ShardMode = mode
+	opts.Offsets = enc
+	opts.ServerTCPAddr = ""
+	opts.ServerSocketPath = ""
+	his := &history.HISTORY{}
+	if err := his.BootHistoryWithOptions(opts); err != nil {
+		log.Fatalf("BootHistory err='%v'", err)
+	}
+	db := his.GetHashDB()
+	batcher, ok := db.(history.HashDBBatcher)
+	if !ok {
+		log.Fatalf("hashDB %T has no InsertOffsets", db)
+	}
+
+	start := time.Now()
+	for i := 0; i < len(data); i += batch {
+		if err := batcher.InsertOffsets(data[i:min(i+batch, len(data))]); err != nil {
+			log.Fatalf("InsertOffsets err='%v'", err)
+		}
+	}
+	insert := time.Since(start)
+
+	start = time.Now()
+	found := 0
+	for i := 0; i < len(data); i += len(data) / keys {
+		offsets, err := db.GetOffsets(data[i].Shorthash)
+		if err != nil {
+			log.Fatalf("GetOffsets err='%v'", err)
+		}
+		found += len(offsets)
+	}
+	lookup := time.Since(start)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := his.Close(ctx); err != nil {
+		log.Fatalf("Close err='%v'", err)
+	}
+	log.Printf("encoding=%d offsets=%d insert=%s (%.0f/s) lookup=%s (%.0f/s) found=%d size=%s values=%s",
+		enc, len(data), insert, float64(len(data))/insert.Seconds(),
+		lookup, float64(keys)/lookup.Seconds(), found, human(dbSize(dir)), human(valueBytes(dir)))
+}
+
+// valueBytes returns the length of all stored offset values in dir.
+// The database files hold at least a page per table: with few keys per table their size hides the difference.
+func valueBytes(dir string) int64 {
+	matches, _ := filepath.Glob(filepath.Join(dir, "hashdb*.sqlite3"))
+	var total int64
+	for _, path := range matches {
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var tables []string
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			tables = append(tables, name)
+		}
+		rows.Close()
+		for _, table := range tables {
+			var n int64
+			if err := db.QueryRow("SELECT COALESCE(SUM(LENGTH(CAST(o AS BLOB))), 0) FROM " + table).Scan(&n); err != nil {
+				log.Fatal(err)
+			}
+			total += n
+		}
+		db.Close()
+	}
+	return total
+}
+
+// dbSize returns the size of all database files in dir.
+func dbSize(dir string) int64 {
+	matches, _ := filepath.Glob(filepath.Join(dir, "hashdb*.sqlite3*"))
+	var size int64
+	for _, path := range matches {
+		if st, err := os.Stat(path); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+func human(size int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(size)/1024/1024)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/go-while/nntp-history"
+)
+
+// shard_migrate moves the SQLite3 hashDB of a history to another shard mode.
+// A running history can call MigrateShardMode itself: it keeps accepting writes meanwhile.
+func main() {
+	dir := flag.String("dir", "history", "HistoryDir")
+	from := flag.Int("from", history.SHARD_SINGLE_DB, "current shard mode")
+	to := flag.Int("to", history.SHARD_16_256, "new shard mode")
+	flag.Parse()
+
+	opts := history.NewBootOptions(*dir, history.KeyLen)
+	opts.HashDBDriver = "sqlite3"
+	opts.ShardMode = *from
+	opts.ServerTCPAddr = ""
+	opts.ServerSocketPath = ""
+	his := &history.HISTORY{}
+	if err := his.BootHistoryWithOptions(opts); err != nil {
+		log.Fatalf("BootHistory err='%v'", err)
+	}
+	stats, err := his.MigrateShardMode(*to)
+	if err != nil {
+		log.Printf("MigrateShardMode err='%v'", err)
+	} else {
+		log.Printf("migrated mode %d -> %d keys=%d offsets=%d took=%s", stats.FromMode, stats.ToMode, stats.Keys, stats.Offsets, stats.Duration)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := his.Close(ctx); err != nil {
+		log.Fatalf("Close err='%v'", err)
+	}
+}
@@ -2,6 +2,8 @@ package history
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-while/go-utils"
@@ -35,13 +38,11 @@ const (
 )
 
 var (
-	ForcedReplay         bool
-	NoReplayHisDat       bool
-	UseHashDB            bool  = true                             // controls whether to use hash database for duplicate detection
-	BatchFlushEvery      int64 = 5120                             // milliseconds
-	HISTORY_INDEX_LOCK         = make(chan struct{}, 1)           // main lock
-	HISTORY_INDEX_LOCK16       = make(chan struct{}, NumCacheDBs) // sub locks
-	BootVerbose                = true
+	ForcedReplay    bool         // BootHistory replays history.dat from the first line into the hashDB
+	NoReplayHisDat  bool         // BootHistory does not replay history.dat into the hashDB
+	UseHashDB       bool  = true // controls whether to use hash database for duplicate detection
+	BatchFlushEvery int64 = 5120 // milliseconds
+	BootVerbose           = true
 	//TESTHASH0                  = "0f05e27ca579892a63a256dacd657f5615fab04bf81e85f53ee52103e3a4fae8"
 	//TESTHASH1                  = "f0d784ae13ce7cf1f3ab076027a6265861eb003ad80069cdfb1549dd1b8032e8"
 	//TESTHASH2                  = "f0d784ae1747092974d02bd3359f044a91ed4fd0a39dc9a1feffe646e6c7ce09"
@@ -51,203 +52,412 @@ var (
 	//TESTBUK                    = "0d"
 	//TESTDB                     = "f"
 	//TESTOFFSET                 = 123456
-	ROOTDBS []string
 	//ROOTBUCKETS          []string
 	//SUBBUCKETS           []string
-	BUFLINES    = 10
-	BUFIOBUFFER = 102 * BUFLINES // a history line with sha256 is 102 bytes long including LF or 38 bytes of payload + hashLen
-	History     HISTORY
-	DEBUG       bool = true
-	DEBUG0      bool = false
-	DEBUG1      bool = false
-	DEBUG2      bool = false
-	DEBUG9      bool = false
-	LOCKHISTORY      = make(chan struct{}, 1)
-	HEXCHARS         = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
-	eofhash          = "EOF"
+	BUFLINES            = 10
+	BUFIOBUFFER         = 102 * BUFLINES // a history line with sha256 is 102 bytes long including LF or 38 bytes of payload + hashLen
+	History     HISTORY                  // default instance. every HISTORY keeps its own state and can boot side by side
+	DEBUG       bool    = true
+	DEBUG0      bool    = false
+	DEBUG1      bool    = false
+	DEBUG2      bool    = false
+	DEBUG9      bool    = false
+	HEXCHARS            = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
+	eofhash             = "EOF"
 )
 
 // BootHistory initializes the history component, configuring its settings and preparing it for operation.
 // It sets up the necessary directories for history and hash databases, and opens the history data file.
 // The function also manages the communication channels for reading and writing historical data.
 // If the `useHashDB` parameter is set to true, it initializes the history database (HashDB) and starts worker routines.
+// BootHistory reads its configuration from the package-level globals, see BootHistoryWithOptions.
 // Parameters:
 //   - history_dir: The directory where history data will be stored.
 //   - keylen: The length of the hash values used for indexing.
-func (his *HISTORY) BootHistory(history_dir string, keylen int) {
+func (his *HISTORY) BootHistory(history_dir string, keylen int) error {
+	return his.BootHistoryWithOptions(NewBootOptions(history_dir, keylen))
+} // end func BootHistory
+
+// BootHistoryWithOptions boots the history with its own configuration
+// and does not read or modify the package-level configuration globals.
+// Errors wrap one of the Err* values in ERRORS.go and leave the history unbooted.
+// With AutoMigrate a hashDB of another shard mode is migrated to ShardMode after the boot.
+// A failed migration is logged and the history keeps running with the old shard mode.
+func (his *HISTORY) BootHistoryWithOptions(opts *BootOptions) error {
+	migrateTo, err := his.bootHistory(opts)
+	if err != nil || migrateTo < 0 {
+		return err
+	}
+	if _, err := his.MigrateShardMode(migrateTo); err != nil {
+		log.Printf("ERROR BootHistory AutoMigrate to shard mode %d failed: %v", migrateTo, err)
+	}
+	return nil
+} // end func BootHistoryWithOptions
+
+// bootHistory does the work of BootHistoryWithOptions.
+// Returns the shard mode the hashDB has to be migrated to or -1.
+func (his *HISTORY) bootHistory(opts *BootOptions) (migrateTo int, err error) {
+	migrateTo = -1
+	if opts == nil {
+		return -1, fmt.Errorf("ERROR BootHistoryWithOptions opts=nil: %w", ErrInvalidConfig)
+	}
 	his.mux.Lock()
 	defer his.mux.Unlock()
-	if CPUProfile { // PROFILE.go
+	if his.WriterChan != nil {
+		return -1, fmt.Errorf("ERROR BootHistory: %w", ErrAlreadyBooted)
+	}
+	o := *opts // copy: caller may reuse opts for another history
+	o.sanitize()
+	his.opts = o
+	his.lockHistory = make(chan struct{}, 1)           // history_Writer lock
+	his.lockIndex = make(chan struct{}, 1)             // hashDB_Index main lock
+	his.lockWorkers = make(chan struct{}, NumCacheDBs) // hashDB_Worker sub locks
+	his.lockReplay = make(chan struct{}, 1)            // ReplayHisDat lock
+	his.lockExpire = make(chan struct{}, 1)            // Expire lock
+	his.lockCompact = make(chan struct{}, 1)           // Compact lock
+	his.pauseWriter = make(chan *writerPause)
+	his.stop = make(chan struct{})
+	his.writerDone = make(chan struct{})
+	his.indexDone = make(chan struct{})
+	his.workersDone = make(chan struct{})
+	if o.CPUProfile { // PROFILE.go
 		CPUfile, err := his.startCPUProfile()
 		if err != nil {
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory startCPUProfile: %w", err)
 		}
 		his.CPUfile = CPUfile
 	}
-	if his.WriterChan != nil {
-		log.Printf("ERROR History already booted")
-		return
-	}
+	var fh *os.File
+	var openedDB HashDB // opened by this call: a preset hashDB belongs to the caller
+	defer func() {
+		if err == nil {
+			return
+		}
+		// undo what we did so far
+		log.Printf("%v", err)
+		if fh != nil {
+			fh.Close()
+		}
+		his.closeListeners()
+		close(his.stop)
+		if his.IndexChan != nil {
+			// stops hashDB_Index and the hashDB_Workers of hashDB_Init
+			his.IndexChan <- nil
+			his.workerWG.Wait()
+			his.IndexChan = nil
+		}
+		if openedDB != nil {
+			if cerr := openedDB.Close(); cerr != nil {
+				log.Printf("ERROR BootHistory undo closing hashDB err='%v'", cerr)
+			}
+			his.hashDB, his.SQLite3Pool, his.MySQLPool = nil, nil, nil
+		}
+		if his.reader != nil {
+			his.reader.Close()
+			his.reader = nil
+		}
+		if his.CPUfile != nil {
+			his.stopCPUProfile(his.CPUfile)
+			his.CPUfile = nil
+		}
+	}()
 	rand.Seed(time.Now().UnixNano())
 	his.Counter = make(map[string]uint64)
+	his.consistency = ConsistencyReport{Clean: true}
 
-	go his.startServer(DefaultServerTCPAddr, DefaultSocketPath)
-
-	if NumQueueWriteChan <= 0 {
-		NumQueueWriteChan = 1
-	}
-
-	if BatchFlushEvery <= 2500 { // milliseconds
-		BatchFlushEvery = 2500
-	}
-
-	if DefaultCachePurge <= 0 { // seconds
-		DefaultCachePurge = 1
-	}
-
-	if DefaultCacheExpires <= 0 { // seconds
-		DefaultCacheExpires = 1
-	}
-
-	if DefaultEvictsCapacity <= 0 {
-		DefaultEvictsCapacity = 1
-	}
-	his.cEvCap = DefaultEvictsCapacity
-
-	// hashDB_Index receives a HistoryIndex struct and passes it down to hashDB_Worker['0-9a-f']
-	if IndexParallel <= 0 {
-		IndexParallel = 1
-	} else if IndexParallel > NumCacheDBs {
-		IndexParallel = NumCacheDBs
-	}
-	his.indexPar = IndexParallel
+	his.cEvCap = o.EvictsCapacity
+	his.indexPar = o.IndexParallel
 
-	if history_dir == "" {
-		history_dir = "history"
-	}
+	history_dir := o.HistoryDir
+	keylen := o.KeyLen
 	his.DIR = history_dir
 	if !utils.DirExists(his.DIR) && !utils.Mkdir(his.DIR+"/hashdb") {
-		os.Exit(1)
+		return -1, fmt.Errorf("ERROR BootHistory creating history_dir='%s': %w", history_dir, ErrNoHistoryDir)
 	}
 	his.hisDat = his.DIR + "/history.dat"
 
-	if !utils.DirExists(history_dir) && !utils.Mkdir(history_dir) {
-		log.Printf("ERROR creating history_dir='%s'", history_dir)
-		os.Exit(1)
-	}
-
 	// default history settings
 	his.keyalgo = HashShort
 	his.keylen = keylen
 	if his.keylen != KeyLen {
-		log.Printf("ERROR BootHistory keylen=%d != KeyLen=%d (fixed for MySQL 3-level hex structure)", keylen, KeyLen)
-		os.Exit(1)
+		return -1, fmt.Errorf("ERROR BootHistory keylen=%d != KeyLen=%d (fixed for MySQL 3-level hex structure): %w", keylen, KeyLen, ErrKeyLenMismatch)
 	}
 	history_settings := &HistorySettings{Ka: his.keyalgo, Kl: his.keylen}
+	his.segment.Store(0)
+	segs, err := his.listSegments()
+	if err != nil {
+		return -1, fmt.Errorf("ERROR BootHistory listSegments: %w: %w", ErrHisDat, err)
+	}
 	// opens history.dat
-	var fh *os.File
 	new := false
 	if !utils.FileExists(his.hisDat) {
 		new = true
+		if len(segs) > 0 {
+			return -1, fmt.Errorf("ERROR BootHistory found segments %v without history.dat: %w", segs, ErrHisDat)
+		}
 	}
-	fh, err := os.OpenFile(his.hisDat, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	fh, err = os.OpenFile(his.hisDat, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Printf("ERROR BootHistory os.OpenFile err='%v'", err)
-		os.Exit(1)
+		return -1, fmt.Errorf("ERROR BootHistory os.OpenFile: %w: %w", ErrHisDat, err)
 	}
 	dw := bufio.NewWriterSize(fh, BUFIOBUFFER)
 	var headerdata []byte
 	if new {
 		// create history.dat
-		_, err := gobEncodeHeader(&headerdata, history_settings)
-		if err != nil {
-			log.Printf("ERROR BootHistory gobEncodeHeader err='%v'", err)
-			os.Exit(1)
+		history_settings.Ct = time.Now().Unix()
+		history_settings.Fv = o.Format
+		if _, err := gobEncodeHeader(&headerdata, history_settings); err != nil {
+			return -1, fmt.Errorf("ERROR BootHistory gobEncodeHeader: %w", err)
 		}
 		if err := writeHistoryHeader(dw, headerdata, &his.Offset, true); err != nil {
-			log.Printf("ERROR BootHistory writeHistoryHeader err='%v'", err)
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory writeHistoryHeader: %w: %w", ErrHisDat, err)
 		}
+		his.segHeader = his.Offset
+		his.segCreated = history_settings.Ct
 
 	} else {
 		var header []byte
 		// read history.dat header history_settings
 		if b, err := his.FseekHistoryHeader(&header); b == 0 || err != nil {
-			log.Printf("ERROR BootHistory header FseekHistoryLine err='%v' header='%v'", err, header)
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory header FseekHistoryHeader err='%v': %w", err, ErrBadHeader)
 		}
 		logf(DEBUG0, "BootHistory history.dat headerBytes='%v'", header)
 
 		if err := gobDecodeHeader(header, history_settings); err != nil {
-			log.Printf("ERROR BootHistory gobDecodeHeader err='%v'", err)
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory gobDecodeHeader err='%v': %w", err, ErrBadHeader)
 		}
 		if history_settings.Kl != his.keylen {
-			log.Printf("ERROR BootHistory history_settings.Kl != his.keylen")
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory history_settings.Kl=%d != his.keylen=%d: %w", history_settings.Kl, his.keylen, ErrKeyLenMismatch)
 		}
 		switch history_settings.Ka { // KeyAlgo
 		case HashShort:
 			// pass
 		default:
-			log.Printf("ERROR BootHistory gobDecodeHeader Unknown history_settings.KeyAlgo=%d'", history_settings.Ka)
-			os.Exit(1)
+			return -1, fmt.Errorf("ERROR BootHistory Unknown history_settings.KeyAlgo=%d: %w", history_settings.Ka, ErrBadHeader)
 		}
 		his.keyalgo = history_settings.Ka
 		his.keylen = history_settings.Kl
+		switch history_settings.Fv {
+		case FormatText, FormatBinary:
+			if o.Format != history_settings.Fv {
+				log.Printf("WARN BootHistory Format=%d ignored: history.dat has Fv=%d", o.Format, history_settings.Fv)
+			}
+		default:
+			return -1, fmt.Errorf("ERROR BootHistory Unknown history_settings.Fv=%d: %w", history_settings.Fv, ErrBadHeader)
+		}
+		his.segHeader = int64(len(header)) + 1 // + LF
+		his.segCreated = history_settings.Ct
+		if last := segs[len(segs)-1]; last > 0 {
+			// history_Writer continues in the last segment
+			settings, headerLen, err := readSegmentHeader(his.segmentPath(last))
+			if err != nil {
+				return -1, fmt.Errorf("ERROR BootHistory segment %d: %w", last, err)
+			}
+			if settings.Ka != his.keyalgo || settings.Kl != his.keylen || settings.Fv != history_settings.Fv || settings.Sg != last {
+				return -1, fmt.Errorf("ERROR BootHistory segment %d settings='%#v' do not match history.dat: %w", last, settings, ErrBadHeader)
+			}
+			fh.Close()
+			fh, err = os.OpenFile(his.segmentPath(last), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return -1, fmt.Errorf("ERROR BootHistory os.OpenFile segment %d: %w: %w", last, ErrHisDat, err)
+			}
+			dw.Reset(fh)
+			his.segment.Store(int32(last))
+			his.segHeader = headerLen
+			his.segCreated = settings.Ct
+		}
+		// the running marker survives a crash: cut off what history_Writer did not finish
+		if utils.FileExists(his.DIR + "/" + RunningMarkerFile) {
+			his.consistency.Clean = false
+			cut, err := his.checkHisDatTail(fh.Name(), his.segHeader, history_settings.Fv)
+			if err != nil {
+				return -1, fmt.Errorf("ERROR BootHistory checkHisDatTail: %w: %w", ErrHisDat, err)
+			}
+			his.consistency.TruncatedBytes = cut
+		}
 		//logf(DEBUG2, "Loaded History Settings: '%#v'", history_settings)
 	}
+	if his.segCreated == 0 {
+		his.segCreated = time.Now().Unix() // header without creation time
+	}
+	his.settings = *history_settings
+	his.settings.Sg, his.settings.Ct = 0, 0
+	fileInfo, err := fh.Stat()
+	if err != nil {
+		return -1, fmt.Errorf("ERROR BootHistory fh.Stat: %w: %w", ErrHisDat, err)
+	}
+	his.Offset = segmentOffset(int(his.segment.Load()), fileInfo.Size())
+	his.consistency.Size = his.Offset
+	// shared read path of hashDB_Worker, Lookup and UpdateEntry
+	his.reader = newSegReader(his, o.MmapMax, HisDatMmapGrow)
 
 	switch NumCacheDBs {
 	case 16:
 		his.cutChar = 1
 		his.CutCharRO = his.cutChar
-		ROOTDBS = generateCombinations(HEXCHARS, 1, []string{}, []string{})
+		his.rootDBs = generateCombinations(HEXCHARS, 1, []string{}, []string{})
 	case 256:
 		his.cutChar = 2
 		his.CutCharRO = his.cutChar
-		ROOTDBS = generateCombinations(HEXCHARS, 2, []string{}, []string{})
+		his.rootDBs = generateCombinations(HEXCHARS, 2, []string{}, []string{})
 	case 4096:
 		his.cutChar = 3
 		his.CutCharRO = his.cutChar
-		ROOTDBS = generateCombinations(HEXCHARS, 3, []string{}, []string{})
+		his.rootDBs = generateCombinations(HEXCHARS, 3, []string{}, []string{})
 	default:
-		log.Printf("ERROR BootHistory NumCacheDBs invalid=%d", NumCacheDBs)
-		os.Exit(1)
+		return -1, fmt.Errorf("ERROR BootHistory NumCacheDBs invalid=%d: %w", NumCacheDBs, ErrInvalidConfig)
 	}
 	//his.CutCharRO = his.cutChar
 
-	if UseHashDB {
-		his.hashDB_Init("mysql")
+	if err := his.startServer(o.ServerTCPAddr, o.ServerSocketPath); err != nil {
+		return -1, err
+	}
+
+	if o.UseHashDB {
+		if o.HashDB != nil {
+			his.hashDB = o.HashDB
+		}
+		// a MigrateShardMode may have been interrupted while it swapped the databases
+		mode, err := his.checkShardSwap()
+		if err != nil {
+			return -1, fmt.Errorf("ERROR BootHistory: %w", err)
+		}
+		if mode >= 0 && mode != o.ShardMode {
+			log.Printf("WARN BootHistory ShardMode=%d ignored: the hashDB got migrated to shard mode %d", o.ShardMode, mode)
+			o.ShardMode = mode
+			his.opts.ShardMode = mode
+		}
+		// refuse a hashDB which was built with other options
+		manifest, migrate, err := his.checkManifest(&o, new)
+		if err != nil {
+			return -1, err
+		}
+		migrateTo = migrate
+		his.opts.ShardMode = o.ShardMode
+		preset := his.hashDB != nil
+		db, err := his.openHashDB(o.HashDBDriver, o.ShardMode)
+		if err != nil {
+			return -1, fmt.Errorf("ERROR BootHistory openHashDB: %w", err)
+		}
+		if !preset {
+			openedDB = db
+		}
+		if err := his.openOffsets(manifest, o.Offsets); err != nil {
+			return -1, fmt.Errorf("ERROR BootHistory: %w", err)
+		}
+		// catch up before the workers start: the hashDB may be behind or ahead of history.dat after a crash
+		if err := his.checkHashDB(); err != nil {
+			return -1, fmt.Errorf("ERROR BootHistory checkHashDB: %w", err)
+		}
+		if err := his.hashDB_Init(db); err != nil {
+			return -1, err
+		}
 		log.Printf("hashDB init done")
 	} else {
-		log.Printf("hashDB disabled - initializing L1 cache for lightweight duplicate detection")
-		his.L1.BootL1Cache(his)
-		log.Printf("L1 cache init done")
-	}
+		if his.checkCompactMarker() {
+			os.Remove(his.DIR + "/" + CompactMarkerFile) // no hashDB to rebuild
+		}
+		log.Printf("hashDB disabled - using L1 cache for lightweight duplicate detection")
+	}
+	his.logConsistencyReport()
+	if err := os.WriteFile(his.DIR+"/"+RunningMarkerFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		return -1, fmt.Errorf("ERROR BootHistory writing %s: %w", RunningMarkerFile, err)
+	}
+	// L1 cache locks hashes in flight and remembers recent duplicates
+	his.L1.BootL1Cache(his)
+	log.Printf("L1 cache init done")
+	his.reserved.deadline = make(map[string]time.Time)
+	his.bgWG.Add(1)
+	go his.reserveJanitor()
+	if o.ExpireEvery > 0 {
+		his.bgWG.Add(1)
+		go his.expireScheduler()
+	}
+	go func(wg *sync.WaitGroup, done chan struct{}) {
+		wg.Wait()
+		close(done)
+	}(&his.workerWG, his.workersDone)
 
 	//his.CacheEvictThread(NumCacheEvictThreads) // hardcoded
 
-	logf(BootVerbose, "\n--> BootHistory: new=%t\n hisDat='%s'\n NumQueueWriteChan=%d DefaultCacheExpires=%d\n settings='%#v'", new, his.hisDat, NumQueueWriteChan, DefaultCacheExpires, history_settings)
-	his.WriterChan = make(chan *HistoryObject, NumQueueWriteChan)
+	logf(BootVerbose, "\n--> BootHistory: new=%t\n hisDat='%s'\n NumQueueWriteChan=%d CacheExpires=%d\n settings='%#v'", new, his.hisDat, o.NumQueueWriteChan, o.CacheExpires, history_settings)
+	his.WriterChan = make(chan *HistoryObject, o.NumQueueWriteChan)
 	go his.history_Writer(fh, dw)
-} // end func BootHistory
+	return migrateTo, nil
+} // end func bootHistory
 
 func (his *HISTORY) AddHistory(hobj *HistoryObject, useL1Cache bool) int {
-	if hobj == nil {
-		log.Printf("ERROR AddHistory hobj=nil")
+	isDup, err := his.AddHistoryCtx(context.Background(), hobj)
+	if err != nil {
+		log.Printf("%v", err)
 		return -999
 	}
+	return isDup
+} // end func AddHistory
+
+// AddHistoryCtx sends hobj to history_Writer and waits for the response.
+// If ctx is canceled or its deadline expires while waiting
+// AddHistoryCtx returns CaseRetry and ctx.Err().
+// history_Writer drops a canceled hobj which it did not process yet.
+// A hobj which got processed right before the cancellation stays in history:
+// the retry will then return CaseDupes.
+// If ctx can be canceled hobj.ResponseChan is replaced with a buffered channel
+// so history_Writer never blocks on a response nobody reads.
+// While a hash is being written other AddHistoryCtx calls for it get CaseRetry.
+func (his *HISTORY) AddHistoryCtx(ctx context.Context, hobj *HistoryObject) (int, error) {
+	if hobj == nil {
+		return -999, fmt.Errorf("ERROR AddHistory hobj=nil")
+	}
 	if his.WriterChan == nil {
-		log.Printf("ERROR AddHistory his.WriterChan=nil")
-		return -999
+		return -999, fmt.Errorf("ERROR AddHistory his.WriterChan=nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return CaseRetry, err
+	}
+	if his.isClosed() {
+		return -999, fmt.Errorf("ERROR AddHistory: %w", ErrClosed)
+	}
+	if len(hobj.MessageIDHash) < 64 {
+		return -999, fmt.Errorf("ERROR AddHistory hash='%s' too short", hobj.MessageIDHash)
+	}
+	// single flight: takes over the lock of a previous IndexQuery
+	switch his.L1.WriteL1Cache(hobj.MessageIDHash, his) {
+	case CasePass:
+		// pass
+	case CaseWrite:
+		// another AddHistory is writing this hash
+		his.Sync_upcounter("inflight")
+		return CaseRetry, nil
+	case CaseDupes, CaseAdded:
+		his.unreserve(hobj.MessageIDHash)
+		return CaseDupes, nil
+	default:
+		return -999, fmt.Errorf("ERROR AddHistory WriteL1Cache hash='%s'", hobj.MessageIDHash)
 	}
+	isDup, err := his.addHistoryCtx(ctx, hobj)
+	his.unlockFlight(hobj.MessageIDHash, isDup)
+	return isDup, err
+} // end func AddHistoryCtx
+
+func (his *HISTORY) addHistoryCtx(ctx context.Context, hobj *HistoryObject) (int, error) {
+	if ctx.Done() != nil || hobj.ResponseChan == nil {
+		hobj.ResponseChan = make(chan int, 1)
+	}
+	hobj.ctx = ctx
 
 	//logf(DEBUG, "AddHistory hobj='%#v' before chan CHlen=%d CHcap=%d", hobj, len(his.WriterChan), cap(his.WriterChan))
 
 	// sends it to history_Writer()
 	// blocks if channel is full
-	his.WriterChan <- hobj
+	select {
+	case his.WriterChan <- hobj:
+		// pass
+	case <-ctx.Done():
+		his.Sync_upcounter("ctx_canceled")
+		return CaseRetry, ctx.Err()
+	case <-his.writerDone:
+		return -999, fmt.Errorf("ERROR AddHistory history_Writer stopped: %w", ErrClosed)
+	}
 
 	//logf(DEBUG, "AddHistory hobj='%#v' in chan CHlen=%d CHcap=%d", hobj, len(his.WriterChan), cap(his.WriterChan))
 
@@ -256,153 +466,311 @@ func (his *HISTORY) AddHistory(hobj *HistoryObject, useL1Cache bool) int {
 	case isDup, ok := <-hobj.ResponseChan:
 		if !ok {
 			// error: responseChan got closed
-			log.Printf("ERROR AddHistory responseChan closed! hash='%#v'", hobj.MessageIDHash)
-			return -999
-		} else {
-			return isDup
+			return -999, fmt.Errorf("ERROR AddHistory responseChan closed! hash='%#v'", hobj.MessageIDHash)
+		}
+		return isDup, nil
+	case <-ctx.Done():
+		his.Sync_upcounter("ctx_canceled")
+		return CaseRetry, ctx.Err()
+	case <-his.writerDone:
+		// history_Writer may have replied right before it returned
+		select {
+		case isDup, ok := <-hobj.ResponseChan:
+			if ok {
+				return isDup, nil
+			}
+		default:
 		}
+		return -999, fmt.Errorf("ERROR AddHistory history_Writer stopped: %w", ErrClosed)
 	} // end select
-} // end func AddHistory
+} // end func addHistoryCtx
+
+// isClosed returns true if Close has been called.
+func (his *HISTORY) isClosed() bool {
+	select {
+	case <-his.stop:
+		return true
+	default:
+		return false
+	}
+} // end func isClosed
+
+// isCanceled returns true if ctx is set and got canceled.
+func isCanceled(ctx context.Context) bool {
+	return ctx != nil && ctx.Err() != nil
+} // end func isCanceled
+
+// sendResponse sends isDup to a buffered response channel without blocking.
+func sendResponse(achan chan int, isDup int) {
+	select {
+	case achan <- isDup:
+	default:
+	}
+} // end func sendResponse
 
 // history_Writer writes historical data to the specified file and manages the communication with the history database (HashDB).
-// It listens to incoming HistoryObject structs on th* WriterChan channel, processes them, and writes formatted data to the file.
-// If an index channel (IndexChan) is provided, it also interacts with the history database for duplicate checks.
-// The function periodically flushes the data to the file to ensure data integrity.
+// It listens to incoming HistoryObject structs on th* WriterChan channel and processes them in windows of up to WriterWindow objects:
+// all hashes of a window are checked concurrently, new lines are written in order of arrival,
+// the window is flushed to history.dat and then the offsets are added concurrently to the index.
+// A hash which appears more than once in a window is written only once: the others get CaseDupes.
 func (his *HISTORY) history_Writer(fh *os.File, dw *bufio.Writer) {
 	log.Printf("start history_Writer")
+	defer close(his.writerDone)
 	if fh == nil || dw == nil {
 		log.Printf("ERROR history_Writer fh=nil || dw=nil")
 		return
 	}
-	if !LOCKfunc(LOCKHISTORY, "history_Writer") {
+	if !LOCKfunc(his.lockHistory, "history_Writer") {
 		return
 	}
-	defer fh.Close()
-	defer UNLOCKfunc(LOCKHISTORY, "history_Writer")
+	defer UNLOCKfunc(his.lockHistory, "history_Writer")
 	//log.Printf("start history_Writer Wait4HashDB")
 	//his.Wait4HashDB()
 	log.Printf("started history_Writer OK")
-	fileInfo, err := fh.Stat()
-	if err != nil {
-		log.Printf("ERROR history_Writer fh open Stat err='%v'", err)
-		os.Exit(1)
-	}
-	his.Offset = fileInfo.Size()
 	logf(DEBUG, "history_Writer opened fp='%s' filesize=%d", his.hisDat, his.Offset)
-	flush := false // false: will flush when bufio gets full
-	var wbt uint64
-	var wroteLines uint64
-	var indexRetChan chan int
-	if History.IndexChan != nil {
-		indexRetChan = make(chan int, 1)
-	}
-	buffered := 0
+	hw := &historyWindow{
+		fh:       fh,
+		dw:       dw,
+		hobjs:    make([]*HistoryObject, 0, his.opts.WriterWindow),
+		retChans: make([]chan int, his.opts.WriterWindow),
+		seen:     make(map[string]struct{}, his.opts.WriterWindow),
+		// segment state
+		segHeader:  his.segHeader,
+		segCreated: his.segCreated,
+	}
+	for i := range hw.retChans {
+		hw.retChans[i] = make(chan int, 1)
+	}
+	stop := false
 forever:
-	for {
+	for !stop {
 		if his.WriterChan == nil {
 			log.Printf("history_Writer WriterChan=nil")
 			return
 		}
+		var hobj *HistoryObject
+		var ok bool
 		select {
-		case hobj, ok := <-his.WriterChan: // receives a HistoryObject struct
-			if !ok || hobj == nil {
-				// receiving a nil object stops history_writer
-				if History.IndexChan != nil {
-					History.IndexChan <- nil // stops history_dbz // dont close IndexChan as clients may still send requests
-				}
+		case hobj, ok = <-his.WriterChan: // receives a HistoryObject struct
+		case <-hw.syncC():
+			if err := his.syncHisDat(hw); err != nil {
+				his.writerErr = err
 				break forever
 			}
-			if hobj.MessageIDHash == "" {
-				log.Printf("ERROR history_Writer hobj.MessageIDHash=nil")
+			continue forever
+		case p := <-his.pauseWriter:
+			if err := his.pauseHistoryWriter(hw, p); err != nil {
+				his.writerErr = err
 				break forever
 			}
-			if hobj.StorageToken == "" {
-				log.Printf("ERROR history_Writer hobj.StorageToken=nil")
-				break forever
-			}
-			if hobj.Arrival == 0 {
-				hobj.Arrival = time.Now().Unix()
-			}
-
-			// Check for duplicates using available method (hashDB or L1 cache)
-			var isDup int
-			if UseHashDB && his.IndexChan != nil {
-				// Use hash database for duplicate detection
-				his.IndexChan <- &HistoryIndex{Hash: hobj.MessageIDHash, Char: hobj.Char, Offset: his.Offset, IndexRetChan: indexRetChan}
-				select {
-				case isDup_result, ok := <-indexRetChan:
-					if !ok {
-						log.Printf("ERROR history_Writer indexRetChan closed! error in hashDB_Worker")
-						if hobj.ResponseChan != nil {
-							close(hobj.ResponseChan) // close responseChan to client
-						}
-						if his.IndexChan != nil {
-							his.IndexChan <- nil // stops history_dbz // dont close IndexChan as clients may still send requests
-						}
-						break forever
-					}
-					isDup = isDup_result
-				} // end select
-			} else {
-				// Use L1 cache for lightweight duplicate detection
-				result, err := his.IndexQuery(hobj.MessageIDHash, nil, his.Offset)
-				if err != nil {
-					log.Printf("ERROR history_Writer IndexQuery err='%v'", err)
-					if hobj.ResponseChan != nil {
-						hobj.ResponseChan <- CaseError
-						close(hobj.ResponseChan)
-					}
-					break forever
+			continue forever
+		}
+		if !ok || hobj == nil {
+			// receiving a nil object stops history_writer
+			break forever
+		}
+		hw.hobjs = append(hw.hobjs[:0], hobj)
+	fill:
+		for len(hw.hobjs) < his.opts.WriterWindow {
+			select {
+			case hobj, ok := <-his.WriterChan:
+				if !ok || hobj == nil {
+					// process the window and stop
+					stop = true
+					break fill
 				}
-				isDup = result
-			}
-
-			if hobj.ResponseChan != nil {
-				hobj.ResponseChan <- isDup
+				hw.hobjs = append(hw.hobjs, hobj)
+			default:
+				break fill
 			}
-			switch isDup {
-			case CaseDupes:
-				continue forever
-			case CaseRetry:
-				// got EOF retry from dupecheck. flush history file so next check may hit
-				if err := dw.Flush(); err != nil {
-					log.Printf("ERROR history_Writer dw.Flush err='%v'", err)
-					break forever
+		}
+		if his.rotateDue(hw) {
+			if err := his.rotateSegment(hw); err != nil {
+				log.Printf("ERROR history_Writer rotateSegment err='%v'", err)
+				his.writerErr = err
+				for _, hobj := range hw.hobjs {
+					respond(hobj, CaseError)
 				}
-				log.Printf("INFO history_Writer CaseRetry EOF flushed hisDat hash='%s' offset=%d", hobj.MessageIDHash, his.Offset)
-				continue forever
-			case CaseAdded:
-				// pass
-			default:
-				log.Printf("ERROR history_Writer unknown Switch after indexRetChan: isDup=%d=%x", isDup, isDup)
-				break forever
-			} // end switch isDup
-
-			if err := his.writeHistoryLine(dw, hobj, flush, &wbt, &buffered); err != nil {
-				log.Printf("ERROR history_Writer writeHistoryLine err='%v'", err)
 				break forever
 			}
-			wroteLines++
-		} // end select
+		}
+		if err := his.writeWindow(hw); err != nil {
+			log.Printf("ERROR history_Writer writeWindow err='%v'", err)
+			// Close keeps RunningMarkerFile: the next boot checks the tail of history.dat
+			his.writerErr = err
+			break forever
+		}
+		if err := his.syncPolicy(hw); err != nil {
+			his.writerErr = err
+			break forever
+		}
 	} // end for
+	if his.IndexChan != nil {
+		his.IndexChan <- nil // stops hashDB_Index and hashDB_Workers // dont close IndexChan as clients may still send requests
+	}
 	if err := dw.Flush(); err != nil {
 		log.Printf("ERROR history_Writer dw.Flush() err='%v'", err)
+		his.writerErr = fmt.Errorf("ERROR history_Writer dw.Flush: %w: %w", ErrHisDat, err)
+	}
+	if err := his.syncHisDat(hw); err != nil {
+		his.writerErr = err
 	}
-	if err := fh.Close(); err != nil {
+	if err := hw.fh.Close(); err != nil { // Compact may have replaced fh
 		log.Printf("ERROR history_Writer fh.Close err='%v'", err)
+		his.writerErr = fmt.Errorf("ERROR history_Writer fh.Close: %w: %w", ErrHisDat, err)
 	}
-	logf(ALWAYS, "history_Writer closed fp='%s' wbt=%d offset=%d wroteLines=%d", his.hisDat, wbt, his.Offset, wroteLines)
+	logf(ALWAYS, "history_Writer closed fp='%s' wbt=%d offset=%d wroteLines=%d", his.hisDat, hw.wbt, his.Offset, hw.wroteLines)
 } // end func history_Writer
 
-func (his *HISTORY) writeHistoryLine(dw *bufio.Writer, hobj *HistoryObject, flush bool, wbt *uint64, bufferedptr *int) error {
-	expiresStr := DefExpiresStr
-	if hobj.Expires > 0 {
-		expiresStr = fmt.Sprintf("%010d", hobj.Expires) // leftpad zeros to 10 digit
+// historyWindow holds the state of history_Writer between windows.
+type historyWindow struct {
+	fh         *os.File
+	dw         *bufio.Writer
+	hobjs      []*HistoryObject    // received objects of this window
+	pass       []*HistoryObject    // objects which passed the checks
+	offsets    []int64             // offsets of the written lines of pass
+	retChans   []chan int          // one reply channel per index request
+	seen       map[string]struct{} // hashes of this window
+	buffered   int
+	wbt        uint64
+	wroteLines uint64
+	// fsync state
+	syncedLines uint64           // wroteLines at the last fsync
+	unsynced    []*HistoryObject // CaseAdded responses waiting for the next fsync
+	syncTimer   *time.Timer      // runs while unsynced waits for SyncInterval or syncLinesMaxDelay
+	// segment state
+	segHeader  int64 // header length of the current segment
+	segCreated int64 // unix time the current segment was created
+}
+
+// writeWindow processes all objects of hw.hobjs.
+// Every object gets exactly one response.
+// Returns an error only if writing history.dat failed: history_Writer stops.
+func (his *HISTORY) writeWindow(hw *historyWindow) error {
+	hw.pass = hw.pass[:0]
+	clear(hw.seen)
+	for _, hobj := range hw.hobjs {
+		if isCanceled(hobj.ctx) {
+			// caller of AddHistoryCtx gave up: drop hobj
+			sendResponse(hobj.ResponseChan, CaseRetry)
+			his.Sync_upcounter("ctx_dropped")
+			continue
+		}
+		if hobj.MessageIDHash == "" || hobj.StorageToken == "" {
+			log.Printf("ERROR history_Writer hobj.MessageIDHash='%s' hobj.StorageToken='%s'", hobj.MessageIDHash, hobj.StorageToken)
+			respond(hobj, CaseError)
+			continue
+		}
+		if his.settings.Fv == FormatBinary && (!isSha256Hex(hobj.MessageIDHash) || len(hobj.StorageToken) != 1) {
+			log.Printf("ERROR history_Writer binary format needs sha256 and 1 char token: hobj.MessageIDHash='%s' hobj.StorageToken='%s'", hobj.MessageIDHash, hobj.StorageToken)
+			respond(hobj, CaseError)
+			continue
+		}
+		if _, dupe := hw.seen[hobj.MessageIDHash]; dupe {
+			// same hash arrived twice in this window
+			respond(hobj, CaseDupes)
+			his.Sync_upcounter("duplicates")
+			continue
+		}
+		hw.seen[hobj.MessageIDHash] = struct{}{}
+		if hobj.Arrival == 0 {
+			hobj.Arrival = time.Now().Unix()
+		}
+		hw.pass = append(hw.pass, hobj)
 	}
+
+	if his.IndexChan != nil {
+		// check all hashes concurrently: previous windows are flushed so hashDB_Worker can verify every offset
+		for i, hobj := range hw.pass {
+			his.IndexChan <- &HistoryIndex{Hash: hobj.MessageIDHash, Char: hobj.Char, Offset: FlagSearch, IndexRetChan: hw.retChans[i]}
+		}
+		n := 0
+		for i, hobj := range hw.pass {
+			isDup := <-hw.retChans[i]
+			if isDup != CasePass {
+				respond(hobj, isDup)
+				continue
+			}
+			hw.pass[n] = hobj
+			n++
+		}
+		hw.pass = hw.pass[:n]
+	}
+	if len(hw.pass) == 0 {
+		return nil
+	}
+
+	// write lines in order of arrival
+	hw.offsets = hw.offsets[:0]
+	for i, hobj := range hw.pass {
+		offset := his.Offset
+		if err := his.writeHistoryLine(hw.dw, hobj, false, &hw.wbt, &hw.buffered); err != nil {
+			for _, hobj := range hw.pass[i:] {
+				respond(hobj, CaseError)
+			}
+			return err
+		}
+		hw.offsets = append(hw.offsets, offset)
+		hw.wroteLines++
+	}
+	// lines must be readable before their offsets go to the index
+	if err := hw.dw.Flush(); err != nil {
+		for _, hobj := range hw.pass {
+			respond(hobj, CaseError)
+		}
+		return err
+	}
+	if his.opts.SyncMode == SyncAlways {
+		// lines must be durable before their offsets go to the index
+		if err := his.syncHisDat(hw); err != nil {
+			for _, hobj := range hw.pass {
+				respond(hobj, CaseError)
+			}
+			return err
+		}
+	}
+
+	if his.IndexChan == nil {
+		// Use L1 cache for lightweight duplicate detection
+		for i, hobj := range hw.pass {
+			isDup, err := his.IndexQuery(hobj.MessageIDHash, nil, hw.offsets[i])
+			if err != nil {
+				log.Printf("ERROR history_Writer IndexQuery err='%v'", err)
+				isDup = CaseError
+			}
+			his.ack(hw, hobj, isDup)
+		}
+		return nil
+	}
+	// add all offsets concurrently
+	for i, hobj := range hw.pass {
+		his.IndexChan <- &HistoryIndex{Hash: hobj.MessageIDHash, Char: hobj.Char, Offset: hw.offsets[i], IndexRetChan: hw.retChans[i]}
+	}
+	for i, hobj := range hw.pass {
+		isDup := <-hw.retChans[i]
+		if isDup != CaseAdded {
+			log.Printf("ERROR history_Writer hashDB add hash='%s' offset=%d isDup=%x", hobj.MessageIDHash, hw.offsets[i], isDup)
+		}
+		his.ack(hw, hobj, isDup)
+	}
+	return nil
+} // end func writeWindow
+
+// respond sends isDup to hobj.ResponseChan if set.
+func respond(hobj *HistoryObject, isDup int) {
+	if hobj.ResponseChan != nil {
+		hobj.ResponseChan <- isDup
+	}
+} // end func respond
+
+func (his *HISTORY) writeHistoryLine(dw *bufio.Writer, hobj *HistoryObject, flush bool, wbt *uint64, bufferedptr *int) error {
 	//if hobj.MessageIDHash == TESTHASH {
 	//	log.Printf("writeHistoryLine TESTHASH='%s' offset=%d", hobj.MessageIDHash, his.Offset)
 	//}
-	line := fmt.Sprintf("{%s}\t%010d~%s~%010d\t%s\n", hobj.MessageIDHash, hobj.Arrival, expiresStr, hobj.Date, hobj.StorageToken) // leftpad zeros to 10 digit
+	line, err := encodeRecord(nil, hobj, his.settings.Fv)
+	if err != nil {
+		return err
+	}
 	//logf(DEBUG, "writeHistoryLine='%s'", line)
 	ll := len(line)
 	// check and flush only complete lines
@@ -410,7 +778,7 @@ func (his *HISTORY) writeHistoryLine(dw *bufio.Writer, hobj *HistoryObject, flus
 		log.Printf("ERROR writeHistoryLine checkWriteBuffer cerr='%v'", cerr)
 		return cerr
 	}
-	if wb, err := dw.WriteString(line); err != nil {
+	if wb, err := dw.Write(line); err != nil {
 		log.Printf("ERROR history_Writer WriteString err='%v'", err)
 		return err
 	} else {
@@ -479,17 +847,38 @@ func (his *HISTORY) FseekHistoryMessageHash(file *os.File, offset int64, char st
 	if offset <= 0 || rethash == nil {
 		return fmt.Errorf("ERROR FseekHistoryMessageHash io nil")
 	}
+	if file == nil && his.reader != nil {
+		// shared mmap or fd: no open/seek per lookup
+		hash, err := his.reader.readHashAt(offset)
+		if err != nil {
+			return err
+		}
+		if hash != eofhash {
+			go his.Sync_upcounter("FSEEK")
+		}
+		*rethash = hash
+		return nil
+	}
+	seg, local := splitOffset(offset)
 	if file == nil {
 		var err error
-		file, err = os.OpenFile(his.hisDat, os.O_RDONLY, 0666)
+		file, err = os.OpenFile(his.segmentPath(seg), os.O_RDONLY, 0666)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
 	}
+	if his.settings.Fv == FormatBinary {
+		hash, err := readHashAt(file, local, FormatBinary)
+		if err != nil {
+			return err
+		}
+		*rethash = hash
+		return nil
+	}
 
 	// Seek to the specified offset
-	_, seekErr := file.Seek(offset, 0)
+	_, seekErr := file.Seek(local, 0)
 	if seekErr != nil {
 		log.Printf("ERROR FseekHistoryMessageHash seekErr='%v' fp='%s'", seekErr, his.hisDat)
 		return seekErr
@@ -525,7 +914,7 @@ func (his *HISTORY) FseekHistoryMessageHash(file *os.File, offset int64, char st
 
 func (his *HISTORY) FseekHistoryHeader(output *[]byte) (int, error) {
 	if output == nil {
-		log.Printf("ERROR FseekHistoryHeader output=nil")
+		return 0, fmt.Errorf("ERROR FseekHistoryHeader output=nil")
 	}
 	file, err := os.OpenFile(his.hisDat, os.O_RDONLY, 0666)
 	if err != nil {
@@ -546,14 +935,24 @@ func (his *HISTORY) FseekHistoryHeader(output *[]byte) (int, error) {
 	return len(*output), nil
 } // end func FseekHistoryHeader
 
+// FseekHistoryLine returns the line at offset without LF. offset selects the segment, see splitOffset.
+// A binary record is returned as text line.
 func (his *HISTORY) FseekHistoryLine(offset int64) (string, error) {
-	file, err := os.OpenFile(his.hisDat, os.O_RDONLY, 0666)
+	seg, local := splitOffset(offset)
+	file, err := os.OpenFile(his.segmentPath(seg), os.O_RDONLY, 0666)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
+	if local > 0 && his.settings.Fv == FormatBinary {
+		hl, _, err := readRecordAt(file, local, FormatBinary)
+		if err != nil {
+			return "", fmt.Errorf("ERROR FseekHistoryLine offset=%d: %w", offset, err)
+		}
+		return recordText(hl), nil
+	}
 	// Seek to the specified offset
-	_, seekErr := file.Seek(offset, 0)
+	_, seekErr := file.Seek(local, 0)
 	if seekErr != nil {
 		return "", seekErr
 	}
@@ -568,7 +967,7 @@ func (his *HISTORY) FseekHistoryLine(offset int64) (string, error) {
 	}
 	//result := strings.Split(line, "\t")[0]
 	if len(result) > 0 {
-		if offset > 0 && result[0] != '{' {
+		if local > 0 && result[0] != '{' {
 			return "", fmt.Errorf("ERROR FseekHistoryLine line[0]!='{' offset=%d line='%s'", offset, result)
 		}
 	}
@@ -576,11 +975,26 @@ func (his *HISTORY) FseekHistoryLine(offset int64) (string, error) {
 	return result, nil
 } // end func FseekHistoryLine
 
+// IndexQuery checks (offset <= 0) or adds (offset > 0) hash.
+// A check locks hash in L1 cache when it returns CasePass:
+// other checks for the same hash get CaseRetry until AddHistory returns or the lock expires.
 func (his *HISTORY) IndexQuery(hash string, indexRetChan chan int, offset int64) (int, error) {
 	if len(hash) < 64 {
 		return -999, fmt.Errorf("ERROR IndexQuery hash=nil")
 	}
 
+	if offset > 0 {
+		// Insert mode
+		if his.IndexChan == nil {
+			// add hash to L1 cache when hash database is not available
+			his.L1.Set(hash, "", CaseAdded, FlagExpires, his)
+			return CaseAdded, nil
+		}
+	} else if isDup := his.lockFlight(hash); isDup != CasePass || his.IndexChan == nil {
+		// in flight, known duplicate or L1 cache only
+		return isDup, nil
+	}
+
 	// If hash database is available, use it
 	if his.IndexChan != nil {
 		if indexRetChan == nil {
@@ -588,49 +1002,151 @@ func (his *HISTORY) IndexQuery(hash string, indexRetChan chan int, offset int64)
 			indexRetChan = make(chan int, 1)
 		}
 		//logf(hash == TESTHASH0, "IndexQuery hash='%s' indexRetChan='%#v' offset=%d his.IndexChan=%d/%d", hash, indexRetChan, offset, len(his.IndexChan), cap(his.IndexChan))
-		if offset > 0 {
-			his.IndexChan <- &HistoryIndex{Hash: hash, Offset: offset, IndexRetChan: indexRetChan}
-		} else {
-			his.IndexChan <- &HistoryIndex{Hash: hash, Offset: -1, IndexRetChan: indexRetChan}
+		hi := &HistoryIndex{Hash: hash, Offset: offset, IndexRetChan: indexRetChan}
+		if offset <= 0 {
+			hi.Offset = -1
+		}
+		// Close stops hashDB_Index and the hashDB_Workers: a query must not wait for them forever
+		select {
+		case his.IndexChan <- hi:
+			// pass
+		case <-his.indexDone:
+			if offset <= 0 {
+				his.unlockFlight(hash, CaseError)
+			}
+			return -999, fmt.Errorf("ERROR IndexQuery hashDB_Index stopped: %w", ErrClosed)
 		}
 		select {
 		case isDup, ok := <-indexRetChan:
 			if !ok {
+				if offset <= 0 {
+					his.unlockFlight(hash, CaseError)
+				}
 				return -999, fmt.Errorf("ERROR IndexQuery indexRetChan closed! error in hashDB_Worker")
 			}
+			if offset <= 0 {
+				his.unlockFlight(hash, isDup)
+			}
 			return isDup, nil
-		} // end select
-	}
-
-	// Fallback to L1 cache when hash database is not available
-	if !UseHashDB {
-		if offset > 0 {
-			// Insert mode: add hash to L1 cache
-			his.L1.Set(hash, "", CaseAdded, true, his)
-			return CaseAdded, nil
-		} else {
-			// Query mode: check L1 cache for duplicates
-			result := his.L1.LockL1Cache(hash, CaseDupes, his)
-			if result == CasePass {
-				// Not found in cache, it's new
-				return CasePass, nil
-			} else {
-				// Found in cache, it's a duplicate
-				return CaseDupes, nil
+		case <-his.workersDone:
+			select {
+			case isDup, ok := <-indexRetChan:
+				if ok {
+					if offset <= 0 {
+						his.unlockFlight(hash, isDup)
+					}
+					return isDup, nil
+				}
+			default:
 			}
-		}
+			if offset <= 0 {
+				his.unlockFlight(hash, CaseError)
+			}
+			return -999, fmt.Errorf("ERROR IndexQuery hashDB_Worker stopped: %w", ErrClosed)
+		} // end select
 	}
 
 	return -999, fmt.Errorf("ERROR IndexQuery - no hash database or L1 cache available")
 } // end func IndexQuery
 
+// lockFlight locks hash in L1 cache before a check.
+// Returns CasePass if the caller holds the lock,
+// CaseRetry if hash is in flight or CaseDupes if hash is a known duplicate.
+func (his *HISTORY) lockFlight(hash string) int {
+	switch isDup := his.L1.LockL1Cache(hash, CaseLock, his); isDup {
+	case CasePass:
+		return CasePass
+	case CaseLock, CaseWrite:
+		his.Sync_upcounter("inflight")
+		return CaseRetry
+	case CaseDupes, CaseAdded:
+		return CaseDupes
+	default:
+		return CaseError
+	}
+} // end func lockFlight
+
+// unlockFlight stores the result of a check or write of hash in L1 cache.
+// CasePass keeps the lock for the following AddHistory.
+// Duplicates are remembered until L1 cache expires them, anything else removes the lock.
+func (his *HISTORY) unlockFlight(hash string, isDup int) {
+	switch isDup {
+	case CasePass:
+		// pass
+	case CaseAdded, CaseDupes:
+		his.L1.Set(hash, "", CaseDupes, FlagExpires, his)
+		his.unreserve(hash) // stored or rejected as duplicate
+	default:
+		his.L1.DelL1Cache(hash, his)
+	}
+} // end func unlockFlight
+
+// IndexQueryCtx checks if hash exists in history.
+// Returns CasePass, CaseDupes, CaseRetry or an error.
+// If ctx is canceled or its deadline expires while waiting
+// IndexQueryCtx returns CaseRetry and ctx.Err().
+// hashDB_Worker drops a canceled query which it did not process yet.
+func (his *HISTORY) IndexQueryCtx(ctx context.Context, hash string) (int, error) {
+	if len(hash) < 64 {
+		return -999, fmt.Errorf("ERROR IndexQueryCtx hash=nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return CaseRetry, err
+	}
+	if his.isClosed() {
+		return -999, fmt.Errorf("ERROR IndexQueryCtx: %w", ErrClosed)
+	}
+	if isDup := his.lockFlight(hash); isDup != CasePass || his.IndexChan == nil {
+		// in flight, known duplicate or L1 cache only: does not block
+		return isDup, nil
+	}
+	isDup, err := his.indexQueryCtx(ctx, hash)
+	his.unlockFlight(hash, isDup)
+	return isDup, err
+} // end func IndexQueryCtx
+
+func (his *HISTORY) indexQueryCtx(ctx context.Context, hash string) (int, error) {
+	// always use a new buffered channel: a late reply must not hit the next query
+	indexRetChan := make(chan int, 1)
+	select {
+	case his.IndexChan <- &HistoryIndex{Hash: hash, Offset: FlagSearch, IndexRetChan: indexRetChan, ctx: ctx}:
+		// pass
+	case <-ctx.Done():
+		his.Sync_upcounter("ctx_canceled")
+		return CaseRetry, ctx.Err()
+	case <-his.indexDone:
+		return -999, fmt.Errorf("ERROR IndexQueryCtx hashDB_Index stopped: %w", ErrClosed)
+	}
+	select {
+	case isDup, ok := <-indexRetChan:
+		if !ok {
+			return -999, fmt.Errorf("ERROR IndexQueryCtx indexRetChan closed! error in hashDB_Worker")
+		}
+		return isDup, nil
+	case <-ctx.Done():
+		his.Sync_upcounter("ctx_canceled")
+		return CaseRetry, ctx.Err()
+	case <-his.workersDone:
+		select {
+		case isDup, ok := <-indexRetChan:
+			if ok {
+				return isDup, nil
+			}
+		default:
+		}
+		return -999, fmt.Errorf("ERROR IndexQueryCtx hashDB_Worker stopped: %w", ErrClosed)
+	} // end select
+} // end func indexQueryCtx
+
 // hashDB_Index listens to incoming HistoryIndex structs on the IndexChan channel
 // and distributes them to corresponding hashDB_Worker goroutines.
 func (his *HISTORY) hashDB_Index() {
-	if !LOCKfunc(HISTORY_INDEX_LOCK, "hashDB_Index") {
+	defer his.workerWG.Done()
+	if !LOCKfunc(his.lockIndex, "hashDB_Index") {
 		return
 	}
-	defer UNLOCKfunc(HISTORY_INDEX_LOCK, "hashDB_Index")
+	defer UNLOCKfunc(his.lockIndex, "hashDB_Index")
+	defer close(his.indexDone)
 	//his.Wait4HashDB()
 	//logf(DEBUG2, "Boot hashDB_Index")
 	if DEBUG2 {
@@ -650,10 +1166,9 @@ func (his *HISTORY) hashDB_Index() {
 						break forever
 					}
 					if hi == nil || len(hi.Hash) < 64 { // allow at least sha256
-						switch his.indexPar {
-						case 1:
-							close(his.IndexChan)
-						default:
+						if his.indexPar > 1 {
+							// passes nil to the next hashDB_Index goroutine
+							// dont close IndexChan as clients may still send requests
 							his.IndexChan <- nil
 						}
 						logf(DEBUG2, "Stopping hashDB_Index IndexChan p=%d/%d received nil pointer", p, his.indexPar)
@@ -691,17 +1206,47 @@ func (his *HISTORY) hashDB_Index() {
 } // end func hashDB_Index
 
 func (his *HISTORY) hashDB_Worker(char string, i int, indexchan chan *HistoryIndex) {
-	if !LOCKfunc(HISTORY_INDEX_LOCK16, "hashDB_Worker "+char) {
+	defer his.workerWG.Done()
+	if !LOCKfunc(his.lockWorkers, "hashDB_Worker "+char) {
 		return
 	}
-	defer UNLOCKfunc(HISTORY_INDEX_LOCK16, "hashDB_Worker "+char)
+	defer UNLOCKfunc(his.lockWorkers, "hashDB_Worker "+char)
 
 	logf(DEBUG2, "Boot hashDB_Worker [%s]", char)
 	defer logf(DEBUG2, "Quit hashDB_Worker [%s]", char)
 
+	// bq queues inserts if batching is enabled or while Compact remaps the hashDB
+	batching := his.opts.BatchFlushMax > 1
+	bq := newBatchQueue(char, max(his.opts.BatchFlushMax, 1))
+	defer func() {
+		if his.remap.Load() != nil {
+			// Compact did not finish: the next boot rebuilds the hashDB
+			his.indexLost.Store(true)
+			return
+		}
+		// commits what is left before the worker quits
+		if err := bq.flush(his); err != nil {
+			his.indexLost.Store(true)
+		}
+	}()
+	var ticker chan struct{} // stays nil if batching is disabled
+	if batching {
+		ticker = make(chan struct{}, 1)
+		stopTicker := make(chan struct{})
+		go his.BatchTicker(char, ticker, stopTicker)
+		defer close(stopTicker)
+	}
+
 forever:
 	for {
 		select {
+		case <-ticker:
+			if his.remap.Load() == nil {
+				if err := bq.flush(his); err != nil {
+					// items stay queued: Close keeps the replay checkpoint if they never get committed
+					his.indexLost.Store(true)
+				}
+			}
 		case hi, ok := <-indexchan:
 			if !ok {
 				logf(DEBUG2, "hashDB_Worker [%s] indexchan closed", char)
@@ -715,6 +1260,41 @@ forever:
 				log.Printf("ERROR hashDB_Worker [%s] hi.IndexRetChan=nil", char)
 				continue forever
 			}
+			if hi.Offset == flagFlush {
+				// workerBarrier: offsets queued while Compact remaps the hashDB are held back
+				if his.remap.Load() == nil && bq.flush(his) != nil {
+					hi.IndexRetChan <- CaseError
+					continue forever
+				}
+				hi.IndexRetChan <- CaseAdded
+				continue forever
+			}
+			if hi.Offset == flagRemove {
+				// forget: the worker owns the keys of char, no append runs meanwhile
+				hi.IndexRetChan <- his.removeOffsets(bq, hi)
+				continue forever
+			}
+			if hi.Offset == flagReplay {
+				// ReplayHisDat on a booted history: sees the offsets queued in bq
+				hi.IndexRetChan <- his.replayOffsets(bq, hi)
+				continue forever
+			}
+			if hi.Offset == flagPause {
+				// pauseWorkers: commit the queue and keep off the hashDB until resumed
+				if bq.flush(his) != nil {
+					hi.IndexRetChan <- CaseError
+					continue forever
+				}
+				hi.IndexRetChan <- CaseAdded
+				<-hi.resume
+				continue forever
+			}
+			if isCanceled(hi.ctx) {
+				// caller of IndexQueryCtx gave up: drop query
+				sendResponse(hi.IndexRetChan, CaseRetry)
+				his.Sync_upcounter("ctx_dropped")
+				continue forever
+			}
 
 			// Extract the key from the hash (first 3 chars for table, next 7 chars for key)
 			if len(hi.Hash) < 10 { // need at least 10 chars: 3 for table + 7 for key
@@ -726,14 +1306,48 @@ forever:
 			// Use first 10 chars: first 3 for table selection, next 7 as key
 			fullKey := hi.Hash[:10]
 
+			if hi.Offset == flagLocate {
+				// locate: returns the offset of the line of hash
+				if his.remap.Load() != nil {
+					hi.IndexRetChan <- CaseRetry
+					continue forever
+				}
+				offsets, err := his.hashDB.GetOffsets(fullKey)
+				if err != nil {
+					log.Printf("ERROR hashDB_Worker [%s] GetOffsets fullKey='%s' err='%v'", char, fullKey, err)
+					hi.IndexRetChan <- CaseRetry
+					continue forever
+				}
+				offsets = append(offsets, bq.pending[fullKey]...)
+				if offset := his.matchOffset(offsets, char, hi.Hash); offset > 0 {
+					hi.found = offset
+					hi.IndexRetChan <- CaseDupes
+				} else {
+					hi.IndexRetChan <- CasePass
+				}
+				continue forever
+			}
+
 			if hi.Offset == -1 {
 				// Query mode: check if hash exists
-				offsets, err := his.MySQLPool.GetOffsets(fullKey, nil)
+				offsets, err := his.hashDB.GetOffsets(fullKey)
 				if err != nil {
 					log.Printf("ERROR hashDB_Worker [%s] GetOffsets fullKey='%s' err='%v'", char, fullKey, err)
 					hi.IndexRetChan <- CaseRetry
 					continue forever
 				}
+				// offsets still waiting in the batch queue
+				offsets = append(offsets, bq.pending[fullKey]...)
+				if r := his.remap.Load(); r != nil {
+					// Compact is remapping the hashDB: an offset can be old or new
+					if his.remapMatch(r, offsets, char, hi.Hash) {
+						hi.IndexRetChan <- CaseDupes
+						go his.Sync_upcounter("duplicates")
+					} else {
+						hi.IndexRetChan <- CasePass
+					}
+					continue forever
+				}
 
 				if len(offsets) > 1 {
 					// Multiple offsets: need to check history.dat file at each offset to find exact match
@@ -781,9 +1395,21 @@ forever:
 				}
 			} else if hi.Offset > 0 {
 				// Insert mode: add hash with offset
-				err := his.MySQLPool.InsertOffset(fullKey, hi.Offset, nil)
+				if remapping := his.remap.Load() != nil; batching || remapping {
+					bq.add(fullKey, hi.Offset)
+					hi.IndexRetChan <- CaseAdded
+					go his.Sync_upcounter("inserted")
+					if len(bq.items) >= his.opts.BatchFlushMax && !remapping {
+						if err := bq.flush(his); err != nil {
+							his.indexLost.Store(true)
+						}
+					}
+					continue forever
+				}
+				err := his.insertOffset(fullKey, hi.Offset)
 				if err != nil {
 					log.Printf("ERROR hashDB_Worker [%s] InsertOffset fullKey='%s' offset=%d err='%v'", char, fullKey, hi.Offset, err)
+					his.indexLost.Store(true)
 					hi.IndexRetChan <- CaseRetry
 					continue forever
 				}
@@ -818,61 +1444,114 @@ func (his *HISTORY) SET_DEBUG(debug int) {
 	}
 } // end func SET_DEBUG
 
+// CLOSE_HISTORY closes the history and waits until everything is stopped.
+// Use Close to set a deadline.
 func (his *HISTORY) CLOSE_HISTORY() {
-	log.Printf("CLOSE_HISTORY aquire lock")
+	if err := his.Close(context.Background()); err != nil {
+		log.Printf("ERROR CLOSE_HISTORY err='%v'", err)
+	}
+} // end func CLOSE_HISTORY
+
+// Close shuts the history down in this order:
+//   - rejects new requests with ErrClosed and closes the historyServer listeners.
+//   - history_Writer processes all queued HistoryObjects, flushes and fsyncs history.dat.
+//   - hashDB_Index and hashDB_Workers process all queued HistoryIndex requests.
+//   - closes historyServer connections and stops L1 cache and WatchDB goroutines.
+//   - closes the hashDB backend and stops cpu profiling.
+//
+// Close returns when everything is stopped or ctx is done.
+// The returned error joins everything which failed or is still running.
+func (his *HISTORY) Close(ctx context.Context) error {
 	his.mux.Lock()
-	defer his.mux.Unlock()
-	log.Printf("CLOSE_HISTORY aquired lock ok")
-	defer log.Printf("CLOSE_HISTORY DONE")
-	if his.WriterChan == nil {
-		log.Printf("ERROR CLOSE_HISTORY his.WriterChan=nil")
-		return
+	if his.stop == nil || his.WriterChan == nil {
+		his.mux.Unlock()
+		return fmt.Errorf("ERROR Close: %w", ErrNotBooted)
 	}
-	log.Printf("CLOSE_HISTORY: his.WriterChan <- nil")
-	his.WriterChan <- nil // closes workers
-	for {
+	if his.isClosed() {
+		his.mux.Unlock()
+		return fmt.Errorf("ERROR Close: %w", ErrClosed)
+	}
+	close(his.stop)
+	his.mux.Unlock()
+	log.Printf("Close history hisDat='%s'", his.hisDat)
+	defer log.Printf("Close history DONE hisDat='%s'", his.hisDat)
 
-		lock1, v1 := len(LOCKHISTORY) > 0, len(LOCKHISTORY)
-		lock2, v2 := len(HISTORY_INDEX_LOCK) > 0, len(HISTORY_INDEX_LOCK)
-		lock3, v3 := len(HISTORY_INDEX_LOCK16) > 0, len(HISTORY_INDEX_LOCK16)
-		lock5, v5 := false, 0
-		//if his.useHashDB {
-		//	lock5, v5 = len(his.batchQueues.BootCh) > 0, len(his.batchQueues.BootCh)
-		//}
+	var errs []error
+	his.closeListeners()
 
-		batchQ, batchLOCKS := 0, 0
-		//if his.useHashDB {
-		/*
-			for _, char := range ROOTDBS {
-				for _, bucket := range ROOTBUCKETS {
-					batchQ += len(his.batchQueues.Maps[char][bucket])
-					batchLOCKS += len(his.BatchLocks[char].bl[bucket].ch)
+	// drain WriterChan: the nil pointer is queued behind all pending requests
+	select {
+	case his.WriterChan <- nil:
+	case <-his.writerDone:
+	case <-ctx.Done():
+	}
+	if err := waitDone(ctx, his.writerDone); err != nil {
+		errs = append(errs, fmt.Errorf("ERROR Close history_Writer still running: %w", err))
+	} else if his.writerErr != nil {
+		errs = append(errs, his.writerErr)
+	} else if err := os.Remove(his.DIR + "/" + RunningMarkerFile); err != nil {
+		// history.dat is complete: next boot skips the consistency check
+		errs = append(errs, fmt.Errorf("ERROR Close removing %s: %w", RunningMarkerFile, err))
+	}
+	workersDone := waitDone(ctx, his.workersDone) == nil
+	if !workersDone {
+		errs = append(errs, fmt.Errorf("ERROR Close hashDB_Index=%d hashDB_Workers=%d still running: %w", len(his.lockIndex), len(his.lockWorkers), ctx.Err()))
+	}
+
+	his.closeConns()
+	bgDone := make(chan struct{})
+	go func() {
+		his.bgWG.Wait()
+		close(bgDone)
+	}()
+	bgStopped := waitDone(ctx, bgDone) == nil
+	if !bgStopped {
+		errs = append(errs, fmt.Errorf("ERROR Close historyServer, L1 cache or WatchDB goroutines still running: %w", ctx.Err()))
+	}
+
+	// workers still running may hold connections of the backend
+	if db := his.GetHashDB(); db != nil {
+		if !workersDone {
+			errs = append(errs, fmt.Errorf("ERROR Close hashDB not closed: workers still running"))
+		} else {
+			if his.writerErr == nil && !his.indexLost.Load() {
+				// every line in history.dat reached the hashDB: next boot needs no replay
+				if err := his.writeReplayCheckpoint(his.Offset); err != nil {
+					errs = append(errs, err)
 				}
+			} else if his.indexLost.Load() {
+				errs = append(errs, fmt.Errorf("ERROR Close: %w: next boot replays history.dat", ErrIndexLost))
+			}
+			if err := db.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("ERROR Close hashDB: %w", err))
 			}
-		*/
-		//}
-		batchQueued := batchQ > 0
-		batchLocked := batchLOCKS > 0
-		if !lock1 && !lock2 && !lock3 && !lock5 && !batchQueued && !batchLocked {
-			break
 		}
-		// if batchQ < NumCacheDBs*RootBuckets: it's most likely remaining 'nil' pointers which should be returned on next BatchFlushEvery
-		// if v5 >= NumCacheDBs*RootBuckets: all batchQueues are still running
-		log.Printf("WAIT CLOSE_HISTORY: lock1=%t=%d lock2=%t=%d lock3=%t=%d lock5=%t=%d batchQueued=%t=%d batchLocked=%t=%d", lock1, v1, lock2, v2, lock3, v3, lock5, v5, batchQueued, batchQ, batchLocked, batchLOCKS)
-		time.Sleep(time.Second)
 	}
-	//his.WriterChan = nil
+
+	if his.reader != nil && workersDone && bgStopped {
+		if err := his.reader.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("ERROR Close reader: %w: %w", ErrHisDat, err))
+		}
+	}
+
+	his.mux.Lock()
 	if his.CPUfile != nil {
 		his.stopCPUProfile(his.CPUfile)
+		his.CPUfile = nil
 	}
-	/*
-		 *
-		if his.MEMfile != nil {
-			his.stopMEMProfile(his.CPUfile)
-		}
-		*
-	*/
-} // end func CLOSE_HISTORY
+	his.mux.Unlock()
+	return errors.Join(errs...)
+} // end func Close
+
+// waitDone waits until done is closed or ctx is done.
+func waitDone(ctx context.Context, done chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+} // end func waitDone
 
 func LOCKfunc(achan chan struct{}, src string) bool {
 	select {
@@ -933,18 +1612,32 @@ func generateCombinations(hexChars []string, length int, currentCombination []st
 	return combinations
 }
 
-func (his *HISTORY) BatchTicker(char string, ticker chan struct{}) {
+// BatchTicker signals hashDB_Worker [char] to flush its batch queue every BatchFlushEvery milliseconds.
+// Returns when stop is closed.
+func (his *HISTORY) BatchTicker(char string, ticker chan struct{}, stop chan struct{}) {
 	//isleep := 32
-	isleep := BatchFlushEvery // / int64(RootBUCKETSperDB)
+	isleep := his.opts.BatchFlushEvery // / int64(RootBUCKETSperDB)
 	if isleep <= 4 {
 		isleep = 4
 	}
-	log.Printf("BatchTicker [%s] isleep=%d", char, isleep)
+	logf(DEBUG2, "BatchTicker [%s] isleep=%d", char, isleep)
+	// spread the first tick so the workers dont flush all at once
+	timer := time.NewTimer(time.Duration(rand.Int63n(isleep)+1) * time.Millisecond)
+	defer timer.Stop()
 	for {
-		ticker <- struct{}{}
-		time.Sleep(time.Duration(isleep) * time.Millisecond)
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			select {
+			case ticker <- struct{}{}:
+			default:
+				// worker is busy: has a pending tick
+			}
+			timer.Reset(time.Duration(isleep) * time.Millisecond)
+		}
 	}
-}
+} // end func BatchTicker
 
 // InitializeDatabase initializes either MySQL or SQLite3 database backend
 func (his *HISTORY) InitializeDatabase(useMySQL bool) error {
@@ -955,7 +1648,9 @@ func (his *HISTORY) InitializeDatabase(useMySQL bool) error {
 func (his *HISTORY) InitializeDatabaseWithSharding(useMySQL bool, shardMode int) error {
 	if useMySQL {
 		// Initialize MySQL RocksDB
-		his.hashDB_Init("mysql")
+		if _, err := his.openHashDB("mysql", shardMode); err != nil {
+			return err
+		}
 		log.Printf("Initialized MySQL RocksDB backend")
 	} else {
 		// Initialize SQLite3 with specified sharding mode